@@ -0,0 +1,386 @@
+// Package cache provides a sector cache in front of a tinyfs.BlockDevice.
+//
+// FatFs reads the FAT and directory sectors over and over while a file is
+// streamed. Cache keeps the recently used sectors in memory, reads ahead on
+// sequential access and optionally defers writes until Sync() (write-back).
+package cache
+
+import (
+	"tinygo.org/x/tinyfs"
+)
+
+const (
+	SectorSize = 512
+
+	defaultSectors = 8
+)
+
+type Config struct {
+	Sectors   int  // number of cached sectors (0: 8)
+	ReadAhead int  // sectors read ahead of a sequential read miss
+	WriteBack bool // keep written sectors until Sync() or eviction
+}
+
+// Stats are the cache statistics counted since New() or ResetStats().
+type Stats struct {
+	Hits       uint32 // sectors found in the cache
+	Misses     uint32 // sectors read from the device on demand
+	ReadAhead  uint32 // sectors read ahead of a miss
+	WriteBacks uint32 // dirty sectors written to the device
+}
+
+type entry struct {
+	sector int64
+	data   []byte
+	valid  bool
+	dirty  bool
+	used   uint32 // LRU stamp
+}
+
+// Cache is a tinyfs.BlockDevice caching the sectors of dev.
+type Cache struct {
+	dev       tinyfs.BlockDevice
+	entries   []entry
+	scratch   []byte
+	readAhead int
+	writeBack bool
+	clock     uint32
+	last      int64 // last sector read
+	stats     Stats
+}
+
+// New returns a cache in front of dev. A nil config selects a write-through
+// cache of 8 sectors without read-ahead.
+func New(dev tinyfs.BlockDevice, config *Config) *Cache {
+	if config == nil {
+		config = &Config{}
+	}
+	sectors := config.Sectors
+	if sectors <= 0 {
+		sectors = defaultSectors
+	}
+	readAhead := config.ReadAhead
+	if readAhead > sectors-1 {
+		readAhead = sectors - 1
+	}
+	if readAhead < 0 {
+		readAhead = 0
+	}
+	c := &Cache{
+		dev:       dev,
+		entries:   make([]entry, sectors),
+		scratch:   make([]byte, (1+readAhead)*SectorSize),
+		readAhead: readAhead,
+		writeBack: config.WriteBack,
+		last:      -2,
+	}
+	mem := make([]byte, sectors*SectorSize)
+	for i := range c.entries {
+		c.entries[i].data = mem[i*SectorSize : (i+1)*SectorSize]
+	}
+	return c
+}
+
+// Stats returns the cache statistics.
+func (c *Cache) Stats() Stats {
+	return c.stats
+}
+
+// ResetStats clears the cache statistics.
+func (c *Cache) ResetStats() {
+	c.stats = Stats{}
+}
+
+// ReadAt reads len(buf) bytes at offset off. Aligned reads of at least the
+// cache size bypass the cache.
+func (c *Cache) ReadAt(buf []byte, off int64) (int, error) {
+	if off%SectorSize == 0 && len(buf)%SectorSize == 0 && len(buf) >= len(c.entries)*SectorSize {
+		n, err := c.dev.ReadAt(buf, off)
+		if err != nil {
+			return n, err
+		}
+		// dirty sectors are newer than the device
+		for i := range c.entries {
+			e := &c.entries[i]
+			if e.valid && e.dirty && e.sector*SectorSize >= off && e.sector*SectorSize < off+int64(len(buf)) {
+				copy(buf[e.sector*SectorSize-off:], e.data)
+			}
+		}
+		return n, nil
+	}
+
+	n := 0
+	for n < len(buf) {
+		pos := off + int64(n)
+		sector := pos / SectorSize
+		e, err := c.read(sector)
+		if err != nil {
+			return n, err
+		}
+		n += copy(buf[n:], e.data[pos%SectorSize:])
+	}
+	return n, nil
+}
+
+// WriteAt writes buf at offset off. Whole sectors are written through to the
+// device unless the cache is write-back and the write is smaller than the
+// cache.
+func (c *Cache) WriteAt(buf []byte, off int64) (int, error) {
+	n := 0
+	for n < len(buf) {
+		pos := off + int64(n)
+		sector := pos / SectorSize
+		start := int(pos % SectorSize)
+		remain := len(buf) - n
+		if start == 0 && remain >= SectorSize && (!c.writeBack || remain >= len(c.entries)*SectorSize) {
+			count := remain / SectorSize
+			data := buf[n : n+count*SectorSize]
+			if _, err := c.dev.WriteAt(data, pos); err != nil {
+				return n, err
+			}
+			c.update(sector, data)
+			n += len(data)
+			continue
+		}
+
+		var e *entry
+		var err error
+		if start == 0 && remain >= SectorSize {
+			// overwritten entirely, no need to read it
+			e = c.lookup(sector)
+			if e == nil {
+				e, err = c.alloc(sector)
+			}
+		} else {
+			e, err = c.read(sector)
+		}
+		if err != nil {
+			return n, err
+		}
+		m := copy(e.data[start:], buf[n:])
+		if c.writeBack {
+			e.dirty = true
+		} else if _, err := c.dev.WriteAt(e.data, sector*SectorSize); err != nil {
+			e.valid = false
+			return n, err
+		}
+		n += m
+	}
+	return n, nil
+}
+
+// Sync writes the dirty sectors to the device and syncs it.
+func (c *Cache) Sync() error {
+	for i := range c.entries {
+		if err := c.flush(&c.entries[i]); err != nil {
+			return err
+		}
+	}
+	if syncer, ok := c.dev.(tinyfs.Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// Invalidate drops all cached sectors including the dirty ones, e.g. when
+// the medium was changed.
+func (c *Cache) Invalidate() {
+	for i := range c.entries {
+		c.entries[i].valid = false
+		c.entries[i].dirty = false
+	}
+	c.last = -2
+}
+
+// Size returns the size of the device in bytes.
+func (c *Cache) Size() int64 {
+	return c.dev.Size()
+}
+
+// WriteBlockSize returns the write block size of the device.
+func (c *Cache) WriteBlockSize() int64 {
+	return c.dev.WriteBlockSize()
+}
+
+// EraseBlockSize returns the erase block size of the device.
+func (c *Cache) EraseBlockSize() int64 {
+	return c.dev.EraseBlockSize()
+}
+
+// EraseBlocks erases blocks of the device and drops them from the cache.
+func (c *Cache) EraseBlocks(start, len int64) error {
+	size := c.dev.EraseBlockSize()
+	c.drop(start*size, len*size)
+	return c.dev.EraseBlocks(start, len)
+}
+
+// Trim discards n bytes at offset off. Devices without Trim only get the
+// erase blocks erased which lie entirely in the range.
+func (c *Cache) Trim(off, n int64) error {
+	if trimmer, ok := c.dev.(interface{ Trim(off, n int64) error }); ok {
+		c.drop(off, n)
+		return trimmer.Trim(off, n)
+	}
+	size := c.dev.EraseBlockSize()
+	start := (off + size - 1) / size
+	end := (off + n) / size
+	if end <= start {
+		return nil
+	}
+	return c.EraseBlocks(start, end-start)
+}
+
+// removable is implemented by devices with removable media such as
+// sdcard.Device.
+type removable interface {
+	Ready() bool
+	Configure() error
+	WriteProtected() bool
+}
+
+// Ready reports whether the medium of the device is ready.
+func (c *Cache) Ready() bool {
+	if r, ok := c.dev.(removable); ok {
+		return r.Ready()
+	}
+	return true
+}
+
+// Configure initializes a newly inserted medium and invalidates the cache.
+func (c *Cache) Configure() error {
+	c.Invalidate()
+	if r, ok := c.dev.(removable); ok {
+		return r.Configure()
+	}
+	return nil
+}
+
+// WriteProtected reports whether the medium of the device is write
+// protected.
+func (c *Cache) WriteProtected() bool {
+	if r, ok := c.dev.(removable); ok {
+		return r.WriteProtected()
+	}
+	return false
+}
+
+// lookup returns the cached sector, nil if it is not cached.
+func (c *Cache) lookup(sector int64) *entry {
+	for i := range c.entries {
+		e := &c.entries[i]
+		if e.valid && e.sector == sector {
+			c.clock++
+			e.used = c.clock
+			return e
+		}
+	}
+	return nil
+}
+
+// alloc evicts the least recently used sector and assigns its entry to
+// sector.
+func (c *Cache) alloc(sector int64) (*entry, error) {
+	victim := &c.entries[0]
+	for i := range c.entries {
+		e := &c.entries[i]
+		if !e.valid {
+			victim = e
+			break
+		}
+		if e.used < victim.used {
+			victim = e
+		}
+	}
+	if err := c.flush(victim); err != nil {
+		return nil, err
+	}
+	c.clock++
+	victim.sector = sector
+	victim.valid = true
+	victim.used = c.clock
+	return victim, nil
+}
+
+// read returns the cached sector, reading it from the device on a miss. A
+// miss following the previously read sector also reads ahead.
+func (c *Cache) read(sector int64) (*entry, error) {
+	sequential := sector == c.last+1
+	c.last = sector
+	if e := c.lookup(sector); e != nil {
+		c.stats.Hits++
+		return e, nil
+	}
+	c.stats.Misses++
+
+	count := int64(1)
+	if sequential {
+		count += int64(c.readAhead)
+		if end := c.dev.Size() / SectorSize; sector+count > end {
+			count = end - sector
+		}
+		// do not replace sectors already cached, which may be dirty
+		for i := int64(1); i < count; i++ {
+			if c.lookup(sector+i) != nil {
+				count = i
+				break
+			}
+		}
+	}
+	if count < 1 {
+		count = 1
+	}
+	data := c.scratch[:count*SectorSize]
+	if _, err := c.dev.ReadAt(data, sector*SectorSize); err != nil {
+		return nil, err
+	}
+
+	// read ahead sectors first, so that sector is the most recently used
+	for i := count - 1; i >= 0; i-- {
+		e, err := c.alloc(sector + i)
+		if err != nil {
+			return nil, err
+		}
+		copy(e.data, data[i*SectorSize:])
+		if i == 0 {
+			return e, nil
+		}
+		c.stats.ReadAhead++
+	}
+	return nil, nil
+}
+
+// update refreshes the cached copies of the sectors written from sector.
+func (c *Cache) update(sector int64, data []byte) {
+	count := int64(len(data) / SectorSize)
+	for i := range c.entries {
+		e := &c.entries[i]
+		if e.valid && e.sector >= sector && e.sector < sector+count {
+			copy(e.data, data[(e.sector-sector)*SectorSize:])
+			e.dirty = false
+		}
+	}
+}
+
+// drop removes the sectors in n bytes at offset off from the cache.
+func (c *Cache) drop(off, n int64) {
+	for i := range c.entries {
+		e := &c.entries[i]
+		if e.valid && (e.sector+1)*SectorSize > off && e.sector*SectorSize < off+n {
+			e.valid = false
+			e.dirty = false
+		}
+	}
+}
+
+// flush writes e to the device if it is dirty.
+func (c *Cache) flush(e *entry) error {
+	if !e.valid || !e.dirty {
+		return nil
+	}
+	if _, err := c.dev.WriteAt(e.data, e.sector*SectorSize); err != nil {
+		return err
+	}
+	e.dirty = false
+	c.stats.WriteBacks++
+	return nil
+}
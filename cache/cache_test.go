@@ -0,0 +1,238 @@
+package cache
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/elehobica/pico_tinygo_vs1053/fatfs"
+	"tinygo.org/x/tinyfs"
+)
+
+// countingDevice counts the device accesses
+type countingDevice struct {
+	tinyfs.BlockDevice
+	reads  int
+	writes int
+	syncs  int
+}
+
+func (d *countingDevice) ReadAt(buf []byte, off int64) (int, error) {
+	d.reads++
+	return d.BlockDevice.ReadAt(buf, off)
+}
+
+func (d *countingDevice) WriteAt(buf []byte, off int64) (int, error) {
+	d.writes++
+	return d.BlockDevice.WriteAt(buf, off)
+}
+
+func (d *countingDevice) Sync() error {
+	d.syncs++
+	return nil
+}
+
+func newTestDevice() *countingDevice {
+	return &countingDevice{BlockDevice: tinyfs.NewMemoryDevice(64, 4096, 64)}
+}
+
+func pattern(n int, seed byte) []byte {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = byte(i) ^ seed
+	}
+	return buf
+}
+
+func TestHitMiss(t *testing.T) {
+	dev := newTestDevice()
+	c := New(dev, &Config{Sectors: 4})
+	buf := make([]byte, 16)
+	for i := 0; i < 3; i++ {
+		_, err := c.ReadAt(buf, 5*SectorSize+8)
+		check(t, err)
+	}
+	if dev.reads != 1 {
+		t.Errorf("expected 1 device read, got %d", dev.reads)
+	}
+	if s := c.Stats(); s.Hits != 2 || s.Misses != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	c.ResetStats()
+	if s := c.Stats(); s != (Stats{}) {
+		t.Errorf("stats not reset %+v", s)
+	}
+}
+
+func TestLRU(t *testing.T) {
+	dev := newTestDevice()
+	c := New(dev, &Config{Sectors: 2})
+	buf := make([]byte, 1)
+	read := func(sector int64) {
+		_, err := c.ReadAt(buf, sector*SectorSize)
+		check(t, err)
+	}
+	read(10)
+	read(20)
+	read(10) // hit, 20 is now the least recently used
+	read(30) // evicts 20
+	read(10) // hit
+	read(20) // miss
+	if s := c.Stats(); s.Hits != 2 || s.Misses != 4 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestReadAhead(t *testing.T) {
+	dev := newTestDevice()
+	data := pattern(16*SectorSize, 0x5a)
+	dev.BlockDevice.WriteAt(data, 0)
+
+	c := New(dev, &Config{Sectors: 8, ReadAhead: 3})
+	buf := make([]byte, 100)
+	for off := 0; off+len(buf) <= len(data); off += len(buf) {
+		_, err := c.ReadAt(buf, int64(off))
+		check(t, err)
+		if !bytes.Equal(buf, data[off:off+len(buf)]) {
+			t.Fatalf("data mismatch at %d", off)
+		}
+	}
+	// sector 0 is read alone, then 4 sectors per device read
+	if dev.reads != 5 {
+		t.Errorf("expected 5 device reads, got %d", dev.reads)
+	}
+	if s := c.Stats(); s.Misses != 5 || s.ReadAhead != 12 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestWriteThrough(t *testing.T) {
+	dev := newTestDevice()
+	c := New(dev, nil)
+	data := pattern(300, 1)
+	_, err := c.WriteAt(data, 400)
+	check(t, err)
+	got := make([]byte, len(data))
+	dev.BlockDevice.ReadAt(got, 400)
+	if !bytes.Equal(got, data) {
+		t.Error("data not written through")
+	}
+	reads := dev.reads
+	_, err = c.ReadAt(got, 400)
+	check(t, err)
+	if dev.reads != reads || !bytes.Equal(got, data) {
+		t.Error("written sectors not cached")
+	}
+}
+
+func TestWriteBack(t *testing.T) {
+	dev := newTestDevice()
+	c := New(dev, &Config{Sectors: 4, WriteBack: true})
+	data := pattern(2*SectorSize, 2)
+	_, err := c.WriteAt(data, 3*SectorSize)
+	check(t, err)
+	_, err = c.WriteAt([]byte{0xaa}, 3*SectorSize+7)
+	check(t, err)
+	data[7] = 0xaa
+	if dev.writes != 0 {
+		t.Errorf("expected no device write, got %d", dev.writes)
+	}
+
+	// a bypassing read still sees the dirty sectors
+	got := make([]byte, 8*SectorSize)
+	_, err = c.ReadAt(got, 0)
+	check(t, err)
+	if !bytes.Equal(got[3*SectorSize:5*SectorSize], data) {
+		t.Error("dirty sectors not read back")
+	}
+
+	check(t, c.Sync())
+	if dev.writes != 2 || dev.syncs != 1 {
+		t.Errorf("expected 2 writes and 1 sync, got %d and %d", dev.writes, dev.syncs)
+	}
+	if s := c.Stats(); s.WriteBacks != 2 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	dev.BlockDevice.ReadAt(got[:len(data)], 3*SectorSize)
+	if !bytes.Equal(got[:len(data)], data) {
+		t.Error("data not written back")
+	}
+
+	// eviction writes back as well
+	c.WriteAt([]byte{1}, 0)
+	for sector := int64(10); sector < 14; sector++ {
+		c.ReadAt(got[:1], sector*SectorSize)
+	}
+	dev.BlockDevice.ReadAt(got[:1], 0)
+	if got[0] != 1 {
+		t.Error("evicted sector not written back")
+	}
+}
+
+func TestErase(t *testing.T) {
+	dev := newTestDevice()
+	c := New(dev, nil)
+	buf := make([]byte, 1)
+	c.WriteAt([]byte{0x12}, 0)
+	check(t, c.EraseBlocks(0, 1))
+	_, err := c.ReadAt(buf, 0)
+	check(t, err)
+	if buf[0] != 0xff {
+		t.Errorf("erased sector still cached: %02x", buf[0])
+	}
+}
+
+func TestTrim(t *testing.T) {
+	dev := newTestDevice()
+	c := New(dev, nil)
+	buf := make([]byte, 1)
+	c.WriteAt([]byte{0x12}, 4096)
+	c.WriteAt([]byte{0x34}, 3*4096-1)
+	// the device has no Trim, only the block at 4096 lies in the range
+	check(t, c.Trim(1, 3*4096-2))
+	c.ReadAt(buf, 4096)
+	if buf[0] != 0xff {
+		t.Errorf("trimmed block not erased: %02x", buf[0])
+	}
+	c.ReadAt(buf, 3*4096-1)
+	if buf[0] != 0x34 {
+		t.Errorf("partial block erased: %02x", buf[0])
+	}
+}
+
+func TestFATFS(t *testing.T) {
+	dev := newTestDevice()
+	c := New(dev, &Config{Sectors: 8, ReadAhead: 2, WriteBack: true})
+	fs := fatfs.New(c).Configure(&fatfs.Config{SectorSize: fatfs.SectorSize})
+	check(t, fs.Format())
+	check(t, fs.Mount())
+	check(t, fs.Mkdir("/dir", 0777))
+	f, err := fs.OpenFile("/dir/file.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	check(t, err)
+	data := pattern(5000, 3)
+	_, err = f.Write(data)
+	check(t, err)
+	check(t, f.Close())
+	if c.Stats().Hits == 0 {
+		t.Error("no cache hits")
+	}
+
+	// mount the device without the cache
+	fs = fatfs.New(dev).Configure(&fatfs.Config{SectorSize: fatfs.SectorSize})
+	check(t, fs.Mount())
+	f, err = fs.OpenFile("/dir/file.txt", os.O_RDONLY)
+	check(t, err)
+	got := make([]byte, len(data))
+	n, _ := f.Read(got)
+	if n != len(data) || !bytes.Equal(got, data) {
+		t.Errorf("file content mismatch (%d bytes)", n)
+	}
+	f.Close()
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,62 @@
+package fatfs
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the time for the timestamps of the files and directories
+// written by FatFs, and the volume serial number made by Format. A time
+// before 1980, such as the time since boot of a board without RTC, is taken
+// as not set, then the fixed date FF_NORTC_YEAR/MON/MDAY of ffconf.h is used.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts a function such as the reader of an RTC module to Clock.
+type ClockFunc func() time.Time
+
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// SystemClock is the Clock of time.Now(), for boards whose time is set, e.g.
+// by runtime.AdjustTimeOffset.
+var SystemClock Clock = ClockFunc(time.Now)
+
+// SoftClock is a Clock set by software, e.g. from the serial console, and
+// running on the monotonic time since then. It is not set until Set is
+// called. It may be set while FatFs reads it on another goroutine.
+type SoftClock struct {
+	mu   sync.Mutex // guards base and set
+	base time.Time
+	set  time.Time
+}
+
+// Set sets the current time.
+func (c *SoftClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.base = now
+	c.set = time.Now()
+}
+
+// Now returns the current time, the zero time if the clock is not set.
+func (c *SoftClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.base.IsZero() {
+		return time.Time{}
+	}
+	return c.base.Add(time.Since(c.set))
+}
+
+// SetClock sets the Clock for the timestamps of the volume. A nil clock
+// stamps FF_NORTC_YEAR/MON/MDAY of ffconf.h.
+func (l *FATFS) SetClock(clock Clock) *FATFS {
+	// FatFs reads the clock with vol read-held
+	l.vol.Lock()
+	defer l.vol.Unlock()
+	l.clock = clock
+	return l
+}
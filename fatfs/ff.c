@@ -254,7 +254,7 @@
 #endif
 #define GET_FATTIME()   ((DWORD)(FF_NORTC_YEAR - 1980) << 25 | (DWORD)FF_NORTC_MON << 21 | (DWORD)FF_NORTC_MDAY << 16)
 #else
-#define GET_FATTIME()   get_fattime()
+#define GET_FATTIME()   get_fattime(fs->drv)   /* Timestamp of the volume, every caller has fs in scope */
 #endif
 
 
@@ -445,6 +445,9 @@ static WORD Fsid;                   /* Filesystem mount ID */
 
 #if FF_FS_LOCK != 0
 static FILESEM Files[FF_FS_LOCK];   /* Open object lock semaphores */
+#if FF_FS_REENTRANT
+static FATFS* FilesOwner;           /* Volume holding the lock of Files[] until it is unlocked */
+#endif
 #endif
 
 #if FF_STR_VOLUME_ID
@@ -888,6 +891,12 @@ static void unlock_fs (
 )
 {
     if (fs && res != FR_NOT_ENABLED && res != FR_INVALID_DRIVE && res != FR_TIMEOUT) {
+#if FF_FS_LOCK != 0
+        if (FilesOwner == fs) {     /* Release the file lock table taken by find_volume() */
+            FilesOwner = 0;
+            ff_unlock_files();
+        }
+#endif
         ff_rel_grant(fs->sobj);
     }
 }
@@ -3123,8 +3132,13 @@ static FRESULT find_volume (    /* FR_OK(0): successful, !=0: an error occurred
     UINT i;
 
 
+    if (!fs) return FR_NOT_ENABLED;     /* Released by the Go binding after unmount */
 #if FF_FS_REENTRANT
     if (!lock_fs(fs)) return FR_TIMEOUT;    /* Lock the volume */
+#if FF_FS_LOCK != 0
+    ff_lock_files();                    /* Lock the file lock table shared by the volumes */
+    FilesOwner = fs;
+#endif
 #endif
 
     mode &= (BYTE)~FA_READ;             /* Desired access mode, write access or not */
@@ -3405,7 +3419,13 @@ FRESULT f_umount (
 )
 {
 #if FF_FS_LOCK
+#if FF_FS_REENTRANT
+    ff_lock_files();
+#endif
     clear_lock(fs);
+#if FF_FS_REENTRANT
+    ff_unlock_files();
+#endif
 #endif
 #if FF_FS_REENTRANT             /* Discard sync object of the current volume */
     if (!ff_del_syncobj(fs->sobj)) return FR_INT_ERR;
@@ -3927,7 +3947,13 @@ FRESULT f_close (
         res = validate(&fp->obj, &fs);  /* Lock volume */
         if (res == FR_OK) {
 #if FF_FS_LOCK != 0
+#if FF_FS_REENTRANT
+            ff_lock_files();
+#endif
             res = dec_lock(fp->obj.lockid);     /* Decrement file open counter */
+#if FF_FS_REENTRANT
+            ff_unlock_files();
+#endif
             if (res == FR_OK) fp->obj.fs = 0;   /* Invalidate file object */
 #else
             fp->obj.fs = 0; /* Invalidate file object */
@@ -4348,7 +4374,13 @@ FRESULT f_closedir (
     res = validate(&dp->obj, &fs);  /* Check validity of the file object */
     if (res == FR_OK) {
 #if FF_FS_LOCK != 0
+#if FF_FS_REENTRANT
+        ff_lock_files();
+#endif
         if (dp->obj.lockid) res = dec_lock(dp->obj.lockid); /* Decrement sub-directory open counter */
+#if FF_FS_REENTRANT
+        ff_unlock_files();
+#endif
         if (res == FR_OK) dp->obj.fs = 0;   /* Invalidate directory object */
 #else
         dp->obj.fs = 0; /* Invalidate directory object */
@@ -4429,6 +4461,7 @@ FRESULT f_findnext (
 /*-----------------------------------------------------------------------*/
 
 FRESULT f_findfirst (
+    FATFS *fs,              /* Pointer to the file system object (added for ooFatFs) */
     DIR* dp,                /* Pointer to the blank directory object */
     FILINFO* fno,           /* Pointer to the file information structure */
     const TCHAR* path,      /* Pointer to the directory to open */
@@ -4439,7 +4472,7 @@ FRESULT f_findfirst (
 
 
     dp->pat = pattern;      /* Save pointer to pattern string */
-    res = f_opendir(dp, path);      /* Open the target directory */
+    res = f_opendir(fs, dp, path);  /* Open the target directory */
     if (res == FR_OK) {
         res = f_findnext(dp, fno);  /* Find the first item */
     }
@@ -5386,14 +5419,16 @@ FRESULT f_forward (
 
 FRESULT f_mkfs (
     FATFS *fs,
-    BYTE opt,           /* Format option */
-    DWORD au,           /* Size of allocation unit (cluster) [byte] */
+    const MKFS_PARM* parm,  /* Format options (null: default, backported from R0.14) */
     void* work,         /* Pointer to working buffer (null: use heap memory) */
     UINT len            /* Size of working buffer [byte] */
 )
 {
-    const UINT n_fats = 1;      /* Number of FATs for FAT/FAT32 volume (1 or 2) */
-    const UINT n_rootdir = 512; /* Number of root directory entries for FAT volume */
+    static const MKFS_PARM defopt = {FM_ANY, 0, 0, 0, 0};   /* Default parameter */
+    BYTE opt;           /* Format option */
+    DWORD au;           /* Size of allocation unit (cluster) [byte] */
+    UINT n_fats;        /* Number of FATs for FAT/FAT32 volume (1 or 2) */
+    UINT n_rootdir;     /* Number of root directory entries for FAT volume */
     static const WORD cst[] = {1, 4, 16, 64, 256, 512, 0};  /* Cluster size boundary for FAT volume (4Ks unit) */
     static const WORD cst32[] = {1, 2, 4, 8, 16, 32, 0};    /* Cluster size boundary for FAT32 volume (128Ks unit) */
     BYTE fmt, sys, *buf, *pte, part; void *pdrv;
@@ -5408,6 +5443,13 @@ FRESULT f_mkfs (
 #endif
 
 
+    /* Get format options */
+    if (!parm) parm = &defopt;
+    opt = parm->fmt;
+    au = parm->au_size;
+    n_fats = (parm->n_fat >= 1 && parm->n_fat <= 2) ? parm->n_fat : 1;
+    n_rootdir = (parm->n_root >= 1 && parm->n_root <= 32768 && (parm->n_root % (FF_MAX_SS / SZDIRE)) == 0) ? parm->n_root : 512;
+
     /* Check mounted drive and clear work area */
     fs->fs_type = 0;    /* Clear mounted volume */
     pdrv = fs->drv;     /* Physical drive */
@@ -5417,7 +5459,9 @@ FRESULT f_mkfs (
     disk_ioctl(pdrv, IOCTL_INIT, &stat);
     if (stat & STA_NOINIT) return FR_NOT_READY;
     if (stat & STA_PROTECT) return FR_WRITE_PROTECTED;
-    if (disk_ioctl(pdrv, GET_BLOCK_SIZE, &sz_blk) != RES_OK || !sz_blk || sz_blk > 32768 || (sz_blk & (sz_blk - 1))) sz_blk = 1;    /* Erase block to align data area */
+    sz_blk = parm->align;   /* Alignment of data area given by the options, or the erase block of the device */
+    if (!sz_blk && disk_ioctl(pdrv, GET_BLOCK_SIZE, &sz_blk) != RES_OK) sz_blk = 1;
+    if (!sz_blk || sz_blk > 32768 || (sz_blk & (sz_blk - 1))) sz_blk = 1;
 #if FF_MAX_SS != FF_MIN_SS      /* Get sector size of the medium if variable sector size cfg. */
     if (disk_ioctl(pdrv, GET_SECTOR_SIZE, &ss) != RES_OK) return FR_DISK_ERR;
     if (ss > FF_MAX_SS || ss < FF_MIN_SS || (ss & (ss - 1))) return FR_DISK_ERR;
@@ -5677,6 +5721,9 @@ FRESULT f_mkfs (
             if (fmt == FS_FAT32) {      /* FAT32: Move FAT base */
                 sz_rsv += n; b_fat += n;
             } else {                    /* FAT: Expand FAT size */
+                if (n % n_fats) {       /* Adjust fractional error if needed (backported from R0.14) */
+                    n--; sz_rsv++; b_fat++;
+                }
                 sz_fat += n / n_fats;
             }
 
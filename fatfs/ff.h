@@ -250,6 +250,18 @@ typedef struct {
 
 
 
+/* Format parameter structure (MKFS_PARM, backported from R0.14) */
+
+typedef struct {
+    BYTE fmt;           /* Format option (FM_FAT, FM_FAT32, FM_EXFAT and FM_SFD) */
+    BYTE n_fat;         /* Number of FATs (0: 1) */
+    UINT align;         /* Data area alignment [sector] (0: erase block size of the device) */
+    UINT n_root;        /* Number of root directory entries (0: 512) */
+    DWORD au_size;      /* Cluster size [byte] (0: auto) */
+} MKFS_PARM;
+
+
+
 /* File function return code (FRESULT) */
 
 typedef enum _FRESULT {
@@ -290,7 +302,7 @@ FRESULT f_sync (FIL* fp);                                           /* Flush cac
 FRESULT f_opendir (FATFS *fs, FF_DIR* dp, const TCHAR* path);       /* Open a directory */
 FRESULT f_closedir (FF_DIR* dp);                                    /* Close an open directory */
 FRESULT f_readdir (FF_DIR* dp, FILINFO* fno);                       /* Read a directory item */
-FRESULT f_findfirst (FF_DIR* dp, FILINFO* fno, const TCHAR* path, const TCHAR* pattern); /* Find first file */
+FRESULT f_findfirst (FATFS *fs, FF_DIR* dp, FILINFO* fno, const TCHAR* path, const TCHAR* pattern); /* Find first file */
 FRESULT f_findnext (FF_DIR* dp, FILINFO* fno);                      /* Find next file */
 FRESULT f_mkdir (FATFS *fs, const TCHAR* path);                     /* Create a sub directory */
 FRESULT f_unlink (FATFS *fs, const TCHAR* path);                    /* Delete an existing file or directory */
@@ -307,7 +319,7 @@ FRESULT f_forward (FIL* fp, UINT(*func)(const BYTE*,UINT), UINT btf, UINT* bf);
 FRESULT f_expand (FIL* fp, FSIZE_t fsz, BYTE opt);                  /* Allocate a contiguous block to the file */
 FRESULT f_mount (FATFS* fs);                                        /* Mount/Unmount a logical drive */
 FRESULT f_umount (FATFS* fs);                                       /* Unmount a logical drive */
-FRESULT f_mkfs (FATFS *fs, BYTE opt, DWORD au, void* work, UINT len); /* Create a FAT volume */
+FRESULT f_mkfs (FATFS *fs, const MKFS_PARM* parm, void* work, UINT len); /* Create a FAT volume */
 FRESULT f_fdisk (void *pdrv, const DWORD* szt, void* work);         /* Divide a physical drive into some partitions */
 FRESULT f_setcp (WORD cp);                                          /* Set current code page */
 FRESULT f_repair (FATFS* fs, void* work, UINT len);                 /* Free unreferenced clusters from the FAT */
@@ -333,7 +345,7 @@ FRESULT f_repair (FATFS* fs, void* work, UINT len);                 /* Free unre
 
 /* RTC function */
 #if !FF_FS_READONLY && !FF_FS_NORTC
-DWORD get_fattime (void);
+DWORD get_fattime (void *drv);
 #endif
 
 /* LFN support functions */
@@ -353,6 +365,10 @@ int ff_cre_syncobj (FATFS *fatfs, FF_SYNC_t* sobj); /* Create a sync object */
 int ff_req_grant (FF_SYNC_t sobj);      /* Lock sync object */
 void ff_rel_grant (FF_SYNC_t sobj);     /* Unlock sync object */
 int ff_del_syncobj (FF_SYNC_t sobj);    /* Delete a sync object */
+#if FF_FS_LOCK != 0
+void ff_lock_files (void);              /* Lock the file lock table shared by the volumes */
+void ff_unlock_files (void);            /* Unlock the file lock table */
+#endif
 #endif
 
 
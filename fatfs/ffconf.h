@@ -37,7 +37,7 @@
 /  2: Enable with LF-CRLF conversion. */
 
 
-#define FF_USE_FIND     0
+#define FF_USE_FIND     1
 /* This option switches filtered directory read functions, f_findfirst() and
 /  f_findnext(). (0:Disable, 1:Enable 2:Enable with matching altname[] too) */
 
@@ -46,7 +46,7 @@
 /* This option switches f_mkfs() function. (0:Disable or 1:Enable) */
 
 
-#define FF_USE_FASTSEEK 0
+#define FF_USE_FASTSEEK 1
 /* This option switches fast seek function. (0:Disable or 1:Enable) */
 
 
@@ -54,12 +54,12 @@
 /* This option switches f_expand function. (0:Disable or 1:Enable) */
 
 
-#define FF_USE_CHMOD    0
+#define FF_USE_CHMOD    1
 /* This option switches attribute manipulation functions, f_chmod() and f_utime().
 /  (0:Disable or 1:Enable) Also FF_FS_READONLY needs to be 0 to enable this option. */
 
 
-#define FF_USE_LABEL    0
+#define FF_USE_LABEL    1
 /* This option switches volume label functions, f_getlabel() and f_setlabel().
 /  (0:Disable or 1:Enable) */
 
@@ -105,7 +105,7 @@
 */
 
 
-#define FF_USE_LFN      1
+#define FF_USE_LFN      3
 #define FF_MAX_LFN      255
 /* The FF_USE_LFN switches the support for LFN (long file name).
 /
@@ -123,6 +123,8 @@
 /  When use stack for the working buffer, take care on stack overflow. When use heap
 /  memory for the working buffer, memory management functions, ff_memalloc() and
 /  ff_memfree() in ffsystem.c, need to be added to the project. */
+/* (go_fatfs: the heap is used, as the static buffer cannot be shared by the
+/  goroutines accessing the volumes at the same time.) */
 
 
 #define FF_LFN_UNICODE  0
@@ -158,7 +160,7 @@
 */
 
 
-#define FF_FS_RPATH     1
+#define FF_FS_RPATH     2
 /* This option configures support for relative path.
 /
 /   0: Disable relative path and remove related functions.
@@ -173,6 +175,8 @@
 
 #define FF_VOLUMES      1
 /* Number of volumes (logical drives) to be used. (1-10) */
+/* (ooFatFs binds each FATFS object to its own drive by fs->drv, so any number of
+/  FATFS objects can be mounted at a time regardless of FF_VOLUMES.) */
 
 
 #define FF_STR_VOLUME_ID    0
@@ -208,7 +212,7 @@
 /  GET_SECTOR_SIZE command. */
 
 
-#define FF_USE_TRIM     0
+#define FF_USE_TRIM     1
 /* This option switches support for ATA-TRIM. (0:Disable or 1:Enable)
 /  To enable Trim function, also CTRL_TRIM command should be implemented to the
 /  disk_ioctl() function. */
@@ -256,9 +260,12 @@
 /  added to the project to read current time form real-time clock. FF_NORTC_MON,
 /  FF_NORTC_MDAY and FF_NORTC_YEAR have no effect.
 /  These options have no effect at read-only configuration (FF_FS_READONLY = 1). */
+/* (go_fatfs: get_fattime() reads the Clock set to the volume by FATFS.SetClock(),
+/  and falls back to FF_NORTC_MON, FF_NORTC_MDAY and FF_NORTC_YEAR without a clock
+/  or while the clock is not set.) */
 
 
-#define FF_FS_LOCK      0
+#define FF_FS_LOCK      16
 /* The option FF_FS_LOCK switches file lock function to control duplicated file open
 /  and illegal operation to open objects. This option must be 0 when FF_FS_READONLY
 /  is 1.
@@ -268,12 +275,15 @@
 /  >0: Enable file lock function. The value defines how many files/sub-directories
 /      can be opened simultaneously under file lock control. Note that the file
 /      lock control is independent of re-entrancy. */
+/* (go_fatfs: the table of open objects is shared by all the volumes, so that it
+/  is guarded by a package level sync.Mutex through ff_lock_files() and
+/  ff_unlock_files(), see ffsystem.c.) */
 
 
 /* #include <somertos.h>    // O/S definitions */
-#define FF_FS_REENTRANT 0
+#define FF_FS_REENTRANT 1
 #define FF_FS_TIMEOUT   1000
-#define FF_SYNC_t       HANDLE
+#define FF_SYNC_t       void*
 /* The option FF_FS_REENTRANT switches the re-entrancy (thread safe) of the FatFs
 /  module itself. Note that regardless of this option, file access to different
 /  volume is always re-entrant and volume control functions, f_mount(), f_mkfs()
@@ -290,6 +300,9 @@
 /  The FF_SYNC_t defines O/S dependent sync object type. e.g. HANDLE, ID, OS_EVENT*,
 /  SemaphoreHandle_t and etc. A header file for O/S definitions needs to be
 /  included somewhere in the scope of ff.h. */
+/* (go_fatfs: the sync object is the sync.Mutex of the FATFS instance, locked
+/  without timeout through the exported go_fatfs_req_grant() and
+/  go_fatfs_rel_grant(), see ffsystem.c.) */
 
 
 
@@ -4,7 +4,7 @@
 /*------------------------------------------------------------------------*/
 
 
-#include "ff.h"
+#include "go_fatfs.h"
 
 
 #if FF_USE_LFN == 3 /* Dynamic memory allocation */
@@ -50,13 +50,17 @@ void ff_memfree (
 
 
 int ff_cre_syncobj (    /* 1:Function succeeded, 0:Could not create the sync object */
-    BYTE vol,           /* Corresponding volume (logical drive number) */
+    FATFS *fatfs,       /* Corresponding filesystem object */
     FF_SYNC_t* sobj     /* Pointer to return the created sync object */
 )
 {
+    /* Go: the mutex of the FATFS instance found by the drv pointer */
+    *sobj = fatfs->drv;
+    return (int)(*sobj != NULL);
+
     /* Win32 */
-    *sobj = CreateMutex(NULL, FALSE, NULL);
-    return (int)(*sobj != INVALID_HANDLE_VALUE);
+//  *sobj = CreateMutex(NULL, FALSE, NULL);
+//  return (int)(*sobj != INVALID_HANDLE_VALUE);
 
     /* uITRON */
 //  T_CSEM csem = {TA_TPRI,1,1};
@@ -90,8 +94,11 @@ int ff_del_syncobj (    /* 1:Function succeeded, 0:Could not delete due to an er
     FF_SYNC_t sobj      /* Sync object tied to the logical drive to be deleted */
 )
 {
+    /* Go: the mutex is released with the FATFS instance */
+    return 1;
+
     /* Win32 */
-    return (int)CloseHandle(sobj);
+//  return (int)CloseHandle(sobj);
 
     /* uITRON */
 //  return (int)(del_sem(sobj) == E_OK);
@@ -121,8 +128,11 @@ int ff_req_grant (  /* 1:Got a grant to access the volume, 0:Could not get a gra
     FF_SYNC_t sobj  /* Sync object to wait */
 )
 {
+    /* Go: sync.Mutex has no timeout */
+    return go_fatfs_req_grant(sobj);
+
     /* Win32 */
-    return (int)(WaitForSingleObject(sobj, FF_FS_TIMEOUT) == WAIT_OBJECT_0);
+//  return (int)(WaitForSingleObject(sobj, FF_FS_TIMEOUT) == WAIT_OBJECT_0);
 
     /* uITRON */
 //  return (int)(wai_sem(sobj) == E_OK);
@@ -150,8 +160,11 @@ void ff_rel_grant (
     FF_SYNC_t sobj  /* Sync object to be signaled */
 )
 {
+    /* Go */
+    go_fatfs_rel_grant(sobj);
+
     /* Win32 */
-    ReleaseMutex(sobj);
+//  ReleaseMutex(sobj);
 
     /* uITRON */
 //  sig_sem(sobj);
@@ -166,5 +179,28 @@ void ff_rel_grant (
 //  osMutexRelease(sobj);
 }
 
+
+#if FF_FS_LOCK != 0
+/*------------------------------------------------------------------------*/
+/* Lock/Unlock the File Lock Table                                        */
+/*------------------------------------------------------------------------*/
+/* The file lock table is shared by all the volumes, so that the functions
+/  opening, closing or checking objects hold this lock in addition to the
+/  lock of the volume (as the system lock of FatFs R0.15).
+*/
+
+void ff_lock_files (void)
+{
+    /* Go: a package level sync.Mutex */
+    go_fatfs_lock_files();
+}
+
+
+void ff_unlock_files (void)
+{
+    go_fatfs_unlock_files();
+}
+#endif
+
 #endif
 
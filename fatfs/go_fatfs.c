@@ -14,14 +14,15 @@ DRESULT disk_ioctl(void *drv, BYTE cmd, void* buff) {
     return go_fatfs_disk_ioctl(drv, cmd, buff);
 }
 
-DWORD get_fattime() {
-    return go_fatfs_get_fattime();
+DWORD get_fattime(void *drv) {
+    return go_fatfs_get_fattime(drv);
 }
 
 // Helper functions for creating FatFs structs
 
 FATFS* go_fatfs_new_fatfs(void) {
-    return malloc(sizeof(FATFS));
+    // zeroed, so that an instance not mounted yet is not taken as mounted
+    return calloc(1, sizeof(FATFS));
 }
 
 FIL* go_fatfs_new_fil(void) {
@@ -32,11 +33,15 @@ FF_DIR* go_fatfs_new_ff_dir(void) {
     return malloc(sizeof(FF_DIR));
 }
 
+DWORD* go_fatfs_new_clmt(UINT n) {
+    return malloc(n * sizeof(DWORD));
+}
+
 // if ffconf.h has FF_FS_READONLY set, certain functions aren't implemented,
 // which prevents the Go code from linking properly.
 #if FF_FS_READONLY == 1
 
-FRESULT f_mkfs (FATFS *fs, BYTE opt, DWORD au, void* work, UINT len) {
+FRESULT f_mkfs (FATFS *fs, const MKFS_PARM* parm, void* work, UINT len) {
     return 99;
 }
 
@@ -64,4 +69,16 @@ FRESULT f_getfree (FATFS *fs, DWORD* nclst) {
     return 99;
 }
 
+FRESULT f_chmod (FATFS *fs, const TCHAR* path, BYTE attr, BYTE mask) {
+    return 99;
+}
+
+FRESULT f_utime (FATFS *fs, const TCHAR* path, const FILINFO* fno) {
+    return 99;
+}
+
+FRESULT f_setlabel (FATFS *fs, const TCHAR* label) {
+    return 99;
+}
+
 #endif
\ No newline at end of file
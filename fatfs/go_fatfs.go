@@ -7,7 +7,9 @@ import "C"
 import (
 	"errors"
 	"io"
+	"io/fs"
 	"os"
+	"sync"
 	"time"
 	"unsafe"
 
@@ -133,12 +135,40 @@ func (r FileResult) Error() string {
 	return "fatfs: " + msg
 }
 
+// Is reports whether the result matches one of the errors of io/fs, such
+// as fs.ErrNotExist for FileResultNoFile.
+func (r FileResult) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return r == FileResultNoFile || r == FileResultNoPath
+	case fs.ErrExist:
+		return r == FileResultExist
+	case fs.ErrPermission:
+		return r == FileResultDenied || r == FileResultWriteProtected || r == FileResultReadOnly
+	case fs.ErrInvalid:
+		return r == FileResultInvalidName || r == FileResultInvalidObject || r == FileResultInvalidParameter
+	}
+	return false
+}
+
 type FileAttr byte
 
 type Info struct {
-	size int64
-	name string
-	attr FileAttr
+	size  int64
+	name  string
+	attr  FileAttr
+	fdate uint16
+	ftime uint16
+}
+
+func newInfo(info *C.FILINFO) *Info {
+	return &Info{
+		size:  int64(info.fsize),
+		name:  gostring(&info.fname[0]),
+		attr:  FileAttr(info.fattrib),
+		fdate: uint16(info.fdate),
+		ftime: uint16(info.ftime),
+	}
 }
 
 var _ os.FileInfo = (*Info)(nil)
@@ -155,29 +185,63 @@ func (info *Info) IsDir() bool {
 	return (info.attr & AttrDirectory) > 0
 }
 
+// Sys returns the FileAttr of the file, which also tells the hidden, system
+// and archive attributes.
 func (info *Info) Sys() interface{} {
-	return nil
+	return info.attr
 }
 
+// Mode returns 0777, or 0555 for a read-only file.
 func (info *Info) Mode() os.FileMode {
 	v := os.FileMode(0777)
+	if info.attr&AttrReadOnly != 0 {
+		v = 0555
+	}
 	if info.IsDir() {
 		v |= os.ModeDir
 	}
 	return v
 }
 
+// ModTime returns the modification time in local time, at a resolution of
+// 2 seconds. It is the zero time if the timestamp is not set.
 func (info *Info) ModTime() time.Time {
-	return time.Time{}
+	return fromFattime(uint32(info.fdate)<<16 | uint32(info.ftime))
 }
 
 type FATFS struct {
-	dev tinyfs.BlockDevice
-	fs  *C.FATFS
+	dev      tinyfs.BlockDevice
+	fs       *C.FATFS
+	fastSeek int
+	clock    Clock
+	cwd      string
+	mu       sync.Mutex         // held by FatFs while accessing the volume
+	vol      sync.RWMutex       // guards fs and clock, read-held across the calls of FatFs
+	state    sync.Mutex         // guards cwd and files
+	files    map[*File]struct{} // open files and directories
 }
 
 type Config struct {
 	SectorSize int
+	// FastSeek is the number of entries of the cluster link map table built
+	// for each file opened read-only, see File.EnableFastSeek (0: disabled)
+	FastSeek int
+}
+
+// Removable is implemented by block devices with removable media such as
+// sdcard.Device. FatFs checks Ready before each access, so that removing the
+// medium unmounts the volume and fails the open files, and mounting again
+// initializes a newly inserted medium by Configure.
+type Removable interface {
+	Ready() bool
+	Configure() error
+	WriteProtected() bool
+}
+
+// Trimmer is implemented by block devices that can discard data at a finer
+// granularity than EraseBlockSize, e.g. the sectors of a single cluster.
+type Trimmer interface {
+	Trim(off, n int64) error
 }
 
 func New(blockdev tinyfs.BlockDevice) *FATFS {
@@ -187,63 +251,181 @@ func New(blockdev tinyfs.BlockDevice) *FATFS {
 }
 
 func (l *FATFS) Configure(config *Config) *FATFS {
+	if config != nil {
+		l.fastSeek = config.FastSeek
+	}
+	l.alloc()
+	return l
+}
+
+// alloc allocates the FatFs work area unless it is allocated already, it
+// is released by Unmount.
+func (l *FATFS) alloc() {
+	l.vol.Lock()
+	defer l.vol.Unlock()
+	if l.fs != nil {
+		return
+	}
 	l.fs = C.go_fatfs_new_fatfs()
 	l.fs.drv = gopointer.Save(l)
-	return l
+	// same sync object as ff_cre_syncobj makes by f_mount, for the
+	// functions mounting the volume by themselves such as f_setlabel
+	l.fs.sobj = l.fs.drv
 }
 
+// Mount mounts the volume. The current directory is reset to the root.
 func (l *FATFS) Mount() error {
+	l.alloc()
+	l.state.Lock()
+	l.cwd = "/"
+	l.state.Unlock()
+	l.vol.RLock()
+	defer l.vol.RUnlock()
+	if l.fs == nil {
+		// unmounted by another goroutine
+		return FileResultNotEnabled
+	}
 	return errval(C.f_mount(l.fs))
 }
 
+// Format creates a FAT volume with the defaults of FatFs: FAT12/16, FAT32
+// or exFAT by the size of the device, aligned to its erase block. See
+// FormatWith for the options.
 func (l *FATFS) Format() error {
-	work := make([]byte, SectorSize)
-	return errval(C.f_mkfs(l.fs, C.FM_FAT, 0, unsafe.Pointer(&work[0]), C.UINT(len(work))))
+	return l.FormatWith(nil)
 }
 
+// Free returns the free space of the volume in bytes.
 func (l *FATFS) Free() (int64, error) {
+	l.vol.RLock()
+	defer l.vol.RUnlock()
 	var clust C.DWORD
 	res := C.f_getfree(l.fs, &clust)
 	if err := errval(res); err != nil {
 		return 0, err
 	}
-	return int64(clust * SectorSize), nil
+	return int64(clust) * l.clusterSize(), nil
+}
+
+// clusterSize returns the cluster size of the mounted volume in bytes. The
+// caller holds vol.
+func (l *FATFS) clusterSize() int64 {
+	return int64(l.fs.csize) * SectorSize
 }
 
+// Unmount closes the open files and directories, which flushes the data
+// written to them, then releases the work area of the volume. The files
+// return FileResultInvalidObject afterwards, and the other methods
+// FileResultNotEnabled until Mount. The methods in progress on other
+// goroutines are completed before the work area is released.
 func (l *FATFS) Unmount() error {
-	return nil
+	l.vol.Lock()
+	defer l.vol.Unlock()
+	if l.fs == nil {
+		return nil
+	}
+	var err error
+	l.state.Lock()
+	files := make([]*File, 0, len(l.files))
+	for f := range l.files {
+		files = append(files, f)
+	}
+	l.state.Unlock()
+	for _, f := range files {
+		// the methods of files lock vol before the file
+		f.mu.Lock()
+		if f.hndl != nil {
+			if e := f.close(); e != nil && err == nil {
+				err = e
+			}
+		}
+		f.mu.Unlock()
+	}
+	if e := errval(C.f_umount(l.fs)); e != nil && err == nil {
+		err = e
+	}
+	gopointer.Unref(l.fs.drv)
+	C.free(unsafe.Pointer(l.fs))
+	l.fs = nil
+	return err
+}
+
+// OpenFiles returns the number of files and directories open on the volume.
+func (l *FATFS) OpenFiles() int {
+	l.state.Lock()
+	defer l.state.Unlock()
+	return len(l.files)
 }
 
 func (l *FATFS) Remove(path string) error {
-	cs := cstring(path)
+	cs := l.cpath(path)
 	defer C.free(unsafe.Pointer(cs))
+	l.vol.RLock()
+	defer l.vol.RUnlock()
 	return errval(C.f_unlink(l.fs, cs))
 }
 
 func (l *FATFS) Rename(oldPath string, newPath string) error {
-	cs1, cs2 := cstring(oldPath), cstring(newPath)
+	cs1, cs2 := l.cpath(oldPath), l.cpath(newPath)
 	defer C.free(unsafe.Pointer(cs1))
 	defer C.free(unsafe.Pointer(cs2))
+	l.vol.RLock()
+	defer l.vol.RUnlock()
 	return errval(C.f_rename(l.fs, cs1, cs2))
 }
 
 func (l *FATFS) Stat(path string) (os.FileInfo, error) {
-	cs := cstring(path)
+	cs := l.cpath(path)
 	defer C.free(unsafe.Pointer(cs))
 	info := C.FILINFO{}
+	l.vol.RLock()
+	defer l.vol.RUnlock()
 	if err := errval(C.f_stat(l.fs, cs, &info)); err != nil {
 		return nil, err
 	}
-	return &Info{
-		size: int64(info.fsize),
-		name: gostring(&info.fname[0]),
-		attr: FileAttr(info.fattrib),
-	}, nil
+	return newInfo(&info), nil
+}
+
+// Chmod sets or clears the read-only attribute of path by the owner write
+// permission of mode.
+func (l *FATFS) Chmod(path string, mode os.FileMode) error {
+	attr := AttrReadOnly
+	if mode&0200 != 0 {
+		attr = 0
+	}
+	return l.SetAttr(path, attr, AttrReadOnly)
+}
+
+// SetAttr changes the attributes of path in mask to attr. Only AttrReadOnly,
+// AttrHidden, AttrSystem and AttrArchive can be changed.
+func (l *FATFS) SetAttr(path string, attr, mask FileAttr) error {
+	cs := l.cpath(path)
+	defer C.free(unsafe.Pointer(cs))
+	l.vol.RLock()
+	defer l.vol.RUnlock()
+	return errval(C.f_chmod(l.fs, cs, C.BYTE(attr), C.BYTE(mask)))
+}
+
+// Chtimes changes the modification time of path. FAT keeps no access time,
+// so atime is ignored.
+func (l *FATFS) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	cs := l.cpath(path)
+	defer C.free(unsafe.Pointer(cs))
+	t := toFattime(mtime)
+	info := C.FILINFO{
+		fdate: C.WORD(t >> 16),
+		ftime: C.WORD(t),
+	}
+	l.vol.RLock()
+	defer l.vol.RUnlock()
+	return errval(C.f_utime(l.fs, cs, &info))
 }
 
 func (l *FATFS) Mkdir(path string, _ os.FileMode) error {
-	cs := cstring(path)
+	cs := l.cpath(path)
 	defer C.free(unsafe.Pointer(cs))
+	l.vol.RLock()
+	defer l.vol.RUnlock()
 	return errval(C.f_mkdir(l.fs, cs))
 }
 
@@ -253,10 +435,15 @@ func (l *FATFS) Open(path string) (tinyfs.File, error) {
 
 func (l *FATFS) OpenFile(path string, flags int) (tinyfs.File, error) {
 
-	// create a C string with the file path
-	cs := cstring(path)
+	// create a C string with the file path resolved against the current
+	// directory
+	abs := l.abs(path)
+	cs := cstring(abs)
 	defer C.free(unsafe.Pointer(cs))
 
+	l.vol.RLock()
+	defer l.vol.RUnlock()
+
 	// stat the file path to see if it exists and if it is a file/dir
 	info := &C.FILINFO{}
 	if err := errval(C.f_stat(l.fs, cs, info)); err != nil && err != FileResultNoFile && err != FileResultInvalidName {
@@ -267,7 +454,7 @@ func (l *FATFS) OpenFile(path string, flags int) (tinyfs.File, error) {
 	// use f_open or f_opendir to obtain a handle to the object
 	var file = &File{fs: l, name: path}
 	var errno C.FRESULT
-	if path == "/" || info.fattrib&C.AM_DIR > 0 {
+	if abs == "/" || info.fattrib&C.AM_DIR > 0 {
 		// directory
 		file.typ = uint8(C.AM_DIR)
 		file.hndl = unsafe.Pointer(C.go_fatfs_new_ff_dir())
@@ -288,6 +475,20 @@ func (l *FATFS) OpenFile(path string, flags int) (tinyfs.File, error) {
 		return nil, err
 	}
 
+	// fast seek is optional, a file too fragmented for the table is still
+	// accessible by the normal seek
+	if l.fastSeek > 0 && !file.IsDir() && flags == os.O_RDONLY {
+		file.enableFastSeek(l.fastSeek)
+	}
+
+	// track the handle to close it by Unmount
+	l.state.Lock()
+	if l.files == nil {
+		l.files = make(map[*File]struct{})
+	}
+	l.files[file] = struct{}{}
+	l.state.Unlock()
+
 	// file handle was initialized successfully
 	return file, nil
 }
@@ -324,8 +525,28 @@ func translateFlags(osFlags int) C.BYTE {
 type File struct {
 	fs   *FATFS
 	typ  uint8
+	mu   sync.Mutex // guards hndl, clmt and the position
 	hndl unsafe.Pointer
 	name string
+	clmt *C.DWORD
+}
+
+// lock locks the file for a call of FatFs on its handle, and keeps the
+// volume from being unmounted until unlock. It returns false, leaving the
+// file unlocked, if the file is closed.
+func (f *File) lock() bool {
+	f.fs.vol.RLock()
+	f.mu.Lock()
+	if f.hndl == nil {
+		f.unlock()
+		return false
+	}
+	return true
+}
+
+func (f *File) unlock() {
+	f.mu.Unlock()
+	f.fs.vol.RUnlock()
 }
 
 func (f *File) dirptr() *C.FF_DIR {
@@ -342,25 +563,42 @@ func (f *File) Name() string {
 }
 
 func (f *File) Close() error {
+	if !f.lock() {
+		return nil
+	}
+	defer f.unlock()
+	return f.close()
+}
+
+// close closes the handle of the open file, the caller holds its lock.
+func (f *File) close() error {
 	var errno C.FRESULT
-	if f.hndl != nil {
-		defer func() {
-			C.free(f.hndl)
-			f.hndl = nil
-		}()
-		if f.IsDir() {
-			errno = C.f_closedir(f.dirptr())
-		} else {
-			errno = C.f_close(f.fileptr())
-		}
+	if f.IsDir() {
+		errno = C.f_closedir(f.dirptr())
+	} else {
+		errno = C.f_close(f.fileptr())
+		f.disableFastSeek()
 	}
+	C.free(f.hndl)
+	f.hndl = nil
+	f.fs.state.Lock()
+	delete(f.fs.files, f)
+	f.fs.state.Unlock()
 	return errval(errno)
 }
 
 func (f *File) Read(buf []byte) (n int, err error) {
-	if f.IsDir() {
+	if f.IsDir() || !f.lock() {
 		return 0, FileResultInvalidObject
 	}
+	defer f.unlock()
+	return f.read(buf)
+}
+
+func (f *File) read(buf []byte) (n int, err error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
 	bufptr := unsafe.Pointer(&buf[0])
 	var br, btr C.UINT = 0, C.UINT(len(buf))
 	errno := C.f_read(f.fileptr(), bufptr, btr, &br)
@@ -373,33 +611,12 @@ func (f *File) Read(buf []byte) (n int, err error) {
 	return int(br), nil
 }
 
-/*
-// Seek changes the position of the file
-func (f *File) Seek(offset int64, whence int) (ret int64, err error) {
-	errno := C.int(C.lfs_file_seek(f.lfs.lfs, &f.fptr, C.lfs_soff_t(offset), C.int(whence)))
-	if errno < 0 {
-		return -1, errval(errno)
-	}
-	return int64(errno), nil
-}
-
-// Tell returns the position of the file
-func (f *File) Tell() (ret int64, err error) {
-	errno := C.int(C.lfs_file_tell(f.lfs.lfs, &f.fptr))
-	if errno < 0 {
-		return -1, errval(errno)
-	}
-	return int64(errno), nil
-}
-
-// Rewind changes the position of the file to the beginning of the file
-func (f *File) Rewind() (err error) {
-	return errval(C.lfs_file_rewind(f.lfs.lfs, &f.fptr))
-}
-*/
-
 // Size returns the size of the file
 func (f *File) Size() (int64, error) {
+	if !f.lock() {
+		return 0, FileResultInvalidObject
+	}
+	defer f.unlock()
 	if f.IsDir() {
 		ptr := f.dirptr()
 		return int64(ptr.obj.objsize), nil
@@ -414,6 +631,10 @@ func (f *File) Size() (int64, error) {
 // Any pending writes are written out to storage.
 // Returns a negative error code on failure.
 func (f *File) Sync() error {
+	if f.IsDir() || !f.lock() {
+		return FileResultInvalidObject
+	}
+	defer f.unlock()
 	return errval(C.f_sync(f.fileptr()))
 }
 
@@ -427,9 +648,17 @@ func (f *File) Truncate(size uint32) error {
 */
 
 func (f *File) Write(buf []byte) (n int, err error) {
-	if f.IsDir() {
+	if f.IsDir() || !f.lock() {
 		return 0, FileResultInvalidObject
 	}
+	defer f.unlock()
+	return f.write(buf)
+}
+
+func (f *File) write(buf []byte) (n int, err error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
 	bufptr := unsafe.Pointer(&buf[0])
 	var bw, btw C.UINT = 0, C.UINT(len(buf))
 	errno := C.f_write(f.fileptr(), bufptr, btw, &bw)
@@ -446,31 +675,29 @@ func (f *File) IsDir() bool {
 	return f.typ == C.AM_DIR
 }
 
+// Readdir reads the directory in the same way as os.File. If n > 0, it
+// returns at most n entries and io.EOF at the end of the directory. If
+// n <= 0, it returns all the remaining entries. Rewind restarts reading from
+// the first entry.
 func (f *File) Readdir(n int) (infos []os.FileInfo, err error) {
-	if !f.IsDir() {
+	if !f.IsDir() || !f.lock() {
 		return nil, FileResultInvalidObject
 	}
-	if n == 0 {
-		// passing nil pointer to f_readdir resets the read index
-		if err := errval(C.f_readdir(f.dirptr(), nil)); err != nil {
-			return nil, err
-		}
-	}
-	for {
+	defer f.unlock()
+	for n <= 0 || len(infos) < n {
 		info := C.FILINFO{}
 		if err := errval(C.f_readdir(f.dirptr(), &info)); err != nil {
-			return nil, err
+			return infos, err
 		}
-		if fname := gostring(&info.fname[0]); fname == "" {
-			return infos, nil
-		} else {
-			infos = append(infos, &Info{
-				size: int64(info.fsize),
-				name: fname,
-				attr: FileAttr(info.fattrib),
-			})
+		if info.fname[0] == 0 {
+			break
 		}
+		infos = append(infos, newInfo(&info))
+	}
+	if n > 0 && len(infos) == 0 {
+		return nil, io.EOF
 	}
+	return infos, nil
 }
 
 func cstring(s string) *C.char {
@@ -8,13 +8,19 @@ extern DRESULT go_fatfs_disk_read(void* drv, void* buff, DWORD sector, UINT coun
 extern DRESULT go_fatfs_disk_write(void* drv, void* buff, DWORD sector, UINT count);
 extern DRESULT go_fatfs_disk_ioctl(void* drv, BYTE cmd, DWORD* param);
 
-extern DWORD go_fatfs_get_fattime();
+extern DWORD go_fatfs_get_fattime(void* drv);
+
+extern int go_fatfs_req_grant(void* drv);
+extern void go_fatfs_rel_grant(void* drv);
+extern void go_fatfs_lock_files(void);
+extern void go_fatfs_unlock_files(void);
 
 // Helper functions used to allocate new FatFs objects, needed because TinyGo
 // does not support sizeof() yet
 FATFS* go_fatfs_new_fatfs(void);
 FIL* go_fatfs_new_fil(void);
 FF_DIR* go_fatfs_new_ff_dir(void);
+DWORD* go_fatfs_new_clmt(UINT n);
 
 //struct lfs_config* go_lfs_new_lfs_config(void);
 //lfs_dir_t* go_lfs_new_lfs_dir(void);
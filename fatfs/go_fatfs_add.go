@@ -5,22 +5,160 @@ package fatfs
 // #include "./go_fatfs.h"
 import "C"
 
+import (
+	"io"
+	"os"
+	"unsafe"
+)
+
+var (
+	_ io.ReadWriteSeeker = (*File)(nil)
+	_ io.ReaderAt        = (*File)(nil)
+	_ io.WriterAt        = (*File)(nil)
+	_ io.ReaderFrom      = (*File)(nil)
+	_ io.WriterTo        = (*File)(nil)
+)
+
 func (l *FATFS) GetFsType() (Type, error) {
+	l.vol.RLock()
+	defer l.vol.RUnlock()
+	if l.fs == nil {
+		return 0, FileResultNotEnabled
+	}
 	return Type(l.fs.fs_type), nil
 }
 
+// GetCardSize returns the size of the data area of the volume in bytes.
 func (l *FATFS) GetCardSize() (int64, error) {
-	return int64(l.fs.csize) * int64(l.fs.n_fatent) * SectorSize, nil
+	l.vol.RLock()
+	defer l.vol.RUnlock()
+	if l.fs == nil || l.fs.fs_type == 0 {
+		return 0, FileResultNotEnabled
+	}
+	return int64(l.fs.n_fatent-2) * l.clusterSize(), nil
+}
+
+// Statfs is the statistics of a volume.
+type Statfs struct {
+	Label         string
+	SerialNumber  uint32
+	Type          Type
+	ClusterSize   int64 // bytes per cluster
+	TotalClusters uint32
+	FreeClusters  uint32
+	TotalBytes    int64 // size of the data area
+	FreeBytes     int64
+}
+
+// Statfs returns the statistics of the volume. Counting the free clusters
+// may scan the whole FAT at the first call after mount.
+func (l *FATFS) Statfs() (*Statfs, error) {
+	l.vol.RLock()
+	defer l.vol.RUnlock()
+	var free C.DWORD
+	if err := errval(C.f_getfree(l.fs, &free)); err != nil {
+		return nil, err
+	}
+	label := make([]byte, 34) // 11 bytes for FAT, 33 bytes (DBCS) for exFAT
+	var vsn C.DWORD
+	if err := errval(C.f_getlabel(l.fs, (*C.TCHAR)(unsafe.Pointer(&label[0])), &vsn)); err != nil {
+		return nil, err
+	}
+	st := &Statfs{
+		Label:         gostring((*C.char)(unsafe.Pointer(&label[0]))),
+		SerialNumber:  uint32(vsn),
+		Type:          Type(l.fs.fs_type),
+		ClusterSize:   l.clusterSize(),
+		TotalClusters: uint32(l.fs.n_fatent - 2),
+		FreeClusters:  uint32(free),
+	}
+	st.TotalBytes = int64(st.TotalClusters) * st.ClusterSize
+	st.FreeBytes = int64(st.FreeClusters) * st.ClusterSize
+	return st, nil
+}
+
+// SetLabel sets the volume label. An empty label removes it.
+func (l *FATFS) SetLabel(label string) error {
+	cs := cstring(label)
+	defer C.free(unsafe.Pointer(cs))
+	l.vol.RLock()
+	defer l.vol.RUnlock()
+	return errval(C.f_setlabel(l.fs, cs))
 }
 
-// Seek changes the position of the file
-func (f *File) Seek(offset int64) error {
-	var ofs C.FSIZE_t = C.FSIZE_t(offset)
-	errno := C.f_lseek(f.fileptr(), ofs)
-	return errval(errno)
+// Find returns the entries of the directory dir whose names match pattern.
+// The pattern may contain '?' for any character and '*' for any sequence of
+// characters, and is matched without case sensitivity as FAT names are.
+func (l *FATFS) Find(dir, pattern string) (infos []os.FileInfo, err error) {
+	cdir, cpat := l.cpath(dir), cstring(pattern)
+	defer C.free(unsafe.Pointer(cdir))
+	defer C.free(unsafe.Pointer(cpat))
+	dp := C.go_fatfs_new_ff_dir()
+	if dp == nil {
+		return nil, FileResultNotEnoughCore
+	}
+	defer C.free(unsafe.Pointer(dp))
+	info := C.FILINFO{}
+	l.vol.RLock()
+	defer l.vol.RUnlock()
+	// f_findfirst in two steps, so that the directory is closed also when
+	// the first f_findnext fails, which would leak a slot of FF_FS_LOCK
+	dp.pat = cpat
+	if err := errval(C.f_opendir(l.fs, dp, cdir)); err != nil {
+		return nil, err
+	}
+	defer func() {
+		C.f_closedir(dp)
+	}()
+	for {
+		if err := errval(C.f_findnext(dp, &info)); err != nil {
+			return infos, err
+		}
+		if info.fname[0] == 0 {
+			break
+		}
+		infos = append(infos, newInfo(&info))
+	}
+	return infos, nil
+}
+
+// Seek changes the position of the file relative to whence (io.SeekStart,
+// io.SeekCurrent or io.SeekEnd) and returns the new position. Seeking beyond
+// the end extends the file if it is opened for writing, otherwise the
+// position stops at the end.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if f.IsDir() || !f.lock() {
+		return 0, FileResultInvalidObject
+	}
+	defer f.unlock()
+	ptr := f.fileptr()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += int64(ptr.fptr)
+	case io.SeekEnd:
+		offset += int64(ptr.obj.objsize)
+	default:
+		return 0, FileResultInvalidParameter
+	}
+	if offset < 0 {
+		return 0, FileResultInvalidParameter
+	}
+	if err := f.seek(offset); err != nil {
+		return 0, err
+	}
+	return int64(ptr.fptr), nil
+}
+
+func (f *File) seek(offset int64) error {
+	return errval(C.f_lseek(f.fileptr(), C.FSIZE_t(offset)))
 }
 
 func (f *File) Tell() (ret int64, err error) {
+	if f.IsDir() || !f.lock() {
+		return -1, FileResultInvalidObject
+	}
+	defer f.unlock()
 	pos := int64(f.fileptr().fptr)
 	if pos < 0 {
 		return -1, errval(C.FRESULT(C.FR_INT_ERR))
@@ -28,20 +166,147 @@ func (f *File) Tell() (ret int64, err error) {
 	return int64(pos), nil
 }
 
-// Rewind changes the position of the file to the beginning of the file
+// Rewind changes the position of the file to the beginning of the file, or
+// restarts reading a directory from the first entry
 func (f *File) Rewind() (err error) {
-	return f.Seek(0)
+	if !f.lock() {
+		return FileResultInvalidObject
+	}
+	defer f.unlock()
+	if f.IsDir() {
+		// passing nil pointer to f_readdir resets the read index
+		return errval(C.f_readdir(f.dirptr(), nil))
+	}
+	return f.seek(0)
+}
+
+// ReadAt reads len(buf) bytes at offset off without moving the position of
+// the file. It returns io.EOF if fewer bytes are read. Reading beyond the
+// end does not extend a file opened for writing, and parallel calls are
+// serialized by the lock of the file held from the seek to the restore.
+func (f *File) ReadAt(buf []byte, off int64) (n int, err error) {
+	if f.IsDir() || !f.lock() {
+		return 0, FileResultInvalidObject
+	}
+	defer f.unlock()
+	if off < 0 {
+		return 0, FileResultInvalidParameter
+	}
+	// f_lseek beyond the end extends a file opened for writing
+	size := int64(f.fileptr().obj.objsize)
+	if off >= size {
+		return 0, io.EOF
+	}
+	var eof error
+	if int64(len(buf)) > size-off {
+		buf = buf[:size-off]
+		eof = io.EOF
+	}
+	pos := int64(f.fileptr().fptr)
+	defer func() {
+		if e := f.seek(pos); e != nil && (err == nil || err == io.EOF) {
+			err = e
+		}
+	}()
+	if err := f.seek(off); err != nil {
+		return 0, err
+	}
+	for n < len(buf) {
+		m, err := f.read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, eof
+}
+
+// WriteAt writes buf at offset off without moving the position of the file.
+// Writing beyond the end extends the file.
+func (f *File) WriteAt(buf []byte, off int64) (n int, err error) {
+	if f.IsDir() || !f.lock() {
+		return 0, FileResultInvalidObject
+	}
+	defer f.unlock()
+	if off < 0 {
+		return 0, FileResultInvalidParameter
+	}
+	pos := int64(f.fileptr().fptr)
+	defer func() {
+		if e := f.seek(pos); e != nil && err == nil {
+			err = e
+		}
+	}()
+	if err := f.seek(off); err != nil {
+		return 0, err
+	}
+	if int64(f.fileptr().fptr) != off {
+		// not opened for writing
+		return 0, FileResultDenied
+	}
+	return f.write(buf)
+}
+
+// ReadFrom writes the data read from r until io.EOF to the file. It makes
+// io.Copy to the file use a sector sized buffer.
+func (f *File) ReadFrom(r io.Reader) (n int64, err error) {
+	buf := make([]byte, SectorSize)
+	for {
+		m, rerr := r.Read(buf)
+		if m > 0 {
+			w, err := f.Write(buf[:m])
+			n += int64(w)
+			if err != nil {
+				return n, err
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// WriteTo writes the data of the file from the current position to w.
+func (f *File) WriteTo(w io.Writer) (n int64, err error) {
+	buf := make([]byte, SectorSize)
+	for {
+		m, rerr := f.Read(buf)
+		if m > 0 {
+			m, err := w.Write(buf[:m])
+			n += int64(m)
+			if err != nil {
+				return n, err
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
 }
 
 // Truncates the size of the file to the specified size
 //
 func (f *File) Truncate() error {
+	if f.IsDir() || !f.lock() {
+		return FileResultInvalidObject
+	}
+	defer f.unlock()
 	return errval(C.f_truncate(f.fileptr()))
 }
 
 //  Allocate a contiguous block to the file
 //
 func (f *File) Expand(size int64, flag bool) error {
+	if f.IsDir() || !f.lock() {
+		return FileResultInvalidObject
+	}
+	defer f.unlock()
 	var fsz C.FSIZE_t = C.FSIZE_t(size)
 	var opt C.BYTE;
 	if flag { opt = 1 } else { opt = 0 }
@@ -5,6 +5,7 @@ package fatfs
 import "C"
 
 import (
+	"sync"
 	"time"
 	"unsafe"
 
@@ -69,33 +70,130 @@ func go_fatfs_disk_ioctl(drv unsafe.Pointer, cmd uint8, param unsafe.Pointer) in
 		// Get sector size (needed at _MAX_SS != _MIN_SS)
 		*((*C.WORD)(param)) = C.WORD(SectorSize)
 	case C.GET_BLOCK_SIZE:
-		// Get erase block size (needed at _USE_MKFS == 1)
-		// FIXME: not really sure why this doesn't work
+		// Get erase block size (needed at _USE_MKFS == 1), the AU of SD cards
+		// aligns the data area unless FormatOptions.Align is given
 		*((*C.DWORD)(param)) = C.DWORD(bdev.EraseBlockSize() / SectorSize)
+	case C.CTRL_TRIM:
+		// Inform device that the data on the block of sectors is no longer used (needed at FF_USE_TRIM == 1)
+		lba := (*[2]C.DWORD)(param)
+		off := int64(lba[0]) * SectorSize
+		n := (int64(lba[1]) - int64(lba[0]) + 1) * SectorSize
+		if err := trim(bdev, off, n); err != nil {
+			return C.RES_ERROR
+		}
 	case C.IOCTL_INIT:
-		// FIXME: not really sure what this would be used for
-		*((*C.DSTATUS)(param)) = C.DSTATUS(0)
+		// Initialize the drive when the volume is mounted
+		if removable, ok := bdev.(Removable); ok && !removable.Ready() {
+			removable.Configure()
+		}
+		*((*C.DSTATUS)(param)) = diskStatus(bdev)
 	case C.IOCTL_STATUS:
-		// FIXME: not really sure what this would be used for
-		*((*C.DSTATUS)(param)) = C.DSTATUS(0)
+		// Get drive status, checked before each access to the volume
+		*((*C.DSTATUS)(param)) = diskStatus(bdev)
 	}
 	return C.RES_OK
 }
 
 //export go_fatfs_get_fattime
-func go_fatfs_get_fattime() (t uint32) {
-	now := time.Now()
-	year, month, day := now.Date()
-	hour, minute, second := now.Hour(), now.Minute(), now.Second()
-	t |= uint32(year-1980) << 24
-	t |= (uint32(month) & 0xF) << 20
-	t |= (uint32(day) & 0x1F) << 15
-	t |= (uint32(hour) & 0x1F) << 10
-	t |= (uint32(minute) & 0x3F) << 4
-	t |= (uint32(second) / 2) & 0xF
+func go_fatfs_get_fattime(drv unsafe.Pointer) (t uint32) {
+	if clock := restore(drv).clock; clock != nil {
+		if now := clock.Now(); now.Year() >= 1980 {
+			return toFattime(now)
+		}
+	}
+	return uint32(C.FF_NORTC_YEAR-1980)<<25 | uint32(C.FF_NORTC_MON)<<21 | uint32(C.FF_NORTC_MDAY)<<16
+}
+
+// go_fatfs_req_grant locks the volume on entering a FatFs function, so that
+// the goroutines sharing the volume access it one by one.
+//
+//export go_fatfs_req_grant
+func go_fatfs_req_grant(drv unsafe.Pointer) int {
+	restore(drv).mu.Lock()
+	return 1
+}
+
+//export go_fatfs_rel_grant
+func go_fatfs_rel_grant(drv unsafe.Pointer) {
+	restore(drv).mu.Unlock()
+}
+
+// files guards the file lock table of FatFs (FF_FS_LOCK), which is shared by
+// all the volumes.
+var files sync.Mutex
+
+//export go_fatfs_lock_files
+func go_fatfs_lock_files() {
+	files.Lock()
+}
+
+//export go_fatfs_unlock_files
+func go_fatfs_unlock_files() {
+	files.Unlock()
+}
+
+// toFattime packs t into the FAT timestamp format, date in the upper and
+// time in the lower 16 bits. Years out of 1980..2107 are clipped.
+func toFattime(tm time.Time) (t uint32) {
+	year, month, day := tm.Date()
+	hour, minute, second := tm.Hour(), tm.Minute(), tm.Second()
+	if year < 1980 {
+		return 1<<21 | 1<<16 // 1980-01-01 00:00:00
+	}
+	if year > 2107 {
+		year, month, day, hour, minute, second = 2107, 12, 31, 23, 59, 59
+	}
+	t |= uint32(year-1980) << 25
+	t |= (uint32(month) & 0xF) << 21
+	t |= (uint32(day) & 0x1F) << 16
+	t |= (uint32(hour) & 0x1F) << 11
+	t |= (uint32(minute) & 0x3F) << 5
+	t |= (uint32(second) / 2) & 0x1F
 	return t
 }
 
+// fromFattime unpacks a FAT timestamp, the zero time for a zero date.
+func fromFattime(t uint32) time.Time {
+	date := t >> 16
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(
+		int(date>>9)+1980, time.Month(date>>5&0xF), int(date&0x1F),
+		int(t>>11&0x1F), int(t>>5&0x3F), int(t&0x1F)*2, 0, time.Local)
+}
+
+// diskStatus returns the STA_* flags of bdev.
+func diskStatus(bdev tinyfs.BlockDevice) C.DSTATUS {
+	removable, ok := bdev.(Removable)
+	if !ok {
+		return 0
+	}
+	stat := C.DSTATUS(0)
+	if !removable.Ready() {
+		stat |= C.STA_NOINIT
+	}
+	if removable.WriteProtected() {
+		stat |= C.STA_PROTECT
+	}
+	return stat
+}
+
+// trim discards n bytes at offset off of bdev. Devices which are not a
+// Trimmer only get the erase blocks erased which lie entirely in the range.
+func trim(bdev tinyfs.BlockDevice, off, n int64) error {
+	if trimmer, ok := bdev.(Trimmer); ok {
+		return trimmer.Trim(off, n)
+	}
+	size := bdev.EraseBlockSize()
+	start := (off + size - 1) / size
+	end := (off + n) / size
+	if end <= start {
+		return nil
+	}
+	return bdev.EraseBlocks(start, end-start)
+}
+
 func restore(ptr unsafe.Pointer) *FATFS {
 	return gopointer.Restore(ptr).(*FATFS)
 }
@@ -0,0 +1,76 @@
+package fatfs
+
+// #include <stdlib.h>
+// #include "./go_fatfs.h"
+import "C"
+import (
+	"path"
+	"strings"
+	"unsafe"
+)
+
+// Chdir changes the current directory, which relative paths given to the
+// other methods start from. "." and ".." are resolved by the path, so ".."
+// of the root directory is the root directory, also on exFAT which has no
+// dot entries.
+func (l *FATFS) Chdir(dir string) error {
+	abs := l.abs(dir)
+	cs := cstring(abs)
+	defer C.free(unsafe.Pointer(cs))
+	l.vol.RLock()
+	defer l.vol.RUnlock()
+	if err := errval(C.f_chdir(l.fs, cs)); err != nil {
+		return err
+	}
+	cwd := abs
+	if l.fs.fs_type != C.FS_EXFAT {
+		// FatFs tells the names in the case stored on the volume, but cannot
+		// follow the parent directories of exFAT
+		buf := make([]byte, C.FF_MAX_LFN+1)
+		for errval(C.f_getcwd(l.fs, (*C.TCHAR)(unsafe.Pointer(&buf[0])), C.UINT(len(buf)))) == FileResultNotEnoughCore {
+			buf = make([]byte, len(buf)*2)
+		}
+		if s := gostring((*C.char)(unsafe.Pointer(&buf[0]))); s != "" {
+			cwd = s
+		}
+	}
+	l.state.Lock()
+	l.cwd = cwd
+	l.state.Unlock()
+	return nil
+}
+
+// Getwd returns the absolute path of the current directory.
+func (l *FATFS) Getwd() (string, error) {
+	l.vol.RLock()
+	defer l.vol.RUnlock()
+	if l.fs == nil || l.fs.fs_type == 0 {
+		return "", FileResultNotEnabled
+	}
+	l.state.Lock()
+	defer l.state.Unlock()
+	return l.cwd, nil
+}
+
+// abs returns path resolved against the current directory.
+func (l *FATFS) abs(p string) string {
+	l.state.Lock()
+	cwd := l.cwd
+	l.state.Unlock()
+	return resolve(cwd, p)
+}
+
+// cpath returns the C string of path resolved by abs.
+func (l *FATFS) cpath(p string) *C.char {
+	return cstring(l.abs(p))
+}
+
+// resolve returns the cleaned absolute path of p relative to cwd.
+// Backslashes are separators as FatFs takes them.
+func resolve(cwd, p string) string {
+	p = strings.ReplaceAll(p, "\\", "/")
+	if !strings.HasPrefix(p, "/") {
+		return path.Join("/", cwd, p)
+	}
+	return path.Clean(p)
+}
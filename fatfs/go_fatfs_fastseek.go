@@ -0,0 +1,101 @@
+package fatfs
+
+// #include <stdlib.h>
+// #include "./go_fatfs.h"
+import "C"
+import (
+	"unsafe"
+)
+
+// EnableFastSeek switches the file to the fast seek mode. The cluster link
+// map table (CLMT) of entries items is built by walking the FAT chain once,
+// then Seek, ReadAt and WriteAt take constant time regardless of the
+// position. A file of n fragments needs 2+2*n entries, FastSeekEntries tells
+// the exact number. If the table is too small, FileResultNotEnoughCore is
+// returned and the file stays in the normal mode.
+//
+// The size of the file cannot be expanded in the fast seek mode.
+func (f *File) EnableFastSeek(entries int) error {
+	if f.IsDir() || !f.lock() {
+		return FileResultInvalidObject
+	}
+	defer f.unlock()
+	return f.enableFastSeek(entries)
+}
+
+func (f *File) enableFastSeek(entries int) error {
+	if entries < 4 {
+		return FileResultInvalidParameter
+	}
+	f.disableFastSeek()
+	clmt := C.go_fatfs_new_clmt(C.UINT(entries))
+	if clmt == nil {
+		return FileResultNotEnoughCore
+	}
+	*clmt = C.DWORD(entries)
+	f.fileptr().cltbl = clmt
+	f.clmt = clmt
+	if err := f.createLinkMap(); err != nil {
+		f.disableFastSeek()
+		return err
+	}
+	return nil
+}
+
+// DisableFastSeek returns the file to the normal mode and frees the table.
+func (f *File) DisableFastSeek() {
+	if !f.lock() {
+		// the table was freed by Close
+		return
+	}
+	defer f.unlock()
+	f.disableFastSeek()
+}
+
+func (f *File) disableFastSeek() {
+	if f.clmt == nil {
+		return
+	}
+	if f.hndl != nil {
+		f.fileptr().cltbl = nil
+	}
+	C.free(unsafe.Pointer(f.clmt))
+	f.clmt = nil
+}
+
+// FastSeek reports whether the file is in the fast seek mode.
+func (f *File) FastSeek() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.clmt != nil
+}
+
+// FastSeekEntries returns the number of table entries EnableFastSeek needs
+// for the file in its current layout.
+func (f *File) FastSeekEntries() (int, error) {
+	if f.IsDir() || !f.lock() {
+		return 0, FileResultInvalidObject
+	}
+	defer f.unlock()
+	// a table of a single item only gets the required size stored
+	tbl := C.go_fatfs_new_clmt(1)
+	if tbl == nil {
+		return 0, FileResultNotEnoughCore
+	}
+	defer C.free(unsafe.Pointer(tbl))
+	*tbl = 1
+	ptr := f.fileptr()
+	saved := ptr.cltbl
+	ptr.cltbl = tbl
+	err := f.createLinkMap()
+	ptr.cltbl = saved
+	if err != nil && err != FileResultNotEnoughCore {
+		return 0, err
+	}
+	return int(*tbl), nil
+}
+
+// createLinkMap builds the CLMT in the table set to cltbl.
+func (f *File) createLinkMap() error {
+	return errval(C.f_lseek(f.fileptr(), C.CREATE_LINKMAP))
+}
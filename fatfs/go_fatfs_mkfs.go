@@ -0,0 +1,84 @@
+package fatfs
+
+// #include <stdlib.h>
+// #include "./go_fatfs.h"
+import "C"
+import (
+	"unsafe"
+)
+
+// FormatType selects the FAT type created by FormatWith. FormatFAT,
+// FormatFAT32 and FormatExFAT can be combined, then the type is chosen by
+// the volume size and the cluster size. FormatSFD may be added to put the
+// volume at sector 0 without a partition table (super floppy disk).
+type FormatType byte
+
+const (
+	FormatFAT   FormatType = C.FM_FAT // FAT12 or FAT16 by the number of clusters
+	FormatFAT32 FormatType = C.FM_FAT32
+	FormatExFAT FormatType = C.FM_EXFAT
+	FormatAny   FormatType = C.FM_ANY
+	FormatSFD   FormatType = C.FM_SFD
+)
+
+// FormatOptions are the options of FormatWith. Zero values select the
+// defaults of FatFs.
+type FormatOptions struct {
+	// Type is the FAT type to create (0: FormatAny)
+	Type FormatType
+	// ClusterSize is the allocation unit in bytes, a power of 2 from
+	// SectorSize up to 32KiB for FAT/FAT32 or 16MiB for exFAT (0: by the
+	// volume size)
+	ClusterSize int
+	// FATs is the number of FAT copies of FAT/FAT32, 1 or 2 (0: 1)
+	FATs int
+	// RootEntries is the number of root directory entries of FAT12/16, a
+	// multiple of 16 (0: 512)
+	RootEntries int
+	// Align is the alignment of the data area in sectors, a power of 2 (0:
+	// the erase block size of the device, which is the AU of SD cards)
+	Align int
+	// Label is the volume label set after formatting (empty: no label)
+	Label string
+}
+
+// formatWorkSectors is the size of the work buffer of f_mkfs, which writes
+// the FAT and the directory by this number of sectors at once.
+const formatWorkSectors = 8
+
+// FormatWith creates a FAT volume on the device by opts. A nil opts is
+// the same as Format. The volume is left unmounted, unless a label is given.
+func (l *FATFS) FormatWith(opts *FormatOptions) error {
+	var parm C.MKFS_PARM
+	parm.fmt = C.FM_ANY
+	var label string
+	if opts != nil {
+		parm.fmt = C.BYTE(opts.Type)
+		if opts.Type&FormatAny == 0 {
+			parm.fmt |= C.FM_ANY
+		}
+		if opts.ClusterSize < 0 || opts.FATs < 0 || opts.FATs > 2 || opts.RootEntries < 0 || opts.Align < 0 {
+			return FileResultInvalidParameter
+		}
+		parm.au_size = C.DWORD(opts.ClusterSize)
+		parm.n_fat = C.BYTE(opts.FATs)
+		parm.n_root = C.UINT(opts.RootEntries)
+		parm.align = C.UINT(opts.Align)
+		label = opts.Label
+	}
+	l.alloc()
+	work := make([]byte, formatWorkSectors*SectorSize)
+	l.vol.RLock()
+	var err error = FileResultNotEnabled // unmounted by another goroutine
+	if l.fs != nil {
+		err = errval(C.f_mkfs(l.fs, &parm, unsafe.Pointer(&work[0]), C.UINT(len(work))))
+	}
+	l.vol.RUnlock()
+	if err != nil {
+		return err
+	}
+	if label != "" {
+		return l.SetLabel(label)
+	}
+	return nil
+}
@@ -1,8 +1,19 @@
 package fatfs
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"github.com/elehobica/pico_tinygo_vs1053/internal/gopointer"
 	"tinygo.org/x/tinyfs"
 )
 
@@ -34,9 +45,8 @@ func TestFormat(t *testing.T) {
 func createTestFS(t *testing.T) (*FATFS, tinyfs.BlockDevice, func()) {
 	// create/format/mount the filesystem
 	dev := tinyfs.NewMemoryDevice(testPageSize, testBlockSize, testBlockCount)
-	fs := New(dev)
+	fs := New(dev).Configure(&Config{SectorSize: SectorSize})
 	println("formatting")
-	//check(t, fs.Configure())
 	if err := fs.Format(); err != nil {
 		t.Fatal(err)
 	}
@@ -50,9 +60,9 @@ func createTestFS(t *testing.T) (*FATFS, tinyfs.BlockDevice, func()) {
 		t.Error("Could not mount", err)
 	}
 	return fs, dev, func() {
-		//if err := fs.Unmount(); err != nil {
-		//	t.Error("Could not ummount", err)
-		//}
+		if err := fs.Unmount(); err != nil {
+			t.Error("Could not ummount", err)
+		}
 	}
 }
 
@@ -78,6 +88,1285 @@ func TestDirectories(t *testing.T) {
 	})
 }
 
+func TestTrim(t *testing.T) {
+	fs, dev, unmount := createTestFS(t)
+	defer unmount()
+	base := countBytes(t, dev, 0x55)
+	f, err := fs.OpenFile("trim.bin", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	check(t, err)
+	buf := bytes.Repeat([]byte{0x55}, 4096)
+	_, err = f.Write(buf)
+	check(t, err)
+	check(t, f.Close())
+	if n := countBytes(t, dev, 0x55) - base; n != len(buf) {
+		t.Fatalf("expected %d bytes written, found %d", len(buf), n)
+	}
+
+	// removing the file erases its clusters
+	check(t, fs.Remove("trim.bin"))
+	if n := countBytes(t, dev, 0x55) - base; n != 0 {
+		t.Fatalf("expected clusters to be erased, found %d bytes", n)
+	}
+}
+
+// removableDevice is a memory device that can be removed and inserted.
+type removableDevice struct {
+	*tinyfs.MemBlockDevice
+	present bool
+	ready   bool
+	inits   int
+}
+
+func (r *removableDevice) Ready() bool          { return r.ready }
+func (r *removableDevice) WriteProtected() bool { return false }
+
+func (r *removableDevice) Configure() error {
+	r.inits++
+	r.ready = r.present
+	if !r.ready {
+		return errors.New("no medium")
+	}
+	return nil
+}
+
+func TestRemovable(t *testing.T) {
+	dev := &removableDevice{MemBlockDevice: tinyfs.NewMemoryDevice(testPageSize, testBlockSize, testBlockCount), present: true, ready: true}
+	fs := New(dev).Configure(&Config{SectorSize: SectorSize})
+	check(t, fs.Format())
+	check(t, fs.Mount())
+	f, err := fs.OpenFile("hotplug.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	check(t, err)
+	_, err = f.Write([]byte("hello"))
+	check(t, err)
+
+	// removal fails the open file and unmounts the volume
+	dev.present, dev.ready = false, false
+	if _, err := f.Write([]byte("world")); err != FileResultInvalidObject {
+		t.Fatalf("expected %v, was actually %v", FileResultInvalidObject, err)
+	}
+	if err := f.Close(); err != FileResultInvalidObject {
+		t.Fatalf("expected %v, was actually %v", FileResultInvalidObject, err)
+	}
+	if _, err := fs.Stat("hotplug.txt"); err != FileResultNotReady {
+		t.Fatalf("expected %v, was actually %v", FileResultNotReady, err)
+	}
+
+	// insertion initializes the medium again on mount
+	dev.present = true
+	check(t, fs.Mount())
+	if dev.inits != 2 {
+		t.Fatalf("expected 2 initializations, was actually %d", dev.inits)
+	}
+	_, err = fs.Stat("hotplug.txt")
+	check(t, err)
+}
+
+func TestVolumes(t *testing.T) {
+	sd, _, unmount := createTestFS(t)
+	defer unmount()
+	flash, _, unmount2 := createTestFS(t)
+	defer unmount2()
+
+	// both volumes are usable at the same time
+	f1, err := sd.OpenFile("track001.mp3", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	check(t, err)
+	f2, err := flash.OpenFile("config.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	check(t, err)
+	data := bytes.Repeat([]byte("ID3 music "), 200)
+	_, err = f1.Write(data)
+	check(t, err)
+	_, err = f2.Write([]byte("volume=60"))
+	check(t, err)
+	check(t, f1.Close())
+	check(t, f2.Close())
+	if _, err := flash.Stat("track001.mp3"); err != FileResultNoFile {
+		t.Fatalf("expected %v, was actually %v", FileResultNoFile, err)
+	}
+
+	vols := NewVolumes()
+	check(t, vols.Add("sd", sd))
+	check(t, vols.Add("flash", flash))
+	if err := vols.Add("sd", flash); err != ErrVolumeExist {
+		t.Fatalf("expected %v, was actually %v", ErrVolumeExist, err)
+	}
+
+	t.Run("Copy", func(t *testing.T) {
+		n, err := CopyFile(vols, "/flash/track001.mp3", vols, "/sd/track001.mp3")
+		check(t, err)
+		if n != int64(len(data)) {
+			t.Fatalf("expected %d bytes copied, was actually %d", len(data), n)
+		}
+		f, err := flash.Open("track001.mp3")
+		check(t, err)
+		buf := make([]byte, len(data)+1)
+		n2, _ := f.Read(buf)
+		check(t, f.Close())
+		if !bytes.Equal(buf[:n2], data) {
+			t.Fatal("copied data mismatch")
+		}
+		// volumes are still independent
+		check(t, vols.Remove("/sd/track001.mp3"))
+		_, err = flash.Stat("track001.mp3")
+		check(t, err)
+	})
+	t.Run("Paths", func(t *testing.T) {
+		check(t, vols.Mkdir("/sd/music", 0777))
+		info, err := sd.Stat("music")
+		check(t, err)
+		expectString(t, "music", info.Name())
+		check(t, vols.Rename("/flash/config.txt", "/flash/settings.txt"))
+		f, err := vols.Open("/flash/settings.txt")
+		check(t, err)
+		expectString(t, "/flash/settings.txt", f.(*File).Name())
+		check(t, f.Close())
+		if err := vols.Rename("/flash/settings.txt", "/sd/settings.txt"); err != ErrCrossVolume {
+			t.Fatalf("expected %v, was actually %v", ErrCrossVolume, err)
+		}
+		if _, err := vols.Stat("/usb/file"); err != FileResultInvalidDrive {
+			t.Fatalf("expected %v, was actually %v", FileResultInvalidDrive, err)
+		}
+		info, err = vols.Stat("/sd")
+		check(t, err)
+		if !info.IsDir() {
+			t.Fatal("expected a directory")
+		}
+	})
+	t.Run("Root", func(t *testing.T) {
+		f, err := vols.Open("/")
+		check(t, err)
+		infos, err := f.Readdir(0)
+		check(t, err)
+		if len(infos) != 2 || infos[0].Name() != "sd" || infos[1].Name() != "flash" {
+			t.Fatalf("unexpected volumes %v", infos)
+		}
+		check(t, f.Close())
+	})
+}
+
+func TestSeek(t *testing.T) {
+	fs, _, unmount := createTestFS(t)
+	defer unmount()
+	f, err := fs.OpenFile("seek.bin", os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	check(t, err)
+	defer f.Close()
+	file := f.(*File)
+	data := []byte("0123456789abcdefghij")
+	_, err = file.Write(data)
+	check(t, err)
+
+	for _, tc := range []struct {
+		offset   int64
+		whence   int
+		expected int64
+	}{
+		{5, io.SeekStart, 5},
+		{3, io.SeekCurrent, 8},
+		{-2, io.SeekCurrent, 6},
+		{-4, io.SeekEnd, 16},
+		{0, io.SeekEnd, 20},
+	} {
+		pos, err := file.Seek(tc.offset, tc.whence)
+		check(t, err)
+		if pos != tc.expected {
+			t.Fatalf("Seek(%d, %d): expected %d, was actually %d", tc.offset, tc.whence, tc.expected, pos)
+		}
+	}
+	if _, err := file.Seek(-21, io.SeekEnd); err != FileResultInvalidParameter {
+		t.Fatalf("expected %v, was actually %v", FileResultInvalidParameter, err)
+	}
+
+	t.Run("ReadAt", func(t *testing.T) {
+		file.Seek(3, io.SeekStart)
+		buf := make([]byte, 4)
+		n, err := file.ReadAt(buf, 10)
+		check(t, err)
+		expectString(t, "abcd", string(buf[:n]))
+		n, err = file.ReadAt(buf, 18)
+		if n != 2 || err != io.EOF {
+			t.Fatalf("expected 2 bytes and EOF, was actually %d and %v", n, err)
+		}
+		// beyond the end of a file opened for writing
+		n, err = file.ReadAt(buf, 1000)
+		if n != 0 || err != io.EOF {
+			t.Fatalf("expected 0 bytes and EOF, was actually %d and %v", n, err)
+		}
+		if size, _ := file.Size(); size != 20 {
+			t.Fatalf("expected size 20, was actually %d", size)
+		}
+		// the position is kept
+		n, err = file.Read(buf)
+		check(t, err)
+		expectString(t, "3456", string(buf[:n]))
+
+		sr := io.NewSectionReader(file, 5, 10)
+		all, err := io.ReadAll(sr)
+		check(t, err)
+		expectString(t, "56789abcde", string(all))
+	})
+	t.Run("WriteAt", func(t *testing.T) {
+		file.Seek(1, io.SeekStart)
+		_, err := file.WriteAt([]byte("XY"), 20)
+		check(t, err)
+		pos, _ := file.Tell()
+		if pos != 1 {
+			t.Fatalf("expected position 1, was actually %d", pos)
+		}
+		size, _ := file.Size()
+		if size != 22 {
+			t.Fatalf("expected size 22, was actually %d", size)
+		}
+	})
+	t.Run("Copy", func(t *testing.T) {
+		file.Seek(0, io.SeekStart)
+		var out bytes.Buffer
+		n, err := io.Copy(&out, file) // WriteTo
+		check(t, err)
+		expectString(t, "0123456789abcdefghijXY", out.String())
+
+		g, err := fs.OpenFile("copy.bin", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		check(t, err)
+		src := bytes.Repeat([]byte("0123456789"), 300)
+		n, err = io.Copy(g, bytes.NewReader(src)) // ReadFrom
+		check(t, err)
+		check(t, g.Close())
+		if n != int64(len(src)) {
+			t.Fatalf("expected %d bytes copied, was actually %d", len(src), n)
+		}
+		info, err := fs.Stat("copy.bin")
+		check(t, err)
+		if info.Size() != int64(len(src)) {
+			t.Fatalf("expected size %d, was actually %d", len(src), info.Size())
+		}
+	})
+}
+
+func TestAttributes(t *testing.T) {
+	fs, _, unmount := createTestFS(t)
+	defer unmount()
+	fs.SetClock(SystemClock)
+	before := time.Now().Add(-2 * time.Second)
+	f, err := fs.OpenFile("sync.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	check(t, err)
+	_, err = f.Write([]byte("sync"))
+	check(t, err)
+	check(t, f.Close())
+
+	info, err := fs.Stat("sync.txt")
+	check(t, err)
+	if mt := info.ModTime(); mt.Before(before) || mt.After(time.Now()) {
+		t.Fatalf("unexpected modification time %v", mt)
+	}
+	if info.Mode() != 0777 || info.Sys() != AttrArchive {
+		t.Fatalf("unexpected mode %v and attributes %v", info.Mode(), info.Sys())
+	}
+
+	t.Run("Chtimes", func(t *testing.T) {
+		mtime := time.Date(2023, 4, 5, 6, 7, 9, 0, time.Local)
+		check(t, fs.Chtimes("sync.txt", time.Now(), mtime))
+		info, err := fs.Stat("sync.txt")
+		check(t, err)
+		// FAT has a resolution of 2 seconds
+		if expected := mtime.Add(-time.Second); !info.ModTime().Equal(expected) {
+			t.Fatalf("expected %v, was actually %v", expected, info.ModTime())
+		}
+	})
+	t.Run("Chmod", func(t *testing.T) {
+		check(t, fs.Chmod("sync.txt", 0444))
+		info, err := fs.Stat("sync.txt")
+		check(t, err)
+		if info.Mode() != 0555 || info.Sys().(FileAttr)&AttrReadOnly == 0 {
+			t.Fatalf("unexpected mode %v and attributes %v", info.Mode(), info.Sys())
+		}
+		if _, err := fs.OpenFile("sync.txt", os.O_RDWR); err != FileResultDenied {
+			t.Fatalf("expected %v, was actually %v", FileResultDenied, err)
+		}
+		check(t, fs.Chmod("sync.txt", 0644))
+		f, err := fs.OpenFile("sync.txt", os.O_RDWR)
+		check(t, err)
+		check(t, f.Close())
+	})
+	t.Run("SetAttr", func(t *testing.T) {
+		check(t, fs.SetAttr("sync.txt", AttrHidden|AttrSystem, AttrHidden|AttrSystem|AttrArchive))
+		dir, err := fs.Open("/")
+		check(t, err)
+		infos, err := dir.Readdir(0)
+		check(t, err)
+		check(t, dir.Close())
+		if len(infos) != 1 || infos[0].Sys() != AttrHidden|AttrSystem {
+			t.Fatalf("unexpected directory entries %v", infos)
+		}
+	})
+}
+
+func TestClock(t *testing.T) {
+	fs, _, unmount := createTestFS(t)
+	defer unmount()
+	modTime := func(name string) time.Time {
+		f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		check(t, err)
+		check(t, f.Close())
+		info, err := fs.Stat(name)
+		check(t, err)
+		return info.ModTime()
+	}
+	nortc := time.Date(2018, 1, 1, 0, 0, 0, 0, time.Local)
+
+	if mt := modTime("noclock.txt"); !mt.Equal(nortc) {
+		t.Fatalf("expected %v, was actually %v", nortc, mt)
+	}
+	clock := &SoftClock{}
+	fs.SetClock(clock)
+	if mt := modTime("notset.txt"); !mt.Equal(nortc) {
+		t.Fatalf("expected %v, was actually %v", nortc, mt)
+	}
+	now := time.Date(2023, 7, 8, 9, 10, 12, 0, time.Local)
+	clock.Set(now)
+	if mt := modTime("soft.txt"); mt.Before(now) || mt.After(now.Add(2*time.Second)) {
+		t.Fatalf("expected %v, was actually %v", now, mt)
+	}
+	// time since boot
+	fs.SetClock(ClockFunc(func() time.Time { return time.Unix(3600, 0) }))
+	if mt := modTime("boot.txt"); !mt.Equal(nortc) {
+		t.Fatalf("expected %v, was actually %v", nortc, mt)
+	}
+
+	// the clock is set from the console while a file is written
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			clock.Set(now.Add(time.Duration(i) * time.Hour))
+			fs.SetClock(clock)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		modTime("console.txt")
+	}
+	<-done
+}
+
+func TestFattime(t *testing.T) {
+	for _, tc := range []struct {
+		time     time.Time
+		expected time.Time
+	}{
+		{time.Date(1980, 1, 1, 0, 0, 0, 0, time.Local), time.Date(1980, 1, 1, 0, 0, 0, 0, time.Local)},
+		{time.Date(2022, 12, 31, 23, 59, 59, 0, time.Local), time.Date(2022, 12, 31, 23, 59, 58, 0, time.Local)},
+		{time.Date(1970, 1, 1, 0, 0, 0, 0, time.Local), time.Date(1980, 1, 1, 0, 0, 0, 0, time.Local)},
+		{time.Date(2200, 1, 1, 0, 0, 0, 0, time.Local), time.Date(2107, 12, 31, 23, 59, 58, 0, time.Local)},
+	} {
+		if actual := fromFattime(toFattime(tc.time)); !actual.Equal(tc.expected) {
+			t.Errorf("%v: expected %v, was actually %v", tc.time, tc.expected, actual)
+		}
+	}
+	if !fromFattime(0).IsZero() {
+		t.Error("expected the zero time")
+	}
+}
+
+func TestStatfs(t *testing.T) {
+	fs, dev, unmount := createTestFS(t)
+	defer unmount()
+	st, err := fs.Statfs()
+	check(t, err)
+	if st.Type != TypeFAT12 || st.ClusterSize < SectorSize || st.SerialNumber == 0 {
+		t.Fatalf("unexpected statistics %+v", st)
+	}
+	if st.TotalBytes != int64(st.TotalClusters)*st.ClusterSize || st.TotalBytes > dev.Size() {
+		t.Fatalf("unexpected total size %+v", st)
+	}
+	size, err := fs.GetCardSize()
+	check(t, err)
+	if size != st.TotalBytes {
+		t.Fatalf("expected card size %d, was actually %d", st.TotalBytes, size)
+	}
+
+	// a file of 10 clusters takes 10 clusters
+	f, err := fs.OpenFile("record.wav", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	check(t, err)
+	_, err = f.Write(make([]byte, 10*st.ClusterSize))
+	check(t, err)
+	check(t, f.Close())
+	st2, err := fs.Statfs()
+	check(t, err)
+	if st2.FreeClusters != st.FreeClusters-10 || st2.FreeBytes != st.FreeBytes-10*st.ClusterSize {
+		t.Fatalf("expected 10 clusters less free, was actually %d -> %d", st.FreeClusters, st2.FreeClusters)
+	}
+	free, err := fs.Free()
+	check(t, err)
+	if free != st2.FreeBytes {
+		t.Fatalf("expected %d bytes free, was actually %d", st2.FreeBytes, free)
+	}
+
+	t.Run("Label", func(t *testing.T) {
+		expectString(t, "", st.Label)
+		check(t, fs.SetLabel("Music"))
+		st, err := fs.Statfs()
+		check(t, err)
+		expectString(t, "MUSIC", st.Label)
+		check(t, fs.SetLabel(""))
+		st, err = fs.Statfs()
+		check(t, err)
+		expectString(t, "", st.Label)
+		if err := fs.SetLabel("bad*label"); err != FileResultInvalidName {
+			t.Fatalf("expected %v, was actually %v", FileResultInvalidName, err)
+		}
+	})
+}
+
+func TestFormatOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		blocks  int // 4KiB erase blocks
+		opts    FormatOptions
+		fsType  Type
+		cluster int64
+	}{
+		{"FAT12", 256, FormatOptions{Type: FormatFAT}, TypeFAT12, 0},
+		{"FAT16", 4096, FormatOptions{Type: FormatFAT, ClusterSize: 2048}, TypeFAT16, 2048},
+		{"FAT32", 10240, FormatOptions{Type: FormatFAT32, ClusterSize: SectorSize}, TypeFAT32, SectorSize},
+		{"ExFAT", 2048, FormatOptions{Type: FormatExFAT, ClusterSize: 32768}, TypeEXFAT, 32768},
+		{"Any", 2048, FormatOptions{}, TypeFAT16, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev := tinyfs.NewMemoryDevice(testPageSize, 4096, tt.blocks)
+			fs := New(dev).Configure(&Config{SectorSize: SectorSize})
+			check(t, fs.FormatWith(&tt.opts))
+			check(t, fs.Mount())
+			st, err := fs.Statfs()
+			check(t, err)
+			if st.Type != tt.fsType || (tt.cluster != 0 && st.ClusterSize != tt.cluster) {
+				t.Fatalf("expected %v with %d bytes cluster, was actually %v with %d", tt.fsType, tt.cluster, st.Type, st.ClusterSize)
+			}
+			// data area aligned to the erase block of the device
+			if fs.fs.database%8 != 0 {
+				t.Fatalf("expected data area aligned to 8 sectors, was actually %d", fs.fs.database)
+			}
+			f, err := fs.OpenFile("track001.mp3", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+			check(t, err)
+			_, err = f.Write([]byte("ID3"))
+			check(t, err)
+			check(t, f.Close())
+			info, err := fs.Stat("track001.mp3")
+			check(t, err)
+			if info.Size() != 3 {
+				t.Fatalf("expected size 3, was actually %d", info.Size())
+			}
+		})
+	}
+
+	t.Run("Layout", func(t *testing.T) {
+		dev := tinyfs.NewMemoryDevice(testPageSize, 4096, 256)
+		fs := New(dev).Configure(&Config{SectorSize: SectorSize})
+		check(t, fs.FormatWith(&FormatOptions{
+			Type:        FormatFAT | FormatSFD,
+			FATs:        2,
+			RootEntries: 1024,
+			Align:       128,
+			Label:       "Recorder",
+		}))
+		// no partition table, the boot sector at sector 0
+		buf := make([]byte, SectorSize)
+		dev.ReadAt(buf, 0)
+		if buf[0] != 0xEB || buf[510] != 0x55 || buf[511] != 0xAA {
+			t.Fatalf("expected boot sector at 0, was actually % X", buf[:3])
+		}
+		check(t, fs.Mount())
+		if fs.fs.volbase != 0 || fs.fs.n_fats != 2 || fs.fs.n_rootdir != 1024 || fs.fs.database%128 != 0 {
+			t.Fatalf("unexpected layout volbase %d fats %d root entries %d data %d",
+				fs.fs.volbase, fs.fs.n_fats, fs.fs.n_rootdir, fs.fs.database)
+		}
+		st, err := fs.Statfs()
+		check(t, err)
+		expectString(t, "RECORDER", st.Label)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		dev := tinyfs.NewMemoryDevice(testPageSize, 4096, 256)
+		fs := New(dev).Configure(&Config{SectorSize: SectorSize})
+		for _, opts := range []FormatOptions{
+			{ClusterSize: 1000},
+			{ClusterSize: 256},
+			{Type: FormatFAT, ClusterSize: 128 * SectorSize * 2},
+			{FATs: 3},
+		} {
+			if err := fs.FormatWith(&opts); err != FileResultInvalidParameter {
+				t.Fatalf("%+v: expected %v, was actually %v", opts, FileResultInvalidParameter, err)
+			}
+		}
+		// FAT32 needs 65526 clusters at least
+		if err := fs.FormatWith(&FormatOptions{Type: FormatFAT32}); err != FileResultMkfsAborted {
+			t.Fatalf("expected %v, was actually %v", FileResultMkfsAborted, err)
+		}
+	})
+}
+
+// countingDevice counts the sectors read from the device.
+type countingDevice struct {
+	tinyfs.BlockDevice
+	reads int
+}
+
+func (d *countingDevice) ReadAt(buf []byte, off int64) (int, error) {
+	d.reads += len(buf) / SectorSize
+	return d.BlockDevice.ReadAt(buf, off)
+}
+
+func TestFastSeek(t *testing.T) {
+	const fragments = 400
+	dev := &countingDevice{BlockDevice: tinyfs.NewMemoryDevice(testPageSize, testBlockSize, testBlockCount)}
+	fs := New(dev).Configure(&Config{SectorSize: SectorSize})
+	check(t, fs.Format())
+	check(t, fs.Mount())
+
+	// fragment the file by writing another file cluster by cluster
+	clust := int(fs.fs.csize) * SectorSize
+	a, err := fs.OpenFile("audiobook.mp3", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	check(t, err)
+	b, err := fs.OpenFile("filler.bin", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	check(t, err)
+	data := make([]byte, fragments*clust)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	for i := 0; i < fragments; i++ {
+		_, err = a.Write(data[i*clust : (i+1)*clust])
+		check(t, err)
+		_, err = b.Write(data[:clust])
+		check(t, err)
+	}
+	check(t, a.Close())
+	check(t, b.Close())
+	check(t, fs.Remove("filler.bin"))
+
+	// reads of a seek to pos and reading a byte there
+	seekReads := func(file *File, pos int64) int {
+		file.Seek(0, io.SeekStart)
+		dev.reads = 0
+		_, err := file.Seek(pos, io.SeekStart)
+		check(t, err)
+		buf := make([]byte, 1)
+		_, err = file.Read(buf)
+		check(t, err)
+		if buf[0] != data[pos] {
+			t.Fatalf("data mismatch at %d", pos)
+		}
+		return dev.reads
+	}
+	near := int64(clust + 100)
+	far := int64(len(data) - 100)
+
+	f, err := fs.Open("audiobook.mp3")
+	check(t, err)
+	file := f.(*File)
+	entries, err := file.FastSeekEntries()
+	check(t, err)
+	if entries != 2+2*fragments {
+		t.Fatalf("expected %d entries, was actually %d", 2+2*fragments, entries)
+	}
+	normal := seekReads(file, far)
+
+	if err := file.EnableFastSeek(entries - 1); err != FileResultNotEnoughCore {
+		t.Fatalf("expected %v, was actually %v", FileResultNotEnoughCore, err)
+	}
+	if file.FastSeek() {
+		t.Fatal("fast seek enabled with a short table")
+	}
+	check(t, file.EnableFastSeek(entries))
+	fastNear, fastFar := seekReads(file, near), seekReads(file, far)
+	if fastNear != 1 || fastFar != 1 {
+		t.Fatalf("expected 1 sector read, was actually %d (near) and %d (far)", fastNear, fastFar)
+	}
+	if normal <= fastFar {
+		t.Fatalf("expected the normal seek to read the FAT, was actually %d sectors", normal)
+	}
+	for pos := int64(0); pos < int64(len(data)); pos += int64(clust)*37 + 123 {
+		buf := make([]byte, 300)
+		n, _ := file.ReadAt(buf, pos)
+		if !bytes.Equal(buf[:n], data[pos:pos+int64(n)]) {
+			t.Fatalf("data mismatch at %d", pos)
+		}
+	}
+	check(t, file.Close())
+
+	// enabled on open by Config
+	fs = New(dev).Configure(&Config{SectorSize: SectorSize, FastSeek: entries})
+	check(t, fs.Mount())
+	f, err = fs.Open("audiobook.mp3")
+	check(t, err)
+	file = f.(*File)
+	if !file.FastSeek() {
+		t.Fatal("fast seek not enabled on open")
+	}
+	if n := seekReads(file, far); n != 1 {
+		t.Fatalf("expected 1 sector read, was actually %d", n)
+	}
+	check(t, file.Close())
+	f, err = fs.OpenFile("audiobook.mp3", os.O_RDWR)
+	check(t, err)
+	if f.(*File).FastSeek() {
+		t.Fatal("fast seek enabled for writing")
+	}
+	check(t, f.Close())
+}
+
+func TestReaddir(t *testing.T) {
+	fs, _, unmount := createTestFS(t)
+	defer unmount()
+	for _, name := range []string{"track001.mp3", "track002.mp3", "track003.mp3", "cover.jpg", "notes.txt"} {
+		f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		check(t, err)
+		check(t, f.Close())
+	}
+	f, err := fs.Open("/")
+	check(t, err)
+	defer f.Close()
+
+	var names []string
+	for {
+		infos, err := f.Readdir(2)
+		if err == io.EOF {
+			break
+		}
+		check(t, err)
+		if len(infos) == 0 || len(infos) > 2 {
+			t.Fatalf("expected 1 or 2 entries, was actually %d", len(infos))
+		}
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+	}
+	if len(names) != 5 {
+		t.Fatalf("expected 5 entries, was actually %v", names)
+	}
+	infos, err := f.Readdir(0)
+	check(t, err)
+	if len(infos) != 0 {
+		t.Fatalf("expected no more entries, was actually %d", len(infos))
+	}
+
+	check(t, f.(*File).Rewind())
+	infos, err = f.Readdir(3)
+	check(t, err)
+	if len(infos) != 3 {
+		t.Fatalf("expected 3 entries, was actually %d", len(infos))
+	}
+	infos, err = f.Readdir(-1)
+	check(t, err)
+	if len(infos) != 2 {
+		t.Fatalf("expected 2 remaining entries, was actually %d", len(infos))
+	}
+
+	t.Run("Find", func(t *testing.T) {
+		infos, err := fs.Find("/", "TRACK*.mp3")
+		check(t, err)
+		if len(infos) != 3 || infos[0].Name() != "track001.mp3" {
+			t.Fatalf("unexpected entries %v", infos)
+		}
+		infos, err = fs.Find("/", "?????.*")
+		check(t, err)
+		if len(infos) != 2 {
+			t.Fatalf("unexpected entries %v", infos)
+		}
+		if _, err := fs.Find("/album", "*"); !errors.Is(err, iofs.ErrNotExist) {
+			t.Fatalf("expected %v, was actually %v", iofs.ErrNotExist, err)
+		}
+	})
+}
+
+// failingDevice fails the reads of the sector at failAt, and records the
+// offset of the last read.
+type failingDevice struct {
+	tinyfs.BlockDevice
+	failAt int64
+	last   int64
+}
+
+func (d *failingDevice) ReadAt(buf []byte, off int64) (int, error) {
+	if off == d.failAt {
+		return 0, errors.New("read error")
+	}
+	d.last = off
+	return d.BlockDevice.ReadAt(buf, off)
+}
+
+func TestFindError(t *testing.T) {
+	dev := &failingDevice{BlockDevice: tinyfs.NewMemoryDevice(testPageSize, testBlockSize, testBlockCount), failAt: -1}
+	fs := New(dev).Configure(&Config{SectorSize: SectorSize})
+	check(t, fs.Format())
+	check(t, fs.Mount())
+	defer fs.Unmount()
+	// one more than the slots of FF_FS_LOCK
+	const dirs = 17
+	for i := 0; i < dirs; i++ {
+		check(t, fs.Mkdir(fmt.Sprintf("album%02d", i), 0777))
+	}
+
+	// each failure of the first f_findnext closes the directory, otherwise
+	// its slot of FF_FS_LOCK is lost
+	for i := 0; i < dirs-1; i++ {
+		dir := fmt.Sprintf("/album%02d", i)
+		// the directory is read last
+		_, err := fs.Find(dir, "*")
+		check(t, err)
+		dev.failAt = dev.last
+		if _, err := fs.Find(dir, "*"); err != FileResultErr {
+			t.Fatalf("expected %v, was actually %v", FileResultErr, err)
+		}
+		dev.failAt = -1
+	}
+	f, err := fs.Open(fmt.Sprintf("/album%02d", dirs-1))
+	check(t, err)
+	check(t, f.Close())
+}
+
+func TestIOFS(t *testing.T) {
+	fs, _, unmount := createTestFS(t)
+	defer unmount()
+	check(t, fs.Mkdir("album", 0777))
+	check(t, fs.Mkdir("album/disc2", 0777))
+	files := map[string]string{
+		"track001.mp3":             "ID3 one",
+		"album/track002.mp3":       "ID3 two",
+		"album/cover.jpg":          "JFIF",
+		"album/disc2/track003.MP3": "ID3 three",
+	}
+	for name, data := range files {
+		f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		check(t, err)
+		_, err = f.Write([]byte(data))
+		check(t, err)
+		check(t, f.Close())
+	}
+	fsys := NewIOFS(fs)
+	check(t, fstest.TestFS(fsys, "track001.mp3", "album/track002.mp3", "album/cover.jpg", "album/disc2/track003.MP3"))
+
+	var walked []string
+	check(t, iofs.WalkDir(fsys, ".", func(path string, d iofs.DirEntry, err error) error {
+		walked = append(walked, path)
+		return err
+	}))
+	expectString(t, ".,album,album/cover.jpg,album/disc2,album/disc2/track003.MP3,album/track002.mp3,track001.mp3", strings.Join(walked, ","))
+
+	for pattern, expected := range map[string]string{
+		"*.mp3":        "track001.mp3",
+		"album/*.mp3":  "album/track002.mp3",
+		"album/*":      "album/cover.jpg,album/disc2,album/track002.mp3",
+		"*/*/*.MP3":    "album/disc2/track003.MP3",
+		"album/[a-c]*": "album/cover.jpg",
+		"none/*.mp3":   "",
+	} {
+		matches, err := iofs.Glob(fsys, pattern)
+		check(t, err)
+		expectString(t, expected, strings.Join(matches, ","))
+	}
+
+	data, err := iofs.ReadFile(fsys, "album/disc2/track003.MP3")
+	check(t, err)
+	expectString(t, "ID3 three", string(data))
+	if _, err := fsys.Open("/track001.mp3"); !errors.Is(err, iofs.ErrInvalid) {
+		t.Fatalf("expected %v, was actually %v", iofs.ErrInvalid, err)
+	}
+	if _, err := fsys.Stat("track999.mp3"); !errors.Is(err, iofs.ErrNotExist) {
+		t.Fatalf("expected %v, was actually %v", iofs.ErrNotExist, err)
+	}
+
+	t.Run("Volumes", func(t *testing.T) {
+		vols := NewVolumes()
+		check(t, vols.Add("sd", fs))
+		fsys := NewIOFS(vols)
+		matches, err := iofs.Glob(fsys, "sd/album/*.mp3")
+		check(t, err)
+		expectString(t, "sd/album/track002.mp3", strings.Join(matches, ","))
+		check(t, fstest.TestFS(fsys, "sd/track001.mp3", "sd/album/disc2/track003.MP3"))
+	})
+}
+
+func TestChdir(t *testing.T) {
+	fat, _, unmount := createTestFS(t)
+	defer unmount()
+	exfat := New(tinyfs.NewMemoryDevice(testPageSize, 4096, 2048)).Configure(&Config{SectorSize: SectorSize})
+	check(t, exfat.FormatWith(&FormatOptions{Type: FormatExFAT}))
+	check(t, exfat.Mount())
+
+	for _, fs := range []*FATFS{fat, exfat} {
+		typ, _ := fs.GetFsType()
+		t.Run(typ.String(), func(t *testing.T) {
+			expectWd := func(expected string) {
+				t.Helper()
+				wd, err := fs.Getwd()
+				check(t, err)
+				expectString(t, expected, wd)
+			}
+			expectWd("/")
+			check(t, fs.Mkdir("Album", 0777))
+			check(t, fs.Mkdir("Album/Disc2", 0777))
+			check(t, fs.Chdir("Album"))
+			expectWd("/Album")
+
+			// relative paths start from the current directory
+			f, err := fs.OpenFile("track001.mp3", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+			check(t, err)
+			check(t, f.Close())
+			_, err = fs.Stat("/Album/track001.mp3")
+			check(t, err)
+
+			check(t, fs.Chdir("Disc2"))
+			expectWd("/Album/Disc2")
+			check(t, fs.Rename("../track001.mp3", "./track001.mp3"))
+			_, err = fs.Stat("/Album/Disc2/track001.mp3")
+			check(t, err)
+			dir, err := fs.Open(".")
+			check(t, err)
+			infos, err := dir.Readdir(-1)
+			check(t, err)
+			if len(infos) != 1 || infos[0].Name() != "track001.mp3" {
+				t.Fatalf("unexpected entries %v", infos)
+			}
+			check(t, dir.Close())
+
+			check(t, fs.Chdir("./../Disc2/.."))
+			expectWd("/Album")
+			check(t, fs.Chdir(".."))
+			expectWd("/")
+			check(t, fs.Chdir("../.."))
+			expectWd("/")
+
+			if err := fs.Chdir("Album/Disc2/track001.mp3"); err != FileResultNoPath {
+				t.Fatalf("expected %v, was actually %v", FileResultNoPath, err)
+			}
+			if err := fs.Chdir("Single"); err != FileResultNoPath {
+				t.Fatalf("expected %v, was actually %v", FileResultNoPath, err)
+			}
+			expectWd("/")
+
+			check(t, fs.Chdir("/Album/Disc2"))
+			check(t, fs.Mount())
+			expectWd("/")
+		})
+	}
+
+	t.Run("Case", func(t *testing.T) {
+		check(t, fat.Chdir("ALBUM/disc2"))
+		wd, err := fat.Getwd()
+		check(t, err)
+		expectString(t, "/Album/Disc2", wd)
+	})
+
+	t.Run("Volumes", func(t *testing.T) {
+		vols := NewVolumes()
+		check(t, vols.Add("sd", fat))
+		check(t, vols.Add("flash", exfat))
+		check(t, vols.Chdir("sd/album"))
+		wd, err := vols.Getwd()
+		check(t, err)
+		expectString(t, "/sd/Album", wd)
+		_, err = vols.Stat("Disc2/track001.mp3")
+		check(t, err)
+		check(t, vols.Chdir("../../flash"))
+		wd, _ = vols.Getwd()
+		expectString(t, "/flash", wd)
+		check(t, vols.Chdir(".."))
+		f, err := vols.Open(".")
+		check(t, err)
+		infos, err := f.Readdir(-1)
+		check(t, err)
+		if len(infos) != 2 {
+			t.Fatalf("unexpected volumes %v", infos)
+		}
+		check(t, f.Close())
+	})
+}
+
+func TestUnmount(t *testing.T) {
+	dev := tinyfs.NewMemoryDevice(testPageSize, testBlockSize, testBlockCount)
+	fs := New(dev).Configure(&Config{SectorSize: SectorSize, FastSeek: 16})
+	check(t, fs.Format())
+	check(t, fs.Mkdir("album", 0777))
+	f, err := fs.OpenFile("track001.mp3", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	check(t, err)
+	check(t, f.Close())
+	pointers := gopointer.Count()
+
+	for cycle := 0; cycle < 10; cycle++ {
+		check(t, fs.Mount())
+		w, err := fs.OpenFile("record.wav", os.O_RDWR|os.O_CREATE|os.O_APPEND)
+		check(t, err)
+		_, err = w.Write([]byte("RIFF"))
+		check(t, err)
+		r, err := fs.OpenFile("track001.mp3", os.O_RDONLY)
+		check(t, err)
+		dir, err := fs.Open("album")
+		check(t, err)
+		closed, err := fs.Open("/")
+		check(t, err)
+		check(t, closed.Close())
+		if n := fs.OpenFiles(); n != 3 {
+			t.Fatalf("expected 3 open files, was actually %d", n)
+		}
+
+		// the data written is flushed and the handles are invalidated
+		check(t, fs.Unmount())
+		if n := fs.OpenFiles(); n != 0 {
+			t.Fatalf("expected no open files, was actually %d", n)
+		}
+		if n := gopointer.Count(); n != pointers-1 {
+			t.Fatalf("expected %d saved pointers, was actually %d", pointers-1, n)
+		}
+		if _, err := w.Write([]byte("RIFF")); err != FileResultInvalidObject {
+			t.Fatalf("expected %v, was actually %v", FileResultInvalidObject, err)
+		}
+		if _, err := r.Read(make([]byte, 4)); err != FileResultInvalidObject {
+			t.Fatalf("expected %v, was actually %v", FileResultInvalidObject, err)
+		}
+		if _, err := r.(*File).Seek(0, io.SeekStart); err != FileResultInvalidObject {
+			t.Fatalf("expected %v, was actually %v", FileResultInvalidObject, err)
+		}
+		if _, err := dir.Readdir(-1); err != FileResultInvalidObject {
+			t.Fatalf("expected %v, was actually %v", FileResultInvalidObject, err)
+		}
+		check(t, w.Close())
+		if _, err := fs.Stat("record.wav"); err != FileResultNotEnabled {
+			t.Fatalf("expected %v, was actually %v", FileResultNotEnabled, err)
+		}
+		if _, err := fs.Open("album"); err != FileResultNotEnabled {
+			t.Fatalf("expected %v, was actually %v", FileResultNotEnabled, err)
+		}
+		if _, err := fs.GetFsType(); err != FileResultNotEnabled {
+			t.Fatalf("expected %v, was actually %v", FileResultNotEnabled, err)
+		}
+		check(t, fs.Unmount())
+	}
+
+	check(t, fs.Mount())
+	info, err := fs.Stat("record.wav")
+	check(t, err)
+	if info.Size() != 10*4 {
+		t.Fatalf("expected size %d, was actually %d", 10*4, info.Size())
+	}
+	if n := gopointer.Count(); n != pointers {
+		t.Fatalf("expected %d saved pointers, was actually %d", pointers, n)
+	}
+	check(t, fs.Unmount())
+}
+
+func TestReadAtConcurrent(t *testing.T) {
+	fs, _, unmount := createTestFS(t)
+	defer unmount()
+	data := make([]byte, 8000)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	f, err := fs.OpenFile("track001.mp3", os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	check(t, err)
+	defer f.Close()
+	_, err = f.Write(data)
+	check(t, err)
+	file := f.(*File)
+	file.Seek(0, io.SeekStart)
+
+	errs := make(chan error, 5)
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		r := r
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 333)
+			for i := 0; i < 50; i++ {
+				off := int64((r*1009 + i*617) % len(data))
+				n, err := file.ReadAt(buf, off)
+				if err != nil && err != io.EOF {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(buf[:n], data[off:off+int64(n)]) {
+					errs <- fmt.Errorf("ReadAt(%d) read other data", off)
+					return
+				}
+			}
+		}()
+	}
+	// sequential reads of the position are not disturbed
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		all, err := io.ReadAll(file)
+		if err != nil {
+			errs <- err
+		} else if !bytes.Equal(all, data) {
+			errs <- errors.New("Read disturbed by ReadAt")
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestUnmountConcurrent(t *testing.T) {
+	fs, _, unmount := createTestFS(t)
+	defer unmount()
+	check(t, fs.Mkdir("album", 0777))
+
+	done := make(chan struct{})
+	errs := make(chan error, 3)
+	var wg sync.WaitGroup
+	for _, fn := range []func() error{
+		func() error { _, err := fs.Stat("album"); return err },
+		func() error { _, err := fs.Statfs(); return err },
+		func() error { _, err := fs.Find("/", "*"); return err },
+	} {
+		fn := fn
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := fn(); err != nil && err != FileResultNotEnabled {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		check(t, fs.Unmount())
+		check(t, fs.Mount())
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	fs, _, unmount := createTestFS(t)
+	defer unmount()
+	f, err := fs.OpenFile("track001.mp3", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	check(t, err)
+	_, err = f.Write(make([]byte, 4000))
+	check(t, err)
+	check(t, f.Close())
+
+	// the player goroutine reads while the card is removed
+	for _, stop := range []func(f tinyfs.File) error{
+		func(f tinyfs.File) error { return f.Close() },
+		func(f tinyfs.File) error { return fs.Unmount() },
+	} {
+		check(t, fs.Mount())
+		f, err := fs.OpenFile("track001.mp3", os.O_RDONLY)
+		check(t, err)
+		reading := make(chan struct{})
+		result := make(chan error, 1)
+		go func() {
+			buf := make([]byte, 300)
+			for i := 0; ; i++ {
+				if i == 10 {
+					close(reading)
+				}
+				_, err := f.Read(buf)
+				if err == io.EOF {
+					err = f.(*File).Rewind()
+				}
+				if err != nil {
+					result <- err
+					return
+				}
+			}
+		}()
+		<-reading
+		check(t, stop(f))
+		if err := <-result; err != FileResultInvalidObject {
+			t.Fatalf("expected %v, was actually %v", FileResultInvalidObject, err)
+		}
+		if n := fs.OpenFiles(); n != 0 {
+			t.Fatalf("expected no open files, was actually %d", n)
+		}
+	}
+}
+
+func TestLock(t *testing.T) {
+	fs, _, unmount := createTestFS(t)
+	defer unmount()
+	w, err := fs.OpenFile("record.wav", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	check(t, err)
+	if _, err := fs.OpenFile("record.wav", os.O_RDWR); err != FileResultLocked {
+		t.Fatalf("expected %v, was actually %v", FileResultLocked, err)
+	}
+	if _, err := fs.OpenFile("record.wav", os.O_RDONLY); err != FileResultLocked {
+		t.Fatalf("expected %v, was actually %v", FileResultLocked, err)
+	}
+	if err := fs.Remove("record.wav"); err != FileResultLocked {
+		t.Fatalf("expected %v, was actually %v", FileResultLocked, err)
+	}
+	check(t, w.Close())
+
+	// any number of readers
+	r1, err := fs.OpenFile("record.wav", os.O_RDONLY)
+	check(t, err)
+	r2, err := fs.OpenFile("record.wav", os.O_RDONLY)
+	check(t, err)
+	if _, err := fs.OpenFile("record.wav", os.O_WRONLY|os.O_CREATE|os.O_TRUNC); err != FileResultLocked {
+		t.Fatalf("expected %v, was actually %v", FileResultLocked, err)
+	}
+	check(t, r1.Close())
+	check(t, r2.Close())
+	check(t, fs.Remove("record.wav"))
+}
+
+func TestConcurrent(t *testing.T) {
+	t.Run("OneVolume", func(t *testing.T) { testConcurrent(t, 1) })
+	// the file lock table of FatFs is shared by the volumes
+	t.Run("TwoVolumes", func(t *testing.T) { testConcurrent(t, 2) })
+}
+
+// testConcurrent reads and writes files of each volume from several
+// goroutines at the same time.
+func testConcurrent(t *testing.T, volumes int) {
+	const (
+		readers = 4
+		writers = 2
+		loops   = 20
+		size    = 6000
+	)
+	pattern := func(seed, n int) []byte {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(seed + i*13 + i/97)
+		}
+		return data
+	}
+	music := pattern(1, size)
+	filesystems := make([]*FATFS, volumes)
+	for v := range filesystems {
+		fs, _, unmount := createTestFS(t)
+		defer unmount()
+		f, err := fs.OpenFile("track001.mp3", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		check(t, err)
+		_, err = f.Write(music)
+		check(t, err)
+		check(t, f.Close())
+		filesystems[v] = fs
+	}
+
+	errs := make(chan error, volumes*(readers+writers+1))
+	var wg sync.WaitGroup
+	run := func(fn func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	for _, fs := range filesystems {
+		fs := fs
+		readAll := func(name string) ([]byte, error) {
+			f, err := fs.OpenFile(name, os.O_RDONLY)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			return io.ReadAll(f)
+		}
+
+		for r := 0; r < readers; r++ {
+			run(func() error {
+				for i := 0; i < loops; i++ {
+					data, err := readAll("track001.mp3")
+					if err != nil {
+						return err
+					}
+					if !bytes.Equal(data, music) {
+						return errors.New("track001.mp3 corrupted")
+					}
+				}
+				return nil
+			})
+		}
+		for w := 0; w < writers; w++ {
+			name := "record" + string(rune('0'+w)) + ".wav"
+			run(func() error {
+				for i := 0; i < loops; i++ {
+					data := pattern(i, size/2+i*50)
+					f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+					if err != nil {
+						return err
+					}
+					for off := 0; off < len(data); off += 700 {
+						end := off + 700
+						if end > len(data) {
+							end = len(data)
+						}
+						if _, err := f.Write(data[off:end]); err != nil {
+							f.Close()
+							return err
+						}
+					}
+					if err := f.Close(); err != nil {
+						return err
+					}
+					read, err := readAll(name)
+					if err != nil {
+						return err
+					}
+					if !bytes.Equal(read, data) {
+						return errors.New(name + " corrupted")
+					}
+				}
+				return nil
+			})
+		}
+		run(func() error {
+			for i := 0; i < loops; i++ {
+				if _, err := fs.Stat("track001.mp3"); err != nil {
+					return err
+				}
+				dir, err := fs.Open("/")
+				if err != nil {
+					return err
+				}
+				_, err = dir.Readdir(-1)
+				dir.Close()
+				if err != nil {
+					return err
+				}
+				if _, err := fs.Statfs(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	for _, fs := range filesystems {
+		if n := fs.OpenFiles(); n != 0 {
+			t.Fatalf("expected no open files, was actually %d", n)
+		}
+	}
+}
+
+func countBytes(t *testing.T, dev tinyfs.BlockDevice, b byte) int {
+	buf := make([]byte, dev.Size())
+	_, err := dev.ReadAt(buf, 0)
+	check(t, err)
+	return bytes.Count(buf, []byte{b})
+}
+
 func expectString(t *testing.T, expected string, actual string) {
 	if expected != actual {
 		t.Fatalf("expected \"%s\", was actually \"%s\"", expected, actual)
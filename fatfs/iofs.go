@@ -0,0 +1,173 @@
+package fatfs
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"tinygo.org/x/tinyfs"
+)
+
+// IOFS adapts a tinyfs.Filesystem such as FATFS or Volumes to io/fs, so that
+// fs.WalkDir, fs.Glob and fs.ReadFile work on the volumes. Names are
+// slash-separated paths relative to the root directory as fs.ValidPath
+// requires, e.g. "track001.mp3" or "sd/album/track001.mp3".
+type IOFS struct {
+	fsys tinyfs.Filesystem
+}
+
+var (
+	_ fs.ReadDirFS   = (*IOFS)(nil)
+	_ fs.StatFS      = (*IOFS)(nil)
+	_ fs.GlobFS      = (*IOFS)(nil)
+	_ fs.ReadDirFile = (*ioFile)(nil)
+)
+
+func NewIOFS(fsys tinyfs.Filesystem) *IOFS {
+	return &IOFS{fsys: fsys}
+}
+
+// abs returns the path in the filesystem of name. Backslashes are rejected,
+// as FatFs takes them as separators.
+func (f *IOFS) abs(op, name string) (string, error) {
+	if !fs.ValidPath(name) || strings.ContainsRune(name, '\\') {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return "/", nil
+	}
+	return "/" + name, nil
+}
+
+func (f *IOFS) Open(name string) (fs.File, error) {
+	p, err := f.abs("open", name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := f.fsys.Open(p)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &ioFile{file: file, iofs: f, name: name}, nil
+}
+
+func (f *IOFS) Stat(name string) (fs.FileInfo, error) {
+	p, err := f.abs("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	if name == "." {
+		// FatFs cannot stat the root directory
+		return &Info{name: ".", attr: AttrDirectory}, nil
+	}
+	info, err := f.fsys.Stat(p)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return info, nil
+}
+
+// ReadDir returns the entries of the directory name sorted by name.
+func (f *IOFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries, err := file.(*ioFile).ReadDir(-1)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, err
+}
+
+// Glob returns the names matching pattern as fs.Glob does. On FATFS, a
+// pattern with '*' and '?' only in its last element is searched by
+// FATFS.Find without reading the information of the other entries.
+func (f *IOFS) Glob(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	l, ok := f.fsys.(*FATFS)
+	dir, file := path.Split(pattern)
+	dir = strings.TrimSuffix(dir, "/")
+	if !ok || hasMeta(dir) || strings.ContainsAny(file, `[\`) {
+		// hide this method from fs.Glob
+		return fs.Glob(struct{ fs.ReadDirFS }{f}, pattern)
+	}
+	if !hasMeta(file) {
+		if _, err := f.Stat(pattern); err != nil {
+			return nil, nil
+		}
+		return []string{pattern}, nil
+	}
+	if dir != "" && !fs.ValidPath(dir) {
+		return nil, nil
+	}
+	infos, err := l.Find("/"+dir, file)
+	if err != nil {
+		// fs.Glob ignores I/O errors as well
+		return nil, nil
+	}
+	var matches []string
+	for _, info := range infos {
+		// FatFs matches without case sensitivity, path.Match does not
+		if ok, _ := path.Match(file, info.Name()); ok {
+			matches = append(matches, path.Join(dir, info.Name()))
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func hasMeta(s string) bool {
+	return strings.ContainsAny(s, `*?[\`)
+}
+
+// ioFile is the fs.File of IOFS.
+type ioFile struct {
+	file tinyfs.File
+	iofs *IOFS
+	name string
+}
+
+func (f *ioFile) Stat() (fs.FileInfo, error) {
+	return f.iofs.Stat(f.name)
+}
+
+func (f *ioFile) Read(buf []byte) (int, error) {
+	return f.file.Read(buf)
+}
+
+func (f *ioFile) Close() error {
+	return f.file.Close()
+}
+
+// ReadDir reads the directory with the paging of fs.ReadDirFile.
+func (f *ioFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.file.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: FileResultInvalidObject}
+	}
+	infos, err := f.file.Readdir(n)
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	return entries, err
+}
+
+func (f *ioFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.file.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, FileResultInvalidObject
+}
+
+func (f *ioFile) ReadAt(buf []byte, off int64) (int, error) {
+	if r, ok := f.file.(io.ReaderAt); ok {
+		return r.ReadAt(buf, off)
+	}
+	return 0, FileResultInvalidObject
+}
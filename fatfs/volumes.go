@@ -0,0 +1,282 @@
+package fatfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"tinygo.org/x/tinyfs"
+)
+
+var (
+	ErrCrossVolume = errors.New("fatfs: rename across volumes")
+	ErrVolumeExist = errors.New("fatfs: volume name already in use")
+)
+
+// Volumes is a tinyfs.Filesystem combining several FATFS instances under
+// path prefixes, e.g. "/sd/track001.mp3" and "/flash/config.txt". Each FATFS
+// is an independent volume with its own block device, so the instances can
+// also be used directly without Volumes.
+type Volumes struct {
+	names []string
+	fss   []*FATFS
+	cwd   string
+}
+
+var _ tinyfs.Filesystem = (*Volumes)(nil)
+
+func NewVolumes() *Volumes {
+	return &Volumes{}
+}
+
+// Add makes fs accessible under "/name".
+func (v *Volumes) Add(name string, fs *FATFS) error {
+	if name == "" || strings.ContainsRune(name, '/') {
+		return FileResultInvalidName
+	}
+	if v.Volume(name) != nil {
+		return ErrVolumeExist
+	}
+	v.names = append(v.names, name)
+	v.fss = append(v.fss, fs)
+	return nil
+}
+
+// Detach removes the volume of name. It does not unmount the volume.
+func (v *Volumes) Detach(name string) {
+	for i := range v.names {
+		if v.names[i] == name {
+			v.names = append(v.names[:i], v.names[i+1:]...)
+			v.fss = append(v.fss[:i], v.fss[i+1:]...)
+			return
+		}
+	}
+}
+
+// Volume returns the FATFS added as name, nil if there is none.
+func (v *Volumes) Volume(name string) *FATFS {
+	for i := range v.names {
+		if v.names[i] == name {
+			return v.fss[i]
+		}
+	}
+	return nil
+}
+
+// Names returns the names of the volumes in the order they were added.
+func (v *Volumes) Names() []string {
+	return append([]string(nil), v.names...)
+}
+
+// Resolve returns the volume of path and the path within the volume.
+// A relative path starts from the current directory.
+func (v *Volumes) Resolve(path string) (*FATFS, string, error) {
+	path = strings.TrimPrefix(resolve(v.cwd, path), "/")
+	name, rest := path, "/"
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		name, rest = path[:i], path[i:]
+	}
+	fs := v.Volume(name)
+	if fs == nil {
+		return nil, "", FileResultInvalidDrive
+	}
+	return fs, rest, nil
+}
+
+// Format formats all volumes.
+func (v *Volumes) Format() error {
+	for _, fs := range v.fss {
+		if err := fs.Format(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Mount mounts all volumes. It stops at the first volume failing to mount.
+func (v *Volumes) Mount() error {
+	for _, fs := range v.fss {
+		if err := fs.Mount(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unmount unmounts all volumes.
+func (v *Volumes) Unmount() error {
+	var err error
+	for _, fs := range v.fss {
+		if e := fs.Unmount(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (v *Volumes) Mkdir(path string, mode os.FileMode) error {
+	fs, path, err := v.Resolve(path)
+	if err != nil {
+		return err
+	}
+	return fs.Mkdir(path, mode)
+}
+
+// Chdir changes the current directory, which may be on any volume or the
+// root directory listing the volumes. The current directory of the volume
+// is changed as well.
+func (v *Volumes) Chdir(dir string) error {
+	dir = resolve(v.cwd, dir)
+	if dir == "/" {
+		v.cwd = dir
+		return nil
+	}
+	fs, rest, err := v.Resolve(dir)
+	if err != nil {
+		return err
+	}
+	if err := fs.Chdir(rest); err != nil {
+		return err
+	}
+	wd, err := fs.Getwd()
+	if err != nil {
+		return err
+	}
+	name := strings.SplitN(dir[1:], "/", 2)[0]
+	v.cwd = strings.TrimSuffix("/"+name+wd, "/")
+	return nil
+}
+
+// Getwd returns the absolute path of the current directory.
+func (v *Volumes) Getwd() (string, error) {
+	if v.cwd == "" {
+		return "/", nil
+	}
+	return v.cwd, nil
+}
+
+func (v *Volumes) Open(path string) (tinyfs.File, error) {
+	return v.OpenFile(path, os.O_RDONLY)
+}
+
+// OpenFile opens path on its volume. Opening "/" gives a directory listing
+// the volumes.
+func (v *Volumes) OpenFile(path string, flags int) (tinyfs.File, error) {
+	if resolve(v.cwd, path) == "/" {
+		return &volumesRoot{v: v}, nil
+	}
+	fs, rest, err := v.Resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.OpenFile(rest, flags)
+	if err != nil {
+		return nil, err
+	}
+	file := f.(*File)
+	file.name = path
+	return file, nil
+}
+
+func (v *Volumes) Remove(path string) error {
+	fs, path, err := v.Resolve(path)
+	if err != nil {
+		return err
+	}
+	return fs.Remove(path)
+}
+
+// Rename renames a file within a volume. Moving a file to another volume
+// returns ErrCrossVolume, use CopyFile and Remove instead.
+func (v *Volumes) Rename(oldPath string, newPath string) error {
+	fs1, path1, err := v.Resolve(oldPath)
+	if err != nil {
+		return err
+	}
+	fs2, path2, err := v.Resolve(newPath)
+	if err != nil {
+		return err
+	}
+	if fs1 != fs2 {
+		return ErrCrossVolume
+	}
+	return fs1.Rename(path1, path2)
+}
+
+func (v *Volumes) Stat(path string) (os.FileInfo, error) {
+	path = resolve(v.cwd, path)
+	if path == "/" {
+		return &Info{name: "/", attr: AttrDirectory}, nil
+	}
+	fs, rest, err := v.Resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	if rest == "/" {
+		// FatFs cannot stat the root directory
+		return &Info{name: strings.Trim(path, "/"), attr: AttrDirectory}, nil
+	}
+	return fs.Stat(rest)
+}
+
+// volumesRoot is the directory "/" of Volumes.
+type volumesRoot struct {
+	v    *Volumes
+	next int
+}
+
+func (r *volumesRoot) Read(buf []byte) (int, error) {
+	return 0, FileResultInvalidObject
+}
+
+func (r *volumesRoot) Write(buf []byte) (int, error) {
+	return 0, FileResultInvalidObject
+}
+
+func (r *volumesRoot) Close() error {
+	return nil
+}
+
+func (r *volumesRoot) IsDir() bool {
+	return true
+}
+
+// Readdir lists the volumes with the same paging as File.Readdir.
+func (r *volumesRoot) Readdir(n int) (infos []os.FileInfo, err error) {
+	for ; r.next < len(r.v.names) && (n <= 0 || len(infos) < n); r.next++ {
+		infos = append(infos, &Info{name: r.v.names[r.next], attr: AttrDirectory})
+	}
+	if n > 0 && len(infos) == 0 {
+		return nil, io.EOF
+	}
+	return infos, nil
+}
+
+// Rewind restarts listing the volumes.
+func (r *volumesRoot) Rewind() error {
+	r.next = 0
+	return nil
+}
+
+// CopyFile copies the file srcPath of src to dstPath of dst, which may be
+// different volumes. dstPath is created or truncated.
+func CopyFile(dst tinyfs.Filesystem, dstPath string, src tinyfs.Filesystem, srcPath string) (int64, error) {
+	in, err := src.Open(srcPath)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	if in.IsDir() {
+		return 0, FileResultInvalidObject
+	}
+	out, err := dst.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.CopyBuffer(out, in, make([]byte, SectorSize))
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	return n, err
+}
@@ -0,0 +1,478 @@
+package fsck
+
+import (
+	"encoding/binary"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	_DIR_Name      = 0
+	_DIR_Attr      = 11
+	_DIR_NTres     = 12
+	_DIR_FstClusHI = 20
+	_DIR_FstClusLO = 26
+	_DIR_FileSize  = 28
+	_LDIR_Ord      = 0
+	_LDIR_Type     = 12
+	_LDIR_Chksum   = 13
+	_SZDIRE        = 32
+
+	_AM_VOL  = 0x08
+	_AM_DIR  = 0x10
+	_AM_LFN  = 0x0F
+	_AM_MASK = 0x3F
+	_NS_BODY = 0x08 // lower case name body in _DIR_NTres
+	_NS_EXT  = 0x10 // lower case extension in _DIR_NTres
+	_DDEM    = 0xE5 // deleted entry mark
+	_LLEF    = 0x40 // last long entry flag
+	_MAX_LFN = 20   // LFN entries of a name of 255 characters
+)
+
+// offsets of the 13 characters of an LFN entry
+var lfnOffsets = [13]int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
+
+// entryPos is the location of a directory entry.
+type entryPos struct {
+	sect uint32
+	off  int
+}
+
+// dirState is the state of checking one directory. The entries are read a
+// sector at a time, which is written back when it was repaired.
+type dirState struct {
+	v      *volume
+	path   string
+	clus   uint32 // first cluster, 0 for the FAT12/16 root directory
+	parent uint32 // first cluster of the parent, 0 for the root directory
+	root   bool
+	index  int // index of the next entry
+	done   bool
+
+	sect  uint32
+	buf   []byte
+	dirty bool
+
+	// LFN entries preceding the next short name entry
+	lfnPos  []entryPos
+	lfnOrd  byte // sequence number of the next LFN entry, 0 when complete
+	lfnSum  byte
+	lfnName []uint16
+}
+
+// checkRoot checks the directory tree from the root directory.
+func (v *volume) checkRoot() {
+	if v.typ != FAT32 {
+		v.checkDir("/", 0, 0, 0, true)
+		return
+	}
+	n, _ := v.chain("/", v.rootClus, 0)
+	if n == 0 {
+		if v.err == nil {
+			v.err = ErrCorrupt
+		}
+		return
+	}
+	v.checkDir("/", v.rootClus, n, 0, true)
+}
+
+// checkDir checks the directory at path of n clusters from clus.
+func (v *volume) checkDir(path string, clus, n, parent uint32, root bool) {
+	d := &dirState{v: v, path: path, clus: clus, parent: parent, root: root, buf: make([]byte, SectorSize)}
+	if clus == 0 {
+		for i := uint32(0); i < v.rootSize && !d.done && v.err == nil; i++ {
+			d.visit(v.rootSect + i)
+		}
+	} else {
+		c := clus
+		for i := uint32(0); i < n && !d.done && v.err == nil; i++ {
+			for s := uint32(0); s < v.spc && !d.done && v.err == nil; s++ {
+				d.visit(v.clusterSect(c) + s)
+			}
+			c = v.fat.get(c)
+		}
+	}
+	d.dropLFN(path, "LFN entries at the end of the directory")
+}
+
+// visit checks the entries in sector sect.
+func (d *dirState) visit(sect uint32) {
+	if !d.v.read(sect, d.buf) {
+		return
+	}
+	d.sect = sect
+	d.dirty = false
+	for off := 0; off < SectorSize && !d.done && d.v.err == nil; off += _SZDIRE {
+		d.entry(off)
+	}
+	if d.dirty {
+		d.v.write(sect, d.buf)
+	}
+}
+
+// remove marks the entry at pos deleted.
+func (d *dirState) remove(pos entryPos) {
+	if pos.sect == d.sect {
+		d.buf[pos.off+_DIR_Name] = _DDEM
+		d.dirty = true
+		return
+	}
+	buf := make([]byte, SectorSize)
+	if d.v.read(pos.sect, buf) {
+		buf[pos.off+_DIR_Name] = _DDEM
+		d.v.write(pos.sect, buf)
+	}
+}
+
+// dropLFN reports the pending LFN entries as orphaned and deletes them.
+func (d *dirState) dropLFN(path, detail string) {
+	if len(d.lfnPos) == 0 {
+		return
+	}
+	if d.v.problem(BadLFN, path, 0, "%s (%d entries)", detail, len(d.lfnPos)) {
+		d.removeLFN()
+	}
+	d.lfnPos = nil
+}
+
+func (d *dirState) removeLFN() {
+	for _, pos := range d.lfnPos {
+		d.remove(pos)
+	}
+	d.lfnPos = nil
+}
+
+func (d *dirState) entry(off int) {
+	e := d.buf[off : off+_SZDIRE]
+	pos := entryPos{d.sect, off}
+	index := d.index
+	d.index++
+	switch {
+	case e[_DIR_Name] == 0:
+		d.done = true
+		return
+	case e[_DIR_Name] == _DDEM:
+		d.dropLFN(d.path, "orphaned LFN entries")
+		return
+	case e[_DIR_Attr]&_AM_MASK == _AM_LFN:
+		d.lfnEntry(e, pos)
+		return
+	}
+
+	name := shortName(e)
+	path := join(d.path, caseName(e, name))
+	remove := func() {
+		d.removeLFN()
+		d.remove(pos)
+	}
+	attr := e[_DIR_Attr]
+	if attr&_AM_VOL != 0 {
+		d.dropLFN(path, "orphaned LFN entries")
+		if !d.root && d.v.problem(BadEntry, path, 0, "volume label in a subdirectory") {
+			d.remove(pos)
+		}
+		return
+	}
+	if !validName(e) {
+		if d.v.problem(BadEntry, path, 0, "invalid short name") {
+			remove()
+		}
+		d.lfnPos = nil
+		return
+	}
+	if len(d.lfnPos) != 0 {
+		if d.lfnOrd != 0 {
+			d.dropLFN(path, "incomplete long name")
+		} else if d.lfnSum != checksum(e) {
+			d.dropLFN(path, "LFN checksum mismatch")
+		} else {
+			path = join(d.path, longName(d.lfnName))
+			d.lfnPos = nil
+		}
+	}
+	if name == "." || name == ".." {
+		d.dotEntry(e, pos, name, index)
+		return
+	}
+	if attr&_AM_DIR != 0 {
+		d.subdir(e, path, remove)
+	} else {
+		d.file(e, path)
+	}
+}
+
+// lfnEntry collects an LFN entry, which precede the short name entry in the
+// reverse order of their sequence numbers.
+func (d *dirState) lfnEntry(e []byte, pos entryPos) {
+	ord := e[_LDIR_Ord]
+	if ord&_LLEF != 0 {
+		d.dropLFN(d.path, "orphaned LFN entries")
+		seq := ord &^ _LLEF
+		d.lfnPos = append(d.lfnPos, pos)
+		if seq == 0 || seq > _MAX_LFN || e[_LDIR_Type] != 0 {
+			d.dropLFN(d.path, "invalid LFN entry")
+			return
+		}
+		d.lfnOrd = seq
+		d.lfnSum = e[_LDIR_Chksum]
+		d.lfnName = make([]uint16, int(seq)*len(lfnOffsets))
+	}
+	if len(d.lfnPos) == 0 || d.lfnOrd == 0 || ord&^_LLEF != d.lfnOrd || e[_LDIR_Chksum] != d.lfnSum || e[_LDIR_Type] != 0 {
+		detail := "LFN entries out of sequence"
+		if len(d.lfnPos) != 0 && e[_LDIR_Chksum] != d.lfnSum {
+			detail = "LFN checksum mismatch"
+		}
+		if ord&_LLEF == 0 {
+			d.lfnPos = append(d.lfnPos, pos)
+		}
+		d.dropLFN(d.path, detail)
+		return
+	}
+	if ord&_LLEF == 0 {
+		d.lfnPos = append(d.lfnPos, pos)
+	}
+	d.lfnOrd--
+	for i, o := range lfnOffsets {
+		d.lfnName[int(d.lfnOrd)*len(lfnOffsets)+i] = binary.LittleEndian.Uint16(e[o:])
+	}
+}
+
+// dotEntry checks "." and "..", the first two entries of a subdirectory.
+func (d *dirState) dotEntry(e []byte, pos entryPos, name string, index int) {
+	path := join(d.path, name)
+	want := d.clus
+	if name == ".." {
+		want = d.parent
+	}
+	if d.root || name == "." && index != 0 || name == ".." && index != 1 {
+		if d.v.problem(BadEntry, path, 0, "misplaced dot entry") {
+			d.remove(pos)
+		}
+		return
+	}
+	if c := d.v.firstCluster(e); c != want {
+		if d.v.problem(BadEntry, path, c, "links to cluster %d instead of %d", c, want) {
+			d.v.setFirstCluster(e, want)
+			d.dirty = true
+		}
+	}
+}
+
+func (d *dirState) subdir(e []byte, path string, remove func()) {
+	v := d.v
+	start := v.firstCluster(e)
+	if start == 0 {
+		if v.problem(BadEntry, path, 0, "directory without cluster") {
+			remove()
+		}
+		return
+	}
+	if size := binary.LittleEndian.Uint32(e[_DIR_FileSize:]); size != 0 {
+		if v.problem(BadEntry, path, start, "directory with size %d", size) {
+			binary.LittleEndian.PutUint32(e[_DIR_FileSize:], 0)
+			d.dirty = true
+		}
+	}
+	n, _ := v.chain(path, start, 0)
+	if n == 0 {
+		if v.opts.Repair {
+			remove()
+		}
+		return
+	}
+	v.report.Dirs++
+	parent := d.clus
+	if d.root {
+		parent = 0
+	}
+	v.checkDir(path, start, n, parent, false)
+}
+
+func (d *dirState) file(e []byte, path string) {
+	v := d.v
+	start := v.firstCluster(e)
+	size := binary.LittleEndian.Uint32(e[_DIR_FileSize:])
+	csize := uint64(v.spc) * SectorSize
+	setSize := func(n uint32) {
+		binary.LittleEndian.PutUint32(e[_DIR_FileSize:], n)
+		d.dirty = true
+	}
+	v.report.Files++
+	switch {
+	case start == 0 && size == 0:
+	case start == 0:
+		if v.problem(SizeMismatch, path, 0, "size %d without clusters", size) {
+			setSize(0)
+		}
+	case size == 0:
+		// the clusters are freed as lost clusters
+		if v.problem(SizeMismatch, path, start, "empty file with clusters") {
+			v.setFirstCluster(e, 0)
+			d.dirty = true
+		}
+	default:
+		need := uint32((uint64(size) + csize - 1) / csize)
+		n, ok := v.chain(path, start, need)
+		switch {
+		case n == 0:
+			if v.opts.Repair {
+				v.setFirstCluster(e, 0)
+				setSize(0)
+			}
+		case n < need:
+			// a broken chain is repaired by truncating the file
+			if ok && !v.problem(SizeMismatch, path, start, "size %d exceeds the chain of %d clusters", size, n) {
+				break
+			}
+			if v.opts.Repair {
+				setSize(uint32(uint64(n) * csize))
+			}
+		}
+	}
+}
+
+// chain follows the chain of path from start, marking the clusters in use,
+// up to limit clusters (0: no limit). It returns the number of clusters in
+// the chain and whether it ended without a broken link. On repair, the chain
+// is terminated before a broken link or a cross-linked cluster, and after
+// limit clusters.
+func (v *volume) chain(path string, start, limit uint32) (uint32, bool) {
+	var n, prev uint32
+	c := start
+	for v.err == nil {
+		if c < 2 || c > v.maxClus {
+			// links are checked below, so this is the first cluster
+			v.problem(BadChain, path, c, "invalid first cluster %d", c)
+			return 0, false
+		}
+		if v.isUsed(c) {
+			if v.problem(CrossLinked, path, c, "cluster %d is already in a chain", c) && prev != 0 {
+				v.fat.end(prev)
+			}
+			return n, false
+		}
+		v.setUsed(c)
+		n++
+		next := v.fat.get(c)
+		if next >= v.fat.eoc {
+			return n, true
+		}
+		if limit != 0 && n == limit {
+			// the clusters after are freed as lost clusters
+			if v.problem(SizeMismatch, path, c, "chain longer than the file size") {
+				v.fat.end(c)
+			}
+			return n, true
+		}
+		if next < 2 || next > v.maxClus {
+			what := "out of range cluster"
+			switch next {
+			case 0:
+				what = "free cluster"
+			case v.fat.bad:
+				what = "bad cluster"
+			}
+			if v.problem(BadChain, path, c, "cluster %d links to %s %d", c, what, next) {
+				v.fat.end(c)
+			}
+			return n, false
+		}
+		prev, c = c, next
+	}
+	return n, false
+}
+
+func (v *volume) firstCluster(e []byte) uint32 {
+	c := uint32(binary.LittleEndian.Uint16(e[_DIR_FstClusLO:]))
+	if v.typ == FAT32 {
+		c |= uint32(binary.LittleEndian.Uint16(e[_DIR_FstClusHI:])) << 16
+	}
+	return c
+}
+
+func (v *volume) setFirstCluster(e []byte, c uint32) {
+	binary.LittleEndian.PutUint16(e[_DIR_FstClusLO:], uint16(c))
+	if v.typ == FAT32 {
+		binary.LittleEndian.PutUint16(e[_DIR_FstClusHI:], uint16(c>>16))
+	}
+}
+
+// checksum returns the checksum of the short name stored in LFN entries.
+func checksum(e []byte) byte {
+	var sum byte
+	for _, c := range e[_DIR_Name : _DIR_Name+11] {
+		sum = (sum>>1 | sum<<7) + c
+	}
+	return sum
+}
+
+// validName reports whether the short name of e has valid characters.
+func validName(e []byte) bool {
+	if string(e[_DIR_Name:_DIR_Name+11]) == ".          " || string(e[_DIR_Name:_DIR_Name+11]) == "..         " {
+		return true
+	}
+	if e[_DIR_Name] == ' ' {
+		return false
+	}
+	for i, c := range e[_DIR_Name : _DIR_Name+11] {
+		if i == 0 && c == 0x05 {
+			// 0xE5 as the first character
+			continue
+		}
+		if c < 0x20 || strings.IndexByte(`"*+,./:;<=>?[\]|`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// shortName returns the short name of e as "NAME.EXT".
+func shortName(e []byte) string {
+	var b []byte
+	for i, c := range e[_DIR_Name : _DIR_Name+8] {
+		if i == 0 && c == 0x05 {
+			c = _DDEM
+		}
+		b = append(b, c)
+	}
+	name := strings.TrimRight(string(b), " ")
+	if ext := strings.TrimRight(string(e[_DIR_Name+8:_DIR_Name+11]), " "); ext != "" {
+		name += "." + ext
+	}
+	return name
+}
+
+// caseName returns name in the case of the NT flags, which Windows and
+// FatFs set instead of LFN entries for names such as "album" or "Track.mp3".
+func caseName(e []byte, name string) string {
+	flags := e[_DIR_NTres]
+	body, ext := name, ""
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		body, ext = name[:i], name[i:]
+	}
+	if flags&_NS_BODY != 0 {
+		body = strings.ToLower(body)
+	}
+	if flags&_NS_EXT != 0 {
+		ext = strings.ToLower(ext)
+	}
+	return body + ext
+}
+
+// longName decodes the UTF-16 name of LFN entries, terminated by 0.
+func longName(name []uint16) string {
+	for i, c := range name {
+		if c == 0 {
+			name = name[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(name))
+}
+
+func join(dir, name string) string {
+	if dir == "/" {
+		return "/" + name
+	}
+	return dir + "/" + name
+}
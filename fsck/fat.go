@@ -0,0 +1,130 @@
+package fsck
+
+import "encoding/binary"
+
+// fatTable reads and writes FAT entries through a cache of one sector of the
+// first FAT. Written sectors go to every FAT copy when the cache moves on.
+type fatTable struct {
+	v     *volume
+	bad   uint32 // bad cluster mark
+	eoc   uint32 // end of chain marks are from eoc
+	sect  uint32 // sector cached in buf (relative to the FAT)
+	valid bool
+	dirty bool
+	buf   [SectorSize]byte
+}
+
+func (f *fatTable) init(v *volume) {
+	*f = fatTable{v: v}
+	switch v.typ {
+	case FAT12:
+		f.bad, f.eoc = 0xFF7, 0xFF8
+	case FAT16:
+		f.bad, f.eoc = 0xFFF7, 0xFFF8
+	default:
+		f.bad, f.eoc = 0x0FFFFFF7, 0x0FFFFFF8
+	}
+}
+
+// load caches the FAT sector sect, flushing the previous one.
+func (f *fatTable) load(sect uint32) bool {
+	if f.valid && f.sect == sect {
+		return true
+	}
+	if !f.flush() {
+		return false
+	}
+	f.valid = false
+	if !f.v.read(f.v.fatStart+sect, f.buf[:]) {
+		return false
+	}
+	f.sect = sect
+	f.valid = true
+	return true
+}
+
+// flush writes the cached sector to the FAT copies if it was changed.
+func (f *fatTable) flush() bool {
+	if !f.dirty {
+		return true
+	}
+	f.dirty = false
+	for i := uint32(0); i < f.v.nFATs; i++ {
+		if !f.v.write(f.v.fatStart+i*f.v.fatSize+f.sect, f.buf[:]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fatTable) byteAt(off uint32) byte {
+	if !f.load(off / SectorSize) {
+		return 0
+	}
+	return f.buf[off%SectorSize]
+}
+
+func (f *fatTable) setByte(off uint32, b byte) {
+	if !f.load(off / SectorSize) {
+		return
+	}
+	f.buf[off%SectorSize] = b
+	f.dirty = true
+}
+
+// get returns the FAT entry of cluster c, 0 after an I/O error.
+func (f *fatTable) get(c uint32) uint32 {
+	switch f.v.typ {
+	case FAT12:
+		off := c + c/2
+		w := uint32(f.byteAt(off)) | uint32(f.byteAt(off+1))<<8
+		if c&1 != 0 {
+			return w >> 4
+		}
+		return w & 0xFFF
+	case FAT16:
+		if !f.load(c * 2 / SectorSize) {
+			return 0
+		}
+		return uint32(binary.LittleEndian.Uint16(f.buf[c*2%SectorSize:]))
+	default:
+		if !f.load(c * 4 / SectorSize) {
+			return 0
+		}
+		return binary.LittleEndian.Uint32(f.buf[c*4%SectorSize:]) & 0x0FFFFFFF
+	}
+}
+
+// set changes the FAT entry of cluster c to val.
+func (f *fatTable) set(c, val uint32) {
+	switch f.v.typ {
+	case FAT12:
+		off := c + c/2
+		if c&1 != 0 {
+			f.setByte(off, f.byteAt(off)&0x0F|byte(val<<4))
+			f.setByte(off+1, byte(val>>4))
+		} else {
+			f.setByte(off, byte(val))
+			f.setByte(off+1, f.byteAt(off+1)&0xF0|byte(val>>8)&0x0F)
+		}
+	case FAT16:
+		if !f.load(c * 2 / SectorSize) {
+			return
+		}
+		binary.LittleEndian.PutUint16(f.buf[c*2%SectorSize:], uint16(val))
+		f.dirty = true
+	default:
+		if !f.load(c * 4 / SectorSize) {
+			return
+		}
+		p := f.buf[c*4%SectorSize:]
+		// the upper 4 bits are reserved
+		binary.LittleEndian.PutUint32(p, binary.LittleEndian.Uint32(p)&0xF0000000|val&0x0FFFFFFF)
+		f.dirty = true
+	}
+}
+
+// end marks the end of chain at cluster c.
+func (f *fatTable) end(c uint32) {
+	f.set(c, f.eoc|7)
+}
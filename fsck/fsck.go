@@ -0,0 +1,523 @@
+// Package fsck checks and repairs FAT12, FAT16 and FAT32 volumes of a
+// tinyfs.BlockDevice without mounting them: the boot sector, the FAT copies,
+// the cluster chains and the directory entries including LFN checksums.
+// Memory use is a bitmap of one bit per cluster plus a sector buffer per
+// directory level, so that SD cards can be checked on the device.
+//
+// The volume must not be mounted while it is checked, as FatFs keeps FAT
+// and directory sectors in its window.
+package fsck
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/elehobica/pico_tinygo_vs1053/partition"
+	"tinygo.org/x/tinyfs"
+)
+
+const SectorSize = 512
+
+var (
+	ErrNoFilesystem = errors.New("fsck: no FAT volume")
+	ErrUnsupported  = errors.New("fsck: exFAT is not supported")
+	ErrCorrupt      = errors.New("fsck: root directory is not readable")
+)
+
+// Type is the FAT type of the volume.
+type Type int
+
+const (
+	FAT12 Type = 12
+	FAT16 Type = 16
+	FAT32 Type = 32
+)
+
+func (t Type) String() string {
+	return fmt.Sprintf("FAT%d", int(t))
+}
+
+// Kind is the kind of a Problem.
+type Kind int
+
+const (
+	BootSector   Kind = iota // inconsistent boot sector, backup boot sector or FSInfo
+	FATMismatch              // FAT copies differ
+	BadChain                 // chain links to a free, bad or out of range cluster
+	CrossLinked              // cluster in more than one chain, or a loop
+	SizeMismatch             // file size does not match the chain length
+	BadEntry                 // invalid directory entry
+	BadLFN                   // orphaned LFN entries or checksum mismatch
+	LostClusters             // allocated clusters not in any chain
+)
+
+func (k Kind) String() string {
+	switch k {
+	case BootSector:
+		return "boot sector"
+	case FATMismatch:
+		return "FAT mismatch"
+	case BadChain:
+		return "bad chain"
+	case CrossLinked:
+		return "cross-linked"
+	case SizeMismatch:
+		return "size mismatch"
+	case BadEntry:
+		return "bad entry"
+	case BadLFN:
+		return "bad LFN"
+	case LostClusters:
+		return "lost clusters"
+	default:
+		return "unknown"
+	}
+}
+
+// Problem is an inconsistency found on the volume.
+type Problem struct {
+	Kind     Kind
+	Path     string // file or directory concerned, empty for the volume
+	Cluster  uint32 // cluster concerned, 0 if none
+	Detail   string
+	Repaired bool // the repair has been written to the device
+}
+
+func (p *Problem) String() string {
+	s := p.Kind.String() + ": " + p.Detail
+	if p.Path != "" {
+		s = p.Path + ": " + s
+	}
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// Report is the result of Check.
+type Report struct {
+	Type         Type
+	ClusterSize  int64  // in bytes
+	Clusters     uint32 // number of data clusters
+	FreeClusters uint32 // after the repair, if any
+	LostClusters uint32
+	Files        int
+	Dirs         int // not counting the root directory
+	Problems     []Problem
+	Err          error // write error which stopped the repair
+}
+
+// OK reports whether the volume is consistent, or all the problems found
+// have been repaired.
+func (r *Report) OK() bool {
+	for i := range r.Problems {
+		if !r.Problems[i].Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+// Options are the options of Check.
+type Options struct {
+	// Repair fixes the problems found: broken and cross-linked chains are
+	// truncated, lost clusters are freed, invalid entries and orphaned LFN
+	// entries are deleted, and the other FAT copies, the backup boot sector
+	// and FSInfo are rewritten from the primary ones
+	Repair bool
+	// Log is called for each problem as it is found, before it is repaired
+	// (optional)
+	Log func(p *Problem)
+}
+
+// Check checks the FAT volume on dev, which is either the volume itself or a
+// device with a partition table, then the first partition holding a FAT
+// volume is checked. The returned error tells that the check could not be
+// done, the problems found are in the Report. After a write error on repair,
+// the Report is returned as well with the error in Err, and none of the
+// problems is marked repaired.
+func Check(dev tinyfs.BlockDevice, opts *Options) (*Report, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	v := &volume{dev: dev, opts: opts, report: &Report{}}
+	if err := v.open(); err != nil {
+		return nil, err
+	}
+	v.check()
+	if v.err == nil && opts.Repair {
+		if syncer, ok := v.dev.(tinyfs.Syncer); ok {
+			v.err = syncer.Sync()
+			v.report.Err = v.err
+		}
+	}
+	if v.report.Err != nil {
+		return v.report, v.err
+	}
+	if v.err != nil {
+		return nil, v.err
+	}
+	// the repairs are on the device now
+	for i := range v.report.Problems {
+		v.report.Problems[i].Repaired = opts.Repair
+	}
+	return v.report, nil
+}
+
+// volume is the state of a check.
+type volume struct {
+	dev    tinyfs.BlockDevice
+	opts   *Options
+	report *Report
+	err    error // first I/O error
+
+	typ      Type
+	spc      uint32 // sectors per cluster
+	nFATs    uint32
+	fatStart uint32 // first sector of the first FAT
+	fatSize  uint32 // in sectors
+	rootSect uint32 // first sector of the FAT12/16 root directory
+	rootSize uint32 // in sectors
+	rootClus uint32 // FAT32 root directory
+	dataSect uint32 // first sector of cluster 2
+	maxClus  uint32 // last cluster number
+	fsInfo   uint32 // FAT32 FSInfo sector, 0 if none
+	backup   uint32 // FAT32 backup boot sector, 0 if none
+
+	fat  fatTable
+	used []byte // bitmap of the clusters in chains
+}
+
+// problem records a problem and tells whether to repair it.
+func (v *volume) problem(kind Kind, path string, cluster uint32, format string, args ...interface{}) bool {
+	p := Problem{
+		Kind:    kind,
+		Path:    path,
+		Cluster: cluster,
+		Detail:  fmt.Sprintf(format, args...),
+	}
+	v.report.Problems = append(v.report.Problems, p)
+	if v.opts.Log != nil {
+		v.opts.Log(&p)
+	}
+	return v.opts.Repair
+}
+
+func (v *volume) read(sect uint32, buf []byte) bool {
+	if v.err != nil {
+		return false
+	}
+	_, v.err = v.dev.ReadAt(buf, int64(sect)*SectorSize)
+	return v.err == nil
+}
+
+func (v *volume) write(sect uint32, buf []byte) bool {
+	if v.err != nil {
+		return false
+	}
+	_, v.err = v.dev.WriteAt(buf, int64(sect)*SectorSize)
+	v.report.Err = v.err
+	return v.err == nil
+}
+
+const (
+	_BS_JmpBoot      = 0
+	_BS_FilSysType   = 54
+	_BPB_BytsPerSec  = 11
+	_BPB_SecPerClus  = 13
+	_BPB_RsvdSecCnt  = 14
+	_BPB_NumFATs     = 16
+	_BPB_RootEntCnt  = 17
+	_BPB_TotSec16    = 19
+	_BPB_FATSz16     = 22
+	_BPB_TotSec32    = 32
+	_BPB_FATSz32     = 36
+	_BPB_FSVer32     = 42
+	_BPB_RootClus32  = 44
+	_BPB_FSInfo32    = 48
+	_BPB_BkBootSec32 = 50
+	_BS_55AA         = 510
+
+	_FSI_LeadSig    = 0
+	_FSI_StrucSig   = 484
+	_FSI_Free_Count = 488
+	_FSI_Nxt_Free   = 492
+	_FSI_TrailSig   = 508
+
+	_MAX_FAT12 = 0xFF5
+	_MAX_FAT16 = 0xFFF5
+)
+
+// open locates the volume on v.dev and reads its boot sector.
+func (v *volume) open() error {
+	buf := make([]byte, SectorSize)
+	if !v.read(0, buf) {
+		return v.err
+	}
+	if string(buf[3:11]) == "EXFAT   " {
+		return ErrUnsupported
+	}
+	err := v.boot(buf)
+	if err != ErrNoFilesystem {
+		return err
+	}
+	// the first partition holding a FAT volume, as FatFs mounts it
+	disk := v.dev
+	table, terr := partition.Read(disk)
+	if terr != nil {
+		return ErrNoFilesystem
+	}
+	for i := range table.Partitions {
+		dev := partition.NewDevice(disk, &table.Partitions[i])
+		if _, err := dev.ReadAt(buf, 0); err != nil {
+			return err
+		}
+		if string(buf[3:11]) == "EXFAT   " {
+			return ErrUnsupported
+		}
+		v.dev = dev
+		if err := v.boot(buf); err != ErrNoFilesystem {
+			return err
+		}
+	}
+	return ErrNoFilesystem
+}
+
+// boot reads the boot sector in buf, falling back on the FAT32 backup boot
+// sector. ErrNoFilesystem tells that buf is not a FAT boot sector.
+func (v *volume) boot(buf []byte) error {
+	if buf[_BS_JmpBoot] != 0xEB && buf[_BS_JmpBoot] != 0xE9 && buf[_BS_JmpBoot] != 0xE8 {
+		return ErrNoFilesystem
+	}
+	if !v.parse(buf) {
+		// FatFs writes the backup at sector 6
+		bak := make([]byte, SectorSize)
+		if !v.read(6, bak) {
+			return v.err
+		}
+		if !v.parse(bak) || v.typ != FAT32 || bak[_BS_55AA] != 0x55 || bak[_BS_55AA+1] != 0xAA {
+			return ErrNoFilesystem
+		}
+		if v.problem(BootSector, "", 0, "invalid boot sector, backup boot sector is valid") {
+			v.write(0, bak)
+		}
+		return v.err
+	}
+	if buf[_BS_55AA] != 0x55 || buf[_BS_55AA+1] != 0xAA {
+		if string(buf[_BS_FilSysType:_BS_FilSysType+3]) != "FAT" && string(buf[82:87]) != "FAT32" {
+			return ErrNoFilesystem
+		}
+		if v.problem(BootSector, "", 0, "missing boot signature") {
+			buf[_BS_55AA], buf[_BS_55AA+1] = 0x55, 0xAA
+			v.write(0, buf)
+		}
+	}
+	if v.backup != 0 {
+		bak := make([]byte, SectorSize)
+		if !v.read(v.backup, bak) {
+			return v.err
+		}
+		if string(bak) != string(buf) {
+			if v.problem(BootSector, "", 0, "backup boot sector differs") {
+				v.write(v.backup, buf)
+			}
+		}
+	}
+	return v.err
+}
+
+// parse sets the layout of v by the BPB in buf and reports whether it is
+// valid, by the checks of FatFs.
+func (v *volume) parse(buf []byte) bool {
+	le16 := func(off int) uint32 { return uint32(binary.LittleEndian.Uint16(buf[off:])) }
+	le32 := func(off int) uint32 { return binary.LittleEndian.Uint32(buf[off:]) }
+
+	if le16(_BPB_BytsPerSec) != SectorSize {
+		return false
+	}
+	spc := uint32(buf[_BPB_SecPerClus])
+	if spc == 0 || spc&(spc-1) != 0 {
+		return false
+	}
+	nFATs := uint32(buf[_BPB_NumFATs])
+	rsvd := le16(_BPB_RsvdSecCnt)
+	nRoot := le16(_BPB_RootEntCnt)
+	if nFATs != 1 && nFATs != 2 || rsvd == 0 || nRoot%(SectorSize/32) != 0 {
+		return false
+	}
+	fatSize := le16(_BPB_FATSz16)
+	if fatSize == 0 {
+		fatSize = le32(_BPB_FATSz32)
+	}
+	total := le16(_BPB_TotSec16)
+	if total == 0 {
+		total = le32(_BPB_TotSec32)
+	}
+	rootSize := nRoot * 32 / SectorSize
+	sysSect := uint64(rsvd) + uint64(fatSize)*uint64(nFATs) + uint64(rootSize)
+	if fatSize == 0 || uint64(total) <= sysSect {
+		return false
+	}
+	nClus := (total - uint32(sysSect)) / spc
+	if nClus == 0 {
+		return false
+	}
+	var typ Type
+	var fatBytes uint64
+	switch {
+	case nClus <= _MAX_FAT12:
+		typ, fatBytes = FAT12, (uint64(nClus+2)*3+1)/2
+	case nClus <= _MAX_FAT16:
+		typ, fatBytes = FAT16, uint64(nClus+2)*2
+	default:
+		typ, fatBytes = FAT32, uint64(nClus+2)*4
+		if le16(_BPB_FSVer32) != 0 || nRoot != 0 || le16(_BPB_FATSz16) != 0 {
+			return false
+		}
+	}
+	if uint64(fatSize)*SectorSize < fatBytes {
+		return false
+	}
+
+	*v = volume{dev: v.dev, opts: v.opts, report: v.report, err: v.err}
+	v.typ = typ
+	v.spc = spc
+	v.nFATs = nFATs
+	v.fatStart = rsvd
+	v.fatSize = fatSize
+	v.rootSect = rsvd + fatSize*nFATs
+	v.rootSize = rootSize
+	v.dataSect = uint32(sysSect)
+	v.maxClus = nClus + 1
+	if typ == FAT32 {
+		v.rootClus = le32(_BPB_RootClus32)
+		if fsi := le16(_BPB_FSInfo32); fsi != 0 && fsi < rsvd {
+			v.fsInfo = fsi
+		}
+		if bk := le16(_BPB_BkBootSec32); bk != 0 && bk < rsvd {
+			v.backup = bk
+		}
+	}
+	v.report.Type = typ
+	v.report.ClusterSize = int64(spc) * SectorSize
+	v.report.Clusters = nClus
+	return true
+}
+
+// clusterSect returns the first sector of cluster c.
+func (v *volume) clusterSect(c uint32) uint32 {
+	return v.dataSect + (c-2)*v.spc
+}
+
+func (v *volume) isUsed(c uint32) bool {
+	return v.used[c/8]&(1<<(c%8)) != 0
+}
+
+func (v *volume) setUsed(c uint32) {
+	v.used[c/8] |= 1 << (c % 8)
+}
+
+// check runs the checks after the boot sector.
+func (v *volume) check() {
+	v.fat.init(v)
+	v.used = make([]byte, v.maxClus/8+1)
+	v.compareFATs()
+	v.checkRoot()
+	v.lostClusters()
+	v.fat.flush()
+	v.checkFSInfo()
+}
+
+// compareFATs compares the other FAT copies to the first one, which FatFs
+// reads.
+func (v *volume) compareFATs() {
+	if v.nFATs < 2 {
+		return
+	}
+	buf := make([]byte, SectorSize)
+	cpy := make([]byte, SectorSize)
+	var differ []uint32
+	for i := uint32(0); i < v.fatSize && v.err == nil; i++ {
+		if !v.read(v.fatStart+i, buf) || !v.read(v.fatStart+v.fatSize+i, cpy) {
+			return
+		}
+		if string(buf) != string(cpy) {
+			differ = append(differ, i)
+		}
+	}
+	if len(differ) == 0 {
+		return
+	}
+	if v.problem(FATMismatch, "", 0, "FAT copies differ in %d sectors", len(differ)) {
+		for _, i := range differ {
+			if !v.read(v.fatStart+i, buf) || !v.write(v.fatStart+v.fatSize+i, buf) {
+				return
+			}
+		}
+	}
+}
+
+// lostClusters frees the clusters allocated in the FAT but not found in any
+// chain, and counts the free clusters.
+func (v *volume) lostClusters() {
+	var lost, free uint32
+	for c := uint32(2); c <= v.maxClus && v.err == nil; c++ {
+		e := v.fat.get(c)
+		switch {
+		case e == 0:
+			free++
+		case e == v.fat.bad || v.isUsed(c):
+		default:
+			lost++
+		}
+	}
+	if v.err != nil {
+		return
+	}
+	v.report.LostClusters = lost
+	if lost != 0 && v.problem(LostClusters, "", 0, "%d clusters allocated but not in any chain", lost) {
+		for c := uint32(2); c <= v.maxClus && v.err == nil; c++ {
+			if e := v.fat.get(c); e != 0 && e != v.fat.bad && !v.isUsed(c) {
+				v.fat.set(c, 0)
+			}
+		}
+		free += lost
+	}
+	v.report.FreeClusters = free
+}
+
+// checkFSInfo checks the signatures and the free cluster count of FSInfo.
+// The next free cluster is a hint which FatFs validates by itself.
+func (v *volume) checkFSInfo() {
+	if v.fsInfo == 0 || v.err != nil {
+		return
+	}
+	buf := make([]byte, SectorSize)
+	if !v.read(v.fsInfo, buf) {
+		return
+	}
+	le32 := binary.LittleEndian.Uint32
+	put32 := binary.LittleEndian.PutUint32
+	free := v.report.FreeClusters
+	if le32(buf[_FSI_LeadSig:]) != 0x41615252 || le32(buf[_FSI_StrucSig:]) != 0x61417272 || le32(buf[_FSI_TrailSig:]) != 0xAA550000 {
+		if v.problem(BootSector, "", 0, "invalid FSInfo sector") {
+			for i := range buf {
+				buf[i] = 0
+			}
+			put32(buf[_FSI_LeadSig:], 0x41615252)
+			put32(buf[_FSI_StrucSig:], 0x61417272)
+			put32(buf[_FSI_Free_Count:], free)
+			put32(buf[_FSI_Nxt_Free:], 0xFFFFFFFF)
+			put32(buf[_FSI_TrailSig:], 0xAA550000)
+			v.write(v.fsInfo, buf)
+		}
+		return
+	}
+	if n := le32(buf[_FSI_Free_Count:]); n != 0xFFFFFFFF && n != free {
+		if v.problem(BootSector, "", 0, "FSInfo free count %d, actually %d", n, free) {
+			put32(buf[_FSI_Free_Count:], free)
+			v.write(v.fsInfo, buf)
+		}
+	}
+}
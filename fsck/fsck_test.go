@@ -0,0 +1,390 @@
+package fsck
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/elehobica/pico_tinygo_vs1053/fatfs"
+	"tinygo.org/x/tinyfs"
+)
+
+const testBlockSize = 4096
+
+// newImage formats a volume of blocks by opts with a few files and
+// directories:
+//
+//	/SHORT.TXT               100 bytes
+//	/a long file name.bin    5000 bytes
+//	/album/track001.mp3      9000 bytes
+func newImage(t *testing.T, blocks int, opts *fatfs.FormatOptions) *tinyfs.MemBlockDevice {
+	t.Helper()
+	dev := tinyfs.NewMemoryDevice(64, testBlockSize, blocks)
+	fs := fatfs.New(dev).Configure(&fatfs.Config{SectorSize: fatfs.SectorSize})
+	check(t, fs.FormatWith(opts))
+	check(t, fs.Mount())
+	writeFile(t, fs, "/SHORT.TXT", 100)
+	writeFile(t, fs, "/a long file name.bin", 5000)
+	check(t, fs.Mkdir("/album", 0777))
+	writeFile(t, fs, "/album/track001.mp3", 9000)
+	check(t, fs.Unmount())
+	return dev
+}
+
+// newFAT12 returns a FAT12 image of 1KiB clusters and two FATs.
+func newFAT12(t *testing.T) *tinyfs.MemBlockDevice {
+	return newImage(t, 256, &fatfs.FormatOptions{Type: fatfs.FormatFAT, ClusterSize: 1024, FATs: 2})
+}
+
+func writeFile(t *testing.T, fs *fatfs.FATFS, path string, size int) {
+	t.Helper()
+	f, err := fs.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+	check(t, err)
+	buf := make([]byte, size)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	_, err = f.Write(buf)
+	check(t, err)
+	check(t, f.Close())
+}
+
+// mount mounts the volume to check that FatFs accepts it.
+func mount(t *testing.T, dev tinyfs.BlockDevice) *fatfs.FATFS {
+	t.Helper()
+	fs := fatfs.New(dev).Configure(&fatfs.Config{SectorSize: fatfs.SectorSize})
+	check(t, fs.Mount())
+	return fs
+}
+
+// openVolume reads the layout of the volume on dev to corrupt it.
+func openVolume(t *testing.T, dev tinyfs.BlockDevice) *volume {
+	t.Helper()
+	v := &volume{dev: dev, opts: &Options{}, report: &Report{}}
+	check(t, v.open())
+	v.fat.init(v)
+	return v
+}
+
+// findEntry returns the location of the short name entry name in the
+// directory of clus (0: root directory).
+func findEntry(t *testing.T, v *volume, clus uint32, name string) entryPos {
+	t.Helper()
+	var sects []uint32
+	if clus == 0 && v.typ != FAT32 {
+		for i := uint32(0); i < v.rootSize; i++ {
+			sects = append(sects, v.rootSect+i)
+		}
+	} else {
+		if clus == 0 {
+			clus = v.rootClus
+		}
+		for c := clus; c >= 2 && c <= v.maxClus; c = v.fat.get(c) {
+			for s := uint32(0); s < v.spc; s++ {
+				sects = append(sects, v.clusterSect(c)+s)
+			}
+		}
+	}
+	buf := make([]byte, SectorSize)
+	for _, s := range sects {
+		check(t, readSector(v, s, buf))
+		for off := 0; off < SectorSize; off += _SZDIRE {
+			e := buf[off : off+_SZDIRE]
+			if e[0] != 0 && e[0] != _DDEM && e[_DIR_Attr]&_AM_MASK != _AM_LFN && shortName(e) == name {
+				return entryPos{s, off}
+			}
+		}
+	}
+	t.Fatalf("%s not found", name)
+	return entryPos{}
+}
+
+func readSector(v *volume, sect uint32, buf []byte) error {
+	v.read(sect, buf)
+	return v.err
+}
+
+// patch changes the sector sect by fn.
+func patch(t *testing.T, v *volume, sect uint32, fn func(buf []byte)) {
+	t.Helper()
+	buf := make([]byte, SectorSize)
+	check(t, readSector(v, sect, buf))
+	fn(buf)
+	v.write(sect, buf)
+	check(t, v.err)
+}
+
+// entry returns a copy of the entry at pos.
+func entry(t *testing.T, v *volume, pos entryPos) []byte {
+	t.Helper()
+	buf := make([]byte, SectorSize)
+	check(t, readSector(v, pos.sect, buf))
+	return buf[pos.off : pos.off+_SZDIRE]
+}
+
+func setFAT(t *testing.T, v *volume, c, val uint32) {
+	t.Helper()
+	v.fat.set(c, val)
+	v.fat.flush()
+	check(t, v.err)
+}
+
+// expectProblem checks the volume, expects a problem of kind, then repairs
+// it and checks that the volume is clean.
+func expectProblem(t *testing.T, dev tinyfs.BlockDevice, kind Kind) *Report {
+	t.Helper()
+	report, err := Check(dev, nil)
+	check(t, err)
+	if report.OK() || !hasProblem(report, kind) {
+		t.Fatalf("expected %v, was actually %v", kind, report.Problems)
+	}
+	repaired, err := Check(dev, &Options{Repair: true})
+	check(t, err)
+	if !repaired.OK() || len(repaired.Problems) != len(report.Problems) {
+		t.Fatalf("expected %v repaired, was actually %v", report.Problems, repaired.Problems)
+	}
+	expectClean(t, dev)
+	return repaired
+}
+
+func expectClean(t *testing.T, dev tinyfs.BlockDevice) *Report {
+	t.Helper()
+	report, err := Check(dev, nil)
+	check(t, err)
+	if len(report.Problems) != 0 {
+		t.Fatalf("expected no problems, was actually %v", report.Problems)
+	}
+	return report
+}
+
+func hasProblem(r *Report, kind Kind) bool {
+	for _, p := range r.Problems {
+		if p.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func expectSize(t *testing.T, fs *fatfs.FATFS, path string, size int64) {
+	t.Helper()
+	info, err := fs.Stat(path)
+	check(t, err)
+	if info.Size() != size {
+		t.Fatalf("expected %d, was actually %d", size, info.Size())
+	}
+}
+
+func TestClean(t *testing.T) {
+	tests := []struct {
+		blocks int
+		opts   *fatfs.FormatOptions
+		typ    Type
+	}{
+		{256, &fatfs.FormatOptions{Type: fatfs.FormatFAT, ClusterSize: 1024, FATs: 2}, FAT12},
+		{2048, &fatfs.FormatOptions{Type: fatfs.FormatFAT, ClusterSize: 512}, FAT16},
+		{10240, &fatfs.FormatOptions{Type: fatfs.FormatFAT32, ClusterSize: 512, FATs: 2}, FAT32},
+		{2048, &fatfs.FormatOptions{Type: fatfs.FormatFAT | fatfs.FormatSFD, ClusterSize: 4096}, FAT12},
+	}
+	for _, tt := range tests {
+		dev := newImage(t, tt.blocks, tt.opts)
+		report := expectClean(t, dev)
+		if report.Type != tt.typ || report.ClusterSize != int64(tt.opts.ClusterSize) {
+			t.Errorf("expected %v of %d, was actually %v of %d", tt.typ, tt.opts.ClusterSize, report.Type, report.ClusterSize)
+		}
+		if report.Files != 3 || report.Dirs != 1 || report.LostClusters != 0 {
+			t.Errorf("expected 3 files and 1 directory, was actually %d and %d", report.Files, report.Dirs)
+		}
+		fs := mount(t, dev)
+		free, err := fs.Free()
+		check(t, err)
+		if int64(report.FreeClusters)*report.ClusterSize != free {
+			t.Errorf("expected %d free bytes, was actually %d", free, int64(report.FreeClusters)*report.ClusterSize)
+		}
+		check(t, fs.Unmount())
+	}
+}
+
+func TestNoFilesystem(t *testing.T) {
+	dev := tinyfs.NewMemoryDevice(64, testBlockSize, 256)
+	if _, err := Check(dev, nil); err != ErrNoFilesystem {
+		t.Fatalf("expected %v, was actually %v", ErrNoFilesystem, err)
+	}
+	dev = newImage(t, 2048, &fatfs.FormatOptions{Type: fatfs.FormatExFAT})
+	if _, err := Check(dev, nil); err != ErrUnsupported {
+		t.Fatalf("expected %v, was actually %v", ErrUnsupported, err)
+	}
+}
+
+func TestBootSector(t *testing.T) {
+	dev := newFAT12(t)
+	v := openVolume(t, dev)
+	patch(t, v, 0, func(buf []byte) { buf[_BS_55AA] = 0 })
+	expectProblem(t, dev, BootSector)
+	mount(t, dev).Unmount()
+
+	// FAT32 restores the boot sector from the backup
+	dev = newImage(t, 10240, &fatfs.FormatOptions{Type: fatfs.FormatFAT32, ClusterSize: 512})
+	v = openVolume(t, dev)
+	patch(t, v, 0, func(buf []byte) { buf[_BPB_BytsPerSec+1] = 0 })
+	expectProblem(t, dev, BootSector)
+	fs := mount(t, dev)
+	expectSize(t, fs, "/album/track001.mp3", 9000)
+	check(t, fs.Unmount())
+
+	// FSInfo
+	patch(t, v, v.fsInfo, func(buf []byte) { binary.LittleEndian.PutUint32(buf[_FSI_Free_Count:], 1) })
+	expectProblem(t, dev, BootSector)
+}
+
+func TestFATMismatch(t *testing.T) {
+	dev := newFAT12(t)
+	v := openVolume(t, dev)
+	patch(t, v, v.fatStart+v.fatSize, func(buf []byte) { buf[10] ^= 0xFF })
+	expectProblem(t, dev, FATMismatch)
+}
+
+func TestLostClusters(t *testing.T) {
+	dev := newFAT12(t)
+	v := openVolume(t, dev)
+	setFAT(t, v, v.maxClus-1, v.maxClus)
+	setFAT(t, v, v.maxClus, 0xFFF)
+	report := expectProblem(t, dev, LostClusters)
+	if report.LostClusters != 2 {
+		t.Fatalf("expected %d, was actually %d", 2, report.LostClusters)
+	}
+	fs := mount(t, dev)
+	free, err := fs.Free()
+	check(t, err)
+	if int64(report.FreeClusters)*report.ClusterSize != free {
+		t.Fatalf("expected %d, was actually %d", free, int64(report.FreeClusters)*report.ClusterSize)
+	}
+	check(t, fs.Unmount())
+}
+
+func TestBadChain(t *testing.T) {
+	dev := newFAT12(t)
+	v := openVolume(t, dev)
+	e := entry(t, v, findEntry(t, v, 0, "ALONGF~1.BIN"))
+	first := v.firstCluster(e)
+	setFAT(t, v, v.fat.get(first), 0)
+	expectProblem(t, dev, BadChain)
+	fs := mount(t, dev)
+	expectSize(t, fs, "/a long file name.bin", 2048)
+	check(t, fs.Unmount())
+}
+
+func TestCrossLinked(t *testing.T) {
+	dev := newFAT12(t)
+	v := openVolume(t, dev)
+	// loop back to the first cluster after 3 clusters
+	album := v.firstCluster(entry(t, v, findEntry(t, v, 0, "ALBUM")))
+	first := v.firstCluster(entry(t, v, findEntry(t, v, album, "TRACK001.MP3")))
+	setFAT(t, v, v.fat.get(v.fat.get(first)), first)
+	expectProblem(t, dev, CrossLinked)
+	fs := mount(t, dev)
+	expectSize(t, fs, "/album/track001.mp3", 3072)
+	check(t, fs.Unmount())
+
+	// two files sharing a cluster
+	dev = newFAT12(t)
+	v = openVolume(t, dev)
+	long := v.firstCluster(entry(t, v, findEntry(t, v, 0, "ALONGF~1.BIN")))
+	pos := findEntry(t, v, 0, "SHORT.TXT")
+	patch(t, v, pos.sect, func(buf []byte) { v.setFirstCluster(buf[pos.off:], v.fat.get(long)) })
+	expectProblem(t, dev, CrossLinked)
+	expectClean(t, dev)
+}
+
+func TestSizeMismatch(t *testing.T) {
+	dev := newFAT12(t)
+	v := openVolume(t, dev)
+	pos := findEntry(t, v, 0, "SHORT.TXT")
+	patch(t, v, pos.sect, func(buf []byte) { binary.LittleEndian.PutUint32(buf[pos.off+_DIR_FileSize:], 5000) })
+	expectProblem(t, dev, SizeMismatch)
+	fs := mount(t, dev)
+	expectSize(t, fs, "/SHORT.TXT", 1024)
+	check(t, fs.Unmount())
+}
+
+func TestBadEntry(t *testing.T) {
+	dev := newFAT12(t)
+	v := openVolume(t, dev)
+	album := v.firstCluster(entry(t, v, findEntry(t, v, 0, "ALBUM")))
+	pos := findEntry(t, v, album, "..")
+	patch(t, v, pos.sect, func(buf []byte) { v.setFirstCluster(buf[pos.off:], album) })
+	expectProblem(t, dev, BadEntry)
+	if c := v.firstCluster(entry(t, v, pos)); c != 0 {
+		t.Fatalf("expected %d, was actually %d", 0, c)
+	}
+
+	// garbage entry, whose clusters are freed as lost clusters
+	pos = findEntry(t, v, 0, "SHORT.TXT")
+	patch(t, v, pos.sect, func(buf []byte) { buf[pos.off+3] = '*' })
+	report := expectProblem(t, dev, BadEntry)
+	if !hasProblem(report, LostClusters) || report.Files != 2 {
+		t.Fatalf("expected lost clusters, was actually %v", report.Problems)
+	}
+}
+
+func TestBadLFN(t *testing.T) {
+	dev := newFAT12(t)
+	v := openVolume(t, dev)
+	pos := findEntry(t, v, 0, "ALONGF~1.BIN")
+	if pos.off == 0 {
+		t.Fatal("expected LFN entries in the same sector")
+	}
+	patch(t, v, pos.sect, func(buf []byte) { buf[pos.off-_SZDIRE+_LDIR_Chksum]++ })
+	expectProblem(t, dev, BadLFN)
+	fs := mount(t, dev)
+	expectSize(t, fs, "/ALONGF~1.BIN", 5000)
+	if _, err := fs.Stat("/a long file name.bin"); err == nil {
+		t.Fatal("expected the long name removed")
+	}
+	check(t, fs.Unmount())
+}
+
+func TestLog(t *testing.T) {
+	dev := newFAT12(t)
+	v := openVolume(t, dev)
+	setFAT(t, v, v.maxClus, 0xFFF)
+	var logged []string
+	report, err := Check(dev, &Options{Log: func(p *Problem) { logged = append(logged, p.String()) }})
+	check(t, err)
+	if len(logged) != 1 || len(report.Problems) != 1 || logged[0] != "lost clusters: 1 clusters allocated but not in any chain" {
+		t.Fatalf("unexpected log %q", logged)
+	}
+}
+
+// readOnlyDevice fails all the writes.
+type readOnlyDevice struct {
+	tinyfs.BlockDevice
+}
+
+var errReadOnly = errors.New("read only")
+
+func (d readOnlyDevice) WriteAt(buf []byte, off int64) (int, error) {
+	return 0, errReadOnly
+}
+
+func TestRepairWriteError(t *testing.T) {
+	dev := newFAT12(t)
+	v := openVolume(t, dev)
+	setFAT(t, v, v.maxClus, 0xFFF)
+	report, err := Check(readOnlyDevice{dev}, &Options{Repair: true})
+	if err != errReadOnly || report == nil || report.Err != errReadOnly {
+		t.Fatalf("expected %v in the report, was actually %v", errReadOnly, err)
+	}
+	if report.OK() || !hasProblem(report, LostClusters) {
+		t.Fatalf("expected %v not repaired, was actually %v", LostClusters, report.Problems)
+	}
+	expectProblem(t, dev, LostClusters)
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -55,3 +55,10 @@ func Unref(ptr unsafe.Pointer) {
 
 	C.free(ptr)
 }
+
+// Count returns the number of values saved and not released by Unref yet.
+func Count() int {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return len(store)
+}
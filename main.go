@@ -1,12 +1,14 @@
 package main
 
 import (
+    "errors"
     "fmt"
     "machine"
     "time"
     "os"
 
     //"tinygo.org/x/drivers/sdcard"
+    "github.com/elehobica/pico_tinygo_vs1053/cache"
     "github.com/elehobica/pico_tinygo_vs1053/sdcard"
     "tinygo.org/x/tinyfs"
     //"tinygo.org/x/tinyfs/fatfs"
@@ -21,6 +23,8 @@ var (
     sdoPin   machine.Pin
     sdiPin   machine.Pin
     csSdPin  machine.Pin
+    cdSdPin  machine.Pin
+    wpSdPin  machine.Pin
     csVsPin  machine.Pin
     xrstPin  machine.Pin
     xdcsPin  machine.Pin
@@ -64,6 +68,46 @@ type TestError struct {
     Code int
 }
 
+// sdErrorCode tells the kind of sdcard error by number of blinks
+func sdErrorCode(err error) int {
+    switch {
+    case errors.Is(err, sdcard.ErrNoCard):
+        return 4
+    case errors.Is(err, sdcard.ErrTimeout), errors.Is(err, sdcard.ErrNotInitialized):
+        return 5
+    case errors.Is(err, sdcard.ErrCRC):
+        return 6
+    case errors.Is(err, sdcard.ErrCardLocked):
+        return 7
+    default:
+        return 2
+    }
+}
+
+// setClock reads "YYYYMMDDhhmmss" from Serial and sets it to clock
+func setClock(clock *fatfs.SoftClock) error {
+    const layout = "20060102150405"
+    buf := make([]byte, 0, len(layout))
+    timeout := time.Now().Add(10 * time.Second)
+    for len(buf) < len(layout) {
+        if time.Now().After(timeout) {
+            return errors.New("timeout")
+        }
+        if serial.Buffered() == 0 {
+            time.Sleep(10 * time.Millisecond)
+            continue
+        }
+        data, _ := serial.ReadByte()
+        buf = append(buf, data)
+    }
+    now, err := time.ParseInLocation(layout, string(buf), time.Local)
+    if err != nil {
+        return err
+    }
+    clock.Set(now)
+    return nil
+}
+
 func main() {
     led := &Pin{&ledPin}
     led.Configure(machine.PinConfig{Mode: machine.PinOutput})
@@ -80,6 +124,10 @@ func main() {
     })
     codec := vs1053.New(mySpi, csVsPin, xrstPin, xdcsPin, xdreqPin)
     sd := sdcard.New(mySpi, csSdPin)
+    if err := sd.SetDetectPins(cdSdPin, wpSdPin); err != nil {
+        fmt.Printf("ERROR[2]: sdcard detect pin error: %s\r\n", err.Error())
+        led.ErrorBlinkFor(2)
+    }
 
     // Start Test
     err := vs1053_test(led, codec, sd)
@@ -105,15 +153,22 @@ func vs1053_test(led *Pin, codec vs1053.Device, sd sdcard.Device) (testError *Te
 
     err = sd.Configure()
     if err != nil {
-        return &TestError{ error: fmt.Errorf("sdcard configure error: %s", err.Error()), Code: 2 }
+        return &TestError{ error: fmt.Errorf("sdcard configure error: %s", err.Error()), Code: sdErrorCode(err) }
     }
 
-    filesystem := fatfs.New(&sd)
+    // cache FAT and directory sectors, read ahead while streaming
+    filesystem := fatfs.New(cache.New(&sd, &cache.Config{
+        Sectors:   8,
+        ReadAhead: 4,
+    }))
 
     // Configure FATFS with sector size (must match value in ff.h - use 512)
     filesystem.Configure(&fatfs.Config{
         SectorSize: 512,
     })
+    // Pico has no battery backed clock, time is given through Serial
+    clock := &fatfs.SoftClock{}
+    filesystem.SetClock(clock)
 
     err = filesystem.Mount()
     if err != nil {
@@ -142,8 +197,38 @@ func vs1053_test(led *Pin, codec vs1053.Device, sd sdcard.Device) (testError *Te
     musicPlayer.StartPlayingFile(ff);
 
     // file is playing in the background
+    removed := false
     for loop := 0; ; loop++ {
-        if musicPlayer.Stopped() {
+        select {
+        case ev := <-sd.Events():
+            if ev == sdcard.EventRemoved {
+                // files are no longer accessible, stop gracefully
+                fmt.Printf("Card removed\r\n")
+                removed = true
+                musicPlayer.StopPlaying()
+                // release the handle before the volume is mounted again
+                ff.Close()
+            } else if removed {
+                // initialize the card again and play track 002 from the start
+                fmt.Printf("Card inserted\r\n")
+                removed = false
+                err = filesystem.Mount()
+                if err != nil {
+                    return &TestError{ error: fmt.Errorf("mount error: %s", err.Error()), Code: 3 }
+                }
+                f, err = filesystem.OpenFile("/track002.mp3", os.O_RDONLY)
+                if err != nil {
+                    return &TestError{ error: fmt.Errorf("open error: %s", err.Error()), Code: 3 }
+                }
+                ff, _ = f.(*fatfs.File)
+                musicPlayer.StartPlayingFile(ff);
+            }
+        default:
+        }
+        if musicPlayer.Stopped() && !removed {
+            if err := musicPlayer.Err(); err != nil {
+                fmt.Printf("Playback stopped: %s\r\n", err.Error())
+            }
             fmt.Printf("Done playing music\r\n")
             return nil
         }
@@ -172,6 +257,12 @@ func vs1053_test(led *Pin, codec vs1053.Device, sd sdcard.Device) (testError *Te
                     volumeAtt++
                     musicPlayer.SetVolume(volumeAtt, volumeAtt)
                 }
+            case 'T':
+                if err := setClock(clock); err != nil {
+                    fmt.Printf("Clock not set: %s\r\n", err.Error())
+                } else {
+                    fmt.Printf("Clock set: %s\r\n", clock.Now().Format("2006-01-02 15:04:05"))
+                }
             default:
             }
         }
@@ -0,0 +1,137 @@
+package partition
+
+import (
+	"tinygo.org/x/tinyfs"
+)
+
+// Device is a tinyfs.BlockDevice covering a partition of the parent device.
+// Accesses are relative to the partition and clipped to its size.
+type Device struct {
+	dev  tinyfs.BlockDevice
+	off  int64
+	size int64
+}
+
+// NewDevice returns the block device of partition p on dev. The partition
+// is clipped to the size of dev.
+func NewDevice(dev tinyfs.BlockDevice, p *Partition) *Device {
+	off := p.Offset()
+	size := p.Size()
+	if total := dev.Size(); off > total {
+		off = total
+		size = 0
+	} else if off+size > total {
+		size = total - off
+	}
+	return &Device{
+		dev:  dev,
+		off:  off,
+		size: size,
+	}
+}
+
+// Offset returns the byte offset of the partition on the parent device.
+func (d *Device) Offset() int64 {
+	return d.off
+}
+
+func (d *Device) check(n int, off int64) error {
+	if off < 0 || off+int64(n) > d.size {
+		return ErrRange
+	}
+	return nil
+}
+
+func (d *Device) ReadAt(buf []byte, off int64) (int, error) {
+	if err := d.check(len(buf), off); err != nil {
+		return 0, err
+	}
+	return d.dev.ReadAt(buf, d.off+off)
+}
+
+func (d *Device) WriteAt(buf []byte, off int64) (int, error) {
+	if err := d.check(len(buf), off); err != nil {
+		return 0, err
+	}
+	return d.dev.WriteAt(buf, d.off+off)
+}
+
+func (d *Device) Size() int64 {
+	return d.size
+}
+
+func (d *Device) WriteBlockSize() int64 {
+	return d.dev.WriteBlockSize()
+}
+
+func (d *Device) EraseBlockSize() int64 {
+	return d.dev.EraseBlockSize()
+}
+
+// EraseBlocks erases blocks of the partition. The partition must start at
+// an erase block boundary of the parent device.
+func (d *Device) EraseBlocks(start, len int64) error {
+	size := d.dev.EraseBlockSize()
+	if d.off%size != 0 {
+		return ErrUnaligned
+	}
+	if err := d.check(0, (start+len)*size); err != nil {
+		return err
+	}
+	return d.dev.EraseBlocks(d.off/size+start, len)
+}
+
+// Trim discards n bytes at offset off of the partition. Parent devices
+// without Trim only get the erase blocks erased which lie entirely in the
+// range.
+func (d *Device) Trim(off, n int64) error {
+	if err := d.check(0, off+n); err != nil {
+		return err
+	}
+	if trimmer, ok := d.dev.(interface{ Trim(off, n int64) error }); ok {
+		return trimmer.Trim(d.off+off, n)
+	}
+	size := d.dev.EraseBlockSize()
+	start := (off + size - 1) / size
+	end := (off + n) / size
+	if end <= start {
+		return nil
+	}
+	return d.EraseBlocks(start, end-start)
+}
+
+func (d *Device) Sync() error {
+	if syncer, ok := d.dev.(tinyfs.Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// removable is implemented by devices with removable media such as
+// sdcard.Device.
+type removable interface {
+	Ready() bool
+	Configure() error
+	WriteProtected() bool
+}
+
+func (d *Device) Ready() bool {
+	if r, ok := d.dev.(removable); ok {
+		return r.Ready()
+	}
+	return true
+}
+
+func (d *Device) Configure() error {
+	if r, ok := d.dev.(removable); ok {
+		return r.Configure()
+	}
+	return nil
+}
+
+func (d *Device) WriteProtected() bool {
+	if r, ok := d.dev.(removable); ok {
+		return r.WriteProtected()
+	}
+	return false
+}
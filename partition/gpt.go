@@ -0,0 +1,307 @@
+package partition
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"unicode/utf16"
+
+	"tinygo.org/x/tinyfs"
+)
+
+// GUID is a GUID in its on-disk (mixed endian) byte order.
+type GUID [16]byte
+
+// GPT partition types
+var (
+	GUIDEmpty     = GUID{}
+	GUIDBasicData = MustParseGUID("EBD0A0A2-B9E5-4433-87C0-68B6B72699C7")
+	GUIDEFISystem = MustParseGUID("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+	GUIDLinux     = MustParseGUID("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+)
+
+// String returns the canonical form such as
+// "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7".
+func (g GUID) String() string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(g[0:]),
+		binary.LittleEndian.Uint16(g[4:]),
+		binary.LittleEndian.Uint16(g[6:]),
+		g[8:10], g[10:16])
+}
+
+// ParseGUID parses the canonical form of a GUID.
+func ParseGUID(s string) (GUID, error) {
+	var g GUID
+	var b [16]byte
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return g, fmt.Errorf("partition: invalid GUID %q", s)
+	}
+	hex := s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:36]
+	for i := range b {
+		hi, ok1 := unhex(hex[i*2])
+		lo, ok2 := unhex(hex[i*2+1])
+		if !ok1 || !ok2 {
+			return g, fmt.Errorf("partition: invalid GUID %q", s)
+		}
+		b[i] = hi<<4 | lo
+	}
+	// first three fields are little endian on disk
+	g[0], g[1], g[2], g[3] = b[3], b[2], b[1], b[0]
+	g[4], g[5] = b[5], b[4]
+	g[6], g[7] = b[7], b[6]
+	copy(g[8:], b[8:])
+	return g, nil
+}
+
+// MustParseGUID is like ParseGUID but panics on an invalid GUID.
+func MustParseGUID(s string) GUID {
+	g, err := ParseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+const (
+	_GPT_SIGNATURE   = "EFI PART"
+	_GPT_REVISION    = 0x00010000
+	_GPT_HEADER_SZ   = 92
+	_GPT_ENTRY_SZ    = 128
+	_GPT_ENTRIES     = 128
+	_GPT_MAX_ENTRIES = 1024
+	_GPT_NAME_LEN    = 36 // UTF-16 code units
+
+	// sectors of the entry array with _GPT_ENTRIES entries
+	_GPT_TABLE_SECTORS = _GPT_ENTRIES * _GPT_ENTRY_SZ / SectorSize
+)
+
+type gptHeader struct {
+	current     int64
+	backup      int64
+	firstUsable int64
+	lastUsable  int64
+	diskGUID    GUID
+	entryLBA    int64
+	entries     uint32
+	entrySize   uint32
+	entryCRC    uint32
+}
+
+// parseGPTHeader checks and parses the GPT header in buf read from lba.
+func parseGPTHeader(buf []byte, lba int64) (*gptHeader, error) {
+	if string(buf[0:8]) != _GPT_SIGNATURE {
+		return nil, ErrCorrupt
+	}
+	size := binary.LittleEndian.Uint32(buf[12:])
+	if size < _GPT_HEADER_SZ || size > SectorSize {
+		return nil, ErrCorrupt
+	}
+	crc := binary.LittleEndian.Uint32(buf[16:])
+	hdr := make([]byte, size)
+	copy(hdr, buf)
+	binary.LittleEndian.PutUint32(hdr[16:], 0)
+	if crc32.ChecksumIEEE(hdr) != crc {
+		return nil, ErrCorrupt
+	}
+	h := &gptHeader{
+		current:     int64(binary.LittleEndian.Uint64(buf[24:])),
+		backup:      int64(binary.LittleEndian.Uint64(buf[32:])),
+		firstUsable: int64(binary.LittleEndian.Uint64(buf[40:])),
+		lastUsable:  int64(binary.LittleEndian.Uint64(buf[48:])),
+		entryLBA:    int64(binary.LittleEndian.Uint64(buf[72:])),
+		entries:     binary.LittleEndian.Uint32(buf[80:]),
+		entrySize:   binary.LittleEndian.Uint32(buf[84:]),
+		entryCRC:    binary.LittleEndian.Uint32(buf[88:]),
+	}
+	copy(h.diskGUID[:], buf[56:72])
+	if h.current != lba || h.entrySize < _GPT_ENTRY_SZ || h.entrySize > SectorSize || h.entrySize&(h.entrySize-1) != 0 || h.entries > _GPT_MAX_ENTRIES {
+		return nil, ErrCorrupt
+	}
+	return h, nil
+}
+
+// readGPTAt reads the GPT whose header is at lba.
+func readGPTAt(dev tinyfs.BlockDevice, lba int64) (*Table, error) {
+	buf := make([]byte, SectorSize)
+	if _, err := dev.ReadAt(buf, lba*SectorSize); err != nil {
+		return nil, err
+	}
+	h, err := parseGPTHeader(buf, lba)
+	if err != nil {
+		return nil, err
+	}
+	t := &Table{
+		Scheme:   SchemeGPT,
+		DiskGUID: h.diskGUID,
+	}
+	// the entry array is read one sector at a time, the entry size is a
+	// power of 2 so that no entry crosses a sector
+	var crc uint32
+	perSector := SectorSize / int(h.entrySize)
+	for i := 0; i < int(h.entries); i++ {
+		n := i % perSector
+		if n == 0 {
+			if _, err := dev.ReadAt(buf, (h.entryLBA+int64(i/perSector))*SectorSize); err != nil {
+				return nil, err
+			}
+			size := (int(h.entries) - i) * int(h.entrySize)
+			if size > SectorSize {
+				size = SectorSize
+			}
+			crc = crc32.Update(crc, crc32.IEEETable, buf[:size])
+		}
+		e := buf[n*int(h.entrySize):]
+		var p Partition
+		copy(p.TypeGUID[:], e[0:16])
+		if p.TypeGUID == GUIDEmpty {
+			continue
+		}
+		copy(p.GUID[:], e[16:32])
+		first := int64(binary.LittleEndian.Uint64(e[32:]))
+		last := int64(binary.LittleEndian.Uint64(e[40:]))
+		if last < first {
+			return nil, ErrCorrupt
+		}
+		p.Index = i + 1
+		p.Start = first
+		p.Sectors = last - first + 1
+		p.Attrs = binary.LittleEndian.Uint64(e[48:])
+		p.Name = decodeName(e[56:128])
+		t.Partitions = append(t.Partitions, p)
+	}
+	if crc != h.entryCRC {
+		return nil, ErrCorrupt
+	}
+	return t, nil
+}
+
+// readGPT reads the primary GPT, or the backup GPT at the end of the device
+// if the primary one is corrupted.
+func readGPT(dev tinyfs.BlockDevice) (*Table, error) {
+	t, err := readGPTAt(dev, 1)
+	if err == ErrCorrupt {
+		t, err = readGPTAt(dev, dev.Size()/SectorSize-1)
+	}
+	return t, err
+}
+
+func decodeName(b []byte) string {
+	u := make([]uint16, 0, _GPT_NAME_LEN)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+func encodeName(b []byte, name string) {
+	u := utf16.Encode([]rune(name))
+	if len(u) > _GPT_NAME_LEN {
+		u = u[:_GPT_NAME_LEN]
+	}
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[i*2:], c)
+	}
+}
+
+// WriteGPT writes a protective MBR, the primary GPT and the backup GPT to
+// dev with up to 128 partitions. Start and Sectors left zero are laid out as
+// described for Partition; TypeGUID defaults to GUIDBasicData. GUID of the
+// partitions must be given by the caller, as there is no random source to
+// rely on.
+func WriteGPT(dev tinyfs.BlockDevice, diskGUID GUID, parts []Partition) error {
+	if len(parts) > _GPT_ENTRIES {
+		return ErrTooMany
+	}
+	lastLBA := dev.Size()/SectorSize - 1
+	firstUsable := int64(2 + _GPT_TABLE_SECTORS)
+	lastUsable := lastLBA - 1 - _GPT_TABLE_SECTORS
+	if lastUsable < firstUsable {
+		return ErrOverlap
+	}
+	parts, err := layout(parts, firstUsable, lastUsable)
+	if err != nil {
+		return err
+	}
+
+	array := make([]byte, _GPT_ENTRIES*_GPT_ENTRY_SZ)
+	for i := range parts {
+		p := &parts[i]
+		if p.TypeGUID == GUIDEmpty {
+			p.TypeGUID = GUIDBasicData
+		}
+		if p.Index > _GPT_ENTRIES {
+			return ErrTooMany
+		}
+		e := array[(p.Index-1)*_GPT_ENTRY_SZ:]
+		copy(e[0:16], p.TypeGUID[:])
+		copy(e[16:32], p.GUID[:])
+		binary.LittleEndian.PutUint64(e[32:], uint64(p.Start))
+		binary.LittleEndian.PutUint64(e[40:], uint64(p.Start+p.Sectors-1))
+		binary.LittleEndian.PutUint64(e[48:], p.Attrs)
+		encodeName(e[56:128], p.Name)
+	}
+	arrayCRC := crc32.ChecksumIEEE(array)
+
+	// protective MBR covering the whole device
+	size := lastLBA
+	if size > 0xFFFFFFFF {
+		size = 0xFFFFFFFF
+	}
+	mbr := make([]byte, SectorSize)
+	putMBREntry(mbr[_MBR_TABLE:], &Partition{Type: TypeGPTProtective, Start: 1, Sectors: size})
+	copy(mbr[_MBR_TABLE+1:_MBR_TABLE+4], []byte{0x00, 0x02, 0x00})
+	mbr[_MBR_SIGNATURE] = 0x55
+	mbr[_MBR_SIGNATURE+1] = 0xAA
+	if _, err := dev.WriteAt(mbr, 0); err != nil {
+		return err
+	}
+
+	backupArray := lastLBA - _GPT_TABLE_SECTORS
+	header := func(current, backup, entryLBA int64) []byte {
+		buf := make([]byte, SectorSize)
+		copy(buf[0:8], _GPT_SIGNATURE)
+		binary.LittleEndian.PutUint32(buf[8:], _GPT_REVISION)
+		binary.LittleEndian.PutUint32(buf[12:], _GPT_HEADER_SZ)
+		binary.LittleEndian.PutUint64(buf[24:], uint64(current))
+		binary.LittleEndian.PutUint64(buf[32:], uint64(backup))
+		binary.LittleEndian.PutUint64(buf[40:], uint64(firstUsable))
+		binary.LittleEndian.PutUint64(buf[48:], uint64(lastUsable))
+		copy(buf[56:72], diskGUID[:])
+		binary.LittleEndian.PutUint64(buf[72:], uint64(entryLBA))
+		binary.LittleEndian.PutUint32(buf[80:], _GPT_ENTRIES)
+		binary.LittleEndian.PutUint32(buf[84:], _GPT_ENTRY_SZ)
+		binary.LittleEndian.PutUint32(buf[88:], arrayCRC)
+		binary.LittleEndian.PutUint32(buf[16:], crc32.ChecksumIEEE(buf[:_GPT_HEADER_SZ]))
+		return buf
+	}
+
+	// backup first, so that an interrupted write leaves a valid table
+	if _, err := dev.WriteAt(array, backupArray*SectorSize); err != nil {
+		return err
+	}
+	if _, err := dev.WriteAt(header(lastLBA, 1, backupArray), lastLBA*SectorSize); err != nil {
+		return err
+	}
+	if _, err := dev.WriteAt(array, 2*SectorSize); err != nil {
+		return err
+	}
+	_, err = dev.WriteAt(header(1, lastLBA, 2), SectorSize)
+	return err
+}
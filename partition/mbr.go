@@ -0,0 +1,175 @@
+package partition
+
+import (
+	"encoding/binary"
+
+	"tinygo.org/x/tinyfs"
+)
+
+// MBR partition types
+const (
+	TypeEmpty         = 0x00
+	TypeFAT12         = 0x01
+	TypeFAT16Small    = 0x04 // FAT16 < 32MB
+	TypeExtended      = 0x05
+	TypeFAT16         = 0x06
+	TypeExFAT         = 0x07 // also NTFS
+	TypeFAT32         = 0x0B
+	TypeFAT32LBA      = 0x0C
+	TypeFAT16LBA      = 0x0E
+	TypeExtendedLBA   = 0x0F
+	TypeLinux         = 0x83
+	TypeLinuxExtended = 0x85
+	TypeGPTProtective = 0xEE
+)
+
+const (
+	_MBR_TABLE     = 446
+	_MBR_ENTRY_SZ  = 16
+	_MBR_ENTRIES   = 4
+	_MBR_SIGNATURE = 510
+	_MBR_DISK_ID   = 440
+
+	_MAX_LOGICAL = 64 // limits the EBR chain
+)
+
+func isExtended(t byte) bool {
+	return t == TypeExtended || t == TypeExtendedLBA || t == TypeLinuxExtended
+}
+
+// isBootSector reports whether sector 0 is a FAT/exFAT boot sector rather
+// than an MBR.
+func isBootSector(buf []byte) bool {
+	if buf[0] != 0xEB && buf[0] != 0xE9 {
+		return false
+	}
+	return string(buf[3:11]) == "EXFAT   " || string(buf[54:57]) == "FAT" || string(buf[82:87]) == "FAT32"
+}
+
+// parseMBR parses the primary partitions of the MBR in buf.
+func parseMBR(buf []byte) (*Table, error) {
+	if buf[_MBR_SIGNATURE] != 0x55 || buf[_MBR_SIGNATURE+1] != 0xAA || isBootSector(buf) {
+		return nil, ErrNoTable
+	}
+	t := &Table{
+		Scheme: SchemeMBR,
+		DiskID: binary.LittleEndian.Uint32(buf[_MBR_DISK_ID:]),
+	}
+	for i := 0; i < _MBR_ENTRIES; i++ {
+		e := buf[_MBR_TABLE+i*_MBR_ENTRY_SZ:]
+		if e[0] != 0x00 && e[0] != 0x80 {
+			return nil, ErrCorrupt
+		}
+		p := Partition{
+			Index:    i + 1,
+			Bootable: e[0] == 0x80,
+			Type:     e[4],
+			Start:    int64(binary.LittleEndian.Uint32(e[8:])),
+			Sectors:  int64(binary.LittleEndian.Uint32(e[12:])),
+		}
+		if p.Type == TypeEmpty || p.Sectors == 0 {
+			continue
+		}
+		t.Partitions = append(t.Partitions, p)
+	}
+	return t, nil
+}
+
+// readLogical follows the EBR chain of the extended partition and appends
+// the logical partitions to t.
+func readLogical(dev tinyfs.BlockDevice, t *Table) error {
+	var ext *Partition
+	for i := range t.Partitions {
+		if isExtended(t.Partitions[i].Type) {
+			ext = &t.Partitions[i]
+			break
+		}
+	}
+	if ext == nil {
+		return nil
+	}
+	base := ext.Start
+	ebr := base
+	buf := make([]byte, SectorSize)
+	for n := 0; n < _MAX_LOGICAL; n++ {
+		if _, err := dev.ReadAt(buf, ebr*SectorSize); err != nil {
+			return err
+		}
+		if buf[_MBR_SIGNATURE] != 0x55 || buf[_MBR_SIGNATURE+1] != 0xAA {
+			return ErrCorrupt
+		}
+		e := buf[_MBR_TABLE:]
+		if e[4] != TypeEmpty {
+			t.Partitions = append(t.Partitions, Partition{
+				Index:   5 + n,
+				Type:    e[4],
+				Start:   ebr + int64(binary.LittleEndian.Uint32(e[8:])),
+				Sectors: int64(binary.LittleEndian.Uint32(e[12:])),
+			})
+		}
+		e = buf[_MBR_TABLE+_MBR_ENTRY_SZ:]
+		if !isExtended(e[4]) {
+			return nil
+		}
+		// link is relative to the extended partition
+		ebr = base + int64(binary.LittleEndian.Uint32(e[8:]))
+	}
+	return ErrCorrupt
+}
+
+// putMBREntry writes p into the 16-byte entry e. CHS addresses are set to
+// the maximum, partitions are addressed by LBA.
+func putMBREntry(e []byte, p *Partition) {
+	e[0] = 0x00
+	if p.Bootable {
+		e[0] = 0x80
+	}
+	copy(e[1:4], []byte{0xFE, 0xFF, 0xFF})
+	e[4] = p.Type
+	copy(e[5:8], []byte{0xFE, 0xFF, 0xFF})
+	binary.LittleEndian.PutUint32(e[8:], uint32(p.Start))
+	binary.LittleEndian.PutUint32(e[12:], uint32(p.Sectors))
+}
+
+// WriteMBR writes an MBR with up to 4 primary partitions to dev. Start and
+// Sectors left zero are laid out as described for Partition; Type defaults
+// to TypeFAT32LBA. The boot code area of sector 0 is kept.
+func WriteMBR(dev tinyfs.BlockDevice, diskID uint32, parts []Partition) error {
+	if len(parts) > _MBR_ENTRIES {
+		return ErrTooMany
+	}
+	last := dev.Size()/SectorSize - 1
+	if last > 0xFFFFFFFF {
+		last = 0xFFFFFFFF
+	}
+	parts, err := layout(parts, 1, last)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, SectorSize)
+	if _, err := dev.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	if isBootSector(buf) {
+		// do not leave a stale boot sector behind
+		for i := range buf {
+			buf[i] = 0
+		}
+	}
+	for i := _MBR_TABLE; i < SectorSize; i++ {
+		buf[i] = 0
+	}
+	binary.LittleEndian.PutUint32(buf[_MBR_DISK_ID:], diskID)
+	for i := range parts {
+		p := &parts[i]
+		if p.Type == TypeEmpty {
+			p.Type = TypeFAT32LBA
+		}
+		putMBREntry(buf[_MBR_TABLE+i*_MBR_ENTRY_SZ:], p)
+	}
+	buf[_MBR_SIGNATURE] = 0x55
+	buf[_MBR_SIGNATURE+1] = 0xAA
+	_, err = dev.WriteAt(buf, 0)
+	return err
+}
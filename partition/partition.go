@@ -0,0 +1,150 @@
+// Package partition reads and writes MBR and GPT partition tables of a
+// tinyfs.BlockDevice and provides each partition as a block device of its
+// own, e.g. to mount the second partition of a card with fatfs.
+package partition
+
+import (
+	"errors"
+
+	"tinygo.org/x/tinyfs"
+)
+
+const (
+	SectorSize = 512
+
+	// Align is the default alignment of new partitions in sectors (1MiB)
+	Align = 2048
+)
+
+type Scheme int
+
+const (
+	SchemeNone Scheme = iota // no partition table (super floppy)
+	SchemeMBR
+	SchemeGPT
+)
+
+func (s Scheme) String() string {
+	switch s {
+	case SchemeMBR:
+		return "MBR"
+	case SchemeGPT:
+		return "GPT"
+	default:
+		return "none"
+	}
+}
+
+var (
+	ErrNoTable   = errors.New("partition: no partition table")
+	ErrCorrupt   = errors.New("partition: corrupted partition table")
+	ErrNotFound  = errors.New("partition: partition not found")
+	ErrRange     = errors.New("partition: access out of range")
+	ErrTooMany   = errors.New("partition: too many partitions")
+	ErrOverlap   = errors.New("partition: partitions overlap or exceed the device")
+	ErrUnaligned = errors.New("partition: erase not aligned to the device erase block")
+)
+
+// Partition describes an entry of the partition table. Start and Sectors are
+// in units of SectorSize.
+type Partition struct {
+	Index    int   // 1-origin, logical MBR partitions start from 5
+	Start    int64 // first sector
+	Sectors  int64 // number of sectors
+	Type     byte  // MBR partition type (TypeXXX)
+	Bootable bool  // MBR active flag
+	TypeGUID GUID  // GPT partition type
+	GUID     GUID  // GPT unique partition GUID
+	Name     string
+	Attrs    uint64 // GPT attributes
+}
+
+// Offset returns the byte offset of the partition on the device.
+func (p *Partition) Offset() int64 {
+	return p.Start * SectorSize
+}
+
+// Size returns the size of the partition in bytes.
+func (p *Partition) Size() int64 {
+	return p.Sectors * SectorSize
+}
+
+// Table is the partition table of a device.
+type Table struct {
+	Scheme     Scheme
+	DiskID     uint32 // MBR disk signature
+	DiskGUID   GUID   // GPT disk GUID
+	Partitions []Partition
+}
+
+// Find returns the partition of index, nil if it does not exist.
+func (t *Table) Find(index int) *Partition {
+	for i := range t.Partitions {
+		if t.Partitions[i].Index == index {
+			return &t.Partitions[i]
+		}
+	}
+	return nil
+}
+
+// Read reads the partition table of dev. A protective MBR is followed by the
+// GPT, the backup GPT is used if the primary one is corrupted. A device
+// without MBR signature or with a FAT boot sector at sector 0 returns
+// ErrNoTable.
+func Read(dev tinyfs.BlockDevice) (*Table, error) {
+	buf := make([]byte, SectorSize)
+	if _, err := dev.ReadAt(buf, 0); err != nil {
+		return nil, err
+	}
+	mbr, err := parseMBR(buf)
+	if err != nil {
+		return nil, err
+	}
+	for i := range mbr.Partitions {
+		if mbr.Partitions[i].Type == TypeGPTProtective {
+			return readGPT(dev)
+		}
+	}
+	if err := readLogical(dev, mbr); err != nil {
+		return nil, err
+	}
+	return mbr, nil
+}
+
+// Open returns the block device of the partition of index on dev.
+func Open(dev tinyfs.BlockDevice, index int) (*Device, error) {
+	table, err := Read(dev)
+	if err != nil {
+		return nil, err
+	}
+	p := table.Find(index)
+	if p == nil {
+		return nil, ErrNotFound
+	}
+	return NewDevice(dev, p), nil
+}
+
+// layout fills in Index, Start and Sectors of parts left zero: Start follows
+// the previous partition aligned to Align sectors, Sectors extends to last.
+// It checks that the partitions are in order and in [first, last].
+func layout(parts []Partition, first, last int64) ([]Partition, error) {
+	parts = append([]Partition(nil), parts...)
+	next := first
+	for i := range parts {
+		p := &parts[i]
+		if p.Index == 0 {
+			p.Index = i + 1
+		}
+		if p.Start == 0 {
+			p.Start = (next + Align - 1) / Align * Align
+		}
+		if p.Sectors == 0 {
+			p.Sectors = last + 1 - p.Start
+		}
+		if p.Start < next || p.Sectors <= 0 || p.Start+p.Sectors-1 > last {
+			return nil, ErrOverlap
+		}
+		next = p.Start + p.Sectors
+	}
+	return parts, nil
+}
@@ -0,0 +1,293 @@
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/elehobica/pico_tinygo_vs1053/fatfs"
+	"tinygo.org/x/tinyfs"
+)
+
+const (
+	testBlockSize  = 4096
+	testBlockCount = 2048 // 8MiB, 16384 sectors
+	testSectors    = testBlockSize * testBlockCount / SectorSize
+)
+
+func newTestDevice() *tinyfs.MemBlockDevice {
+	return tinyfs.NewMemoryDevice(64, testBlockSize, testBlockCount)
+}
+
+func TestGUID(t *testing.T) {
+	s := "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7"
+	g, err := ParseGUID(s)
+	check(t, err)
+	if g[0] != 0xA2 || g[3] != 0xEB || g[8] != 0x87 {
+		t.Errorf("unexpected byte order % X", g[:])
+	}
+	if g.String() != s {
+		t.Errorf("expected %s, got %s", s, g.String())
+	}
+	if _, err := ParseGUID("EBD0A0A2-B9E5-4433-87C0-68B6B72699CX"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestNoTable(t *testing.T) {
+	dev := newTestDevice()
+	if _, err := Read(dev); err != ErrNoTable {
+		t.Errorf("expected ErrNoTable, got %v", err)
+	}
+
+	// FAT volume without partition table
+	buf := make([]byte, SectorSize)
+	buf[0] = 0xEB
+	copy(buf[82:], "FAT32   ")
+	buf[510], buf[511] = 0x55, 0xAA
+	dev.WriteAt(buf, 0)
+	if _, err := Read(dev); err != ErrNoTable {
+		t.Errorf("expected ErrNoTable, got %v", err)
+	}
+}
+
+func TestMBR(t *testing.T) {
+	dev := newTestDevice()
+	err := WriteMBR(dev, 0x12345678, []Partition{
+		{Sectors: 4096, Type: TypeFAT32LBA, Bootable: true},
+		{Start: 8192, Sectors: 2048, Type: TypeLinux},
+		{}, // rest of the device
+	})
+	check(t, err)
+
+	table, err := Read(dev)
+	check(t, err)
+	if table.Scheme != SchemeMBR || table.DiskID != 0x12345678 {
+		t.Errorf("unexpected table %v %08X", table.Scheme, table.DiskID)
+	}
+	expected := []Partition{
+		{Index: 1, Start: 2048, Sectors: 4096, Type: TypeFAT32LBA, Bootable: true},
+		{Index: 2, Start: 8192, Sectors: 2048, Type: TypeLinux},
+		{Index: 3, Start: 10240, Sectors: testSectors - 10240, Type: TypeFAT32LBA},
+	}
+	comparePartitions(t, expected, table.Partitions)
+
+	err = WriteMBR(dev, 0, []Partition{{Start: 2048, Sectors: 4096}, {Start: 4096}})
+	if err != ErrOverlap {
+		t.Errorf("expected ErrOverlap, got %v", err)
+	}
+	err = WriteMBR(dev, 0, make([]Partition, 5))
+	if err != ErrTooMany {
+		t.Errorf("expected ErrTooMany, got %v", err)
+	}
+}
+
+func TestMBRLogical(t *testing.T) {
+	dev := newTestDevice()
+	check(t, WriteMBR(dev, 0, []Partition{
+		{Sectors: 2048},
+		{Type: TypeExtendedLBA},
+	}))
+
+	// two logical partitions in the extended partition at 4096
+	ebr := func(lba int64, start, sectors, next uint32) {
+		buf := make([]byte, SectorSize)
+		putMBREntry(buf[_MBR_TABLE:], &Partition{Type: TypeFAT16LBA, Start: int64(start), Sectors: int64(sectors)})
+		if next != 0 {
+			putMBREntry(buf[_MBR_TABLE+_MBR_ENTRY_SZ:], &Partition{Type: TypeExtended, Start: int64(next), Sectors: 2048})
+		}
+		buf[510], buf[511] = 0x55, 0xAA
+		dev.WriteAt(buf, lba*SectorSize)
+	}
+	ebr(4096, 2048, 1024, 4096)
+	ebr(8192, 2048, 2048, 0)
+
+	table, err := Read(dev)
+	check(t, err)
+	expected := []Partition{
+		{Index: 1, Start: 2048, Sectors: 2048, Type: TypeFAT32LBA},
+		{Index: 2, Start: 4096, Sectors: testSectors - 4096, Type: TypeExtendedLBA},
+		{Index: 5, Start: 6144, Sectors: 1024, Type: TypeFAT16LBA},
+		{Index: 6, Start: 10240, Sectors: 2048, Type: TypeFAT16LBA},
+	}
+	comparePartitions(t, expected, table.Partitions)
+}
+
+func TestGPT(t *testing.T) {
+	dev := newTestDevice()
+	disk := MustParseGUID("01234567-89AB-CDEF-0123-456789ABCDEF")
+	part := MustParseGUID("11111111-2222-3333-4444-555555555555")
+	err := WriteGPT(dev, disk, []Partition{
+		{Sectors: 4096, Name: "music", GUID: part},
+		{TypeGUID: GUIDLinux, Name: "データ", Attrs: 1 << 63},
+	})
+	check(t, err)
+	expected := []Partition{
+		{Index: 1, Start: 2048, Sectors: 4096, TypeGUID: GUIDBasicData, GUID: part, Name: "music"},
+		{Index: 2, Start: 6144, Sectors: testSectors - 33 - 6144, TypeGUID: GUIDLinux, Name: "データ", Attrs: 1 << 63},
+	}
+
+	table, err := Read(dev)
+	check(t, err)
+	if table.Scheme != SchemeGPT || table.DiskGUID != disk {
+		t.Errorf("unexpected table %v %v", table.Scheme, table.DiskGUID)
+	}
+	comparePartitions(t, expected, table.Partitions)
+
+	t.Run("Large", func(t *testing.T) {
+		// a header with the largest entry array must not allocate it
+		orig := make([]byte, SectorSize)
+		dev.ReadAt(orig, SectorSize)
+		defer dev.WriteAt(orig, SectorSize)
+		hdr := bytes.Clone(orig)
+		binary.LittleEndian.PutUint32(hdr[80:], _GPT_MAX_ENTRIES)
+		binary.LittleEndian.PutUint32(hdr[84:], SectorSize)
+		binary.LittleEndian.PutUint32(hdr[16:], 0)
+		binary.LittleEndian.PutUint32(hdr[16:], crc32.ChecksumIEEE(hdr[:_GPT_HEADER_SZ]))
+		dev.WriteAt(hdr, SectorSize)
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := readGPTAt(dev, 1)
+		runtime.ReadMemStats(&after)
+		if err != ErrCorrupt {
+			t.Errorf("expected ErrCorrupt, got %v", err)
+		}
+		if n := after.TotalAlloc - before.TotalAlloc; n > 16*SectorSize {
+			t.Errorf("allocated %d bytes", n)
+		}
+	})
+
+	t.Run("Backup", func(t *testing.T) {
+		dev.WriteAt([]byte{0}, SectorSize+24) // break the header CRC
+		table, err := Read(dev)
+		check(t, err)
+		comparePartitions(t, expected, table.Partitions)
+
+		dev.WriteAt([]byte{0}, (testSectors-33)*SectorSize) // break the backup entries
+		if _, err := Read(dev); err != ErrCorrupt {
+			t.Errorf("expected ErrCorrupt, got %v", err)
+		}
+	})
+}
+
+func TestDevice(t *testing.T) {
+	dev := newTestDevice()
+	check(t, WriteMBR(dev, 0, []Partition{{Sectors: 2048}, {Sectors: 2048}}))
+	pdev, err := Open(dev, 2)
+	check(t, err)
+	if pdev.Offset() != 4096*SectorSize || pdev.Size() != 2048*SectorSize {
+		t.Errorf("unexpected offset %d size %d", pdev.Offset(), pdev.Size())
+	}
+
+	_, err = pdev.WriteAt([]byte("partition2"), 0)
+	check(t, err)
+	buf := make([]byte, 10)
+	dev.ReadAt(buf, 4096*SectorSize)
+	if string(buf) != "partition2" {
+		t.Errorf("unexpected data %q", buf)
+	}
+
+	if _, err := pdev.ReadAt(buf, pdev.Size()-5); err != ErrRange {
+		t.Errorf("expected ErrRange, got %v", err)
+	}
+	if _, err := pdev.WriteAt(buf, -1); err != ErrRange {
+		t.Errorf("expected ErrRange, got %v", err)
+	}
+	if _, err := Open(dev, 3); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// erase block 0 of the partition is block 256 of the device
+	check(t, pdev.EraseBlocks(0, 1))
+	dev.ReadAt(buf, 4096*SectorSize)
+	if !bytes.Equal(buf, bytes.Repeat([]byte{0xff}, len(buf))) {
+		t.Errorf("partition not erased %q", buf)
+	}
+
+	// the device has no Trim, only block 1 of the partition lies in the range
+	pdev.WriteAt([]byte{0x12}, testBlockSize)
+	pdev.WriteAt([]byte{0x34}, 3*testBlockSize-1)
+	check(t, pdev.Trim(1, 3*testBlockSize-2))
+	pdev.ReadAt(buf[:1], testBlockSize)
+	if buf[0] != 0xff {
+		t.Errorf("trimmed block not erased: %02x", buf[0])
+	}
+	pdev.ReadAt(buf[:1], 3*testBlockSize-1)
+	if buf[0] != 0x34 {
+		t.Errorf("partial block erased: %02x", buf[0])
+	}
+
+	// partition beyond the device is clipped
+	pdev = NewDevice(dev, &Partition{Start: testSectors - 10, Sectors: 100})
+	if pdev.Size() != 10*SectorSize {
+		t.Errorf("expected clipped size, got %d", pdev.Size())
+	}
+}
+
+func TestFATFS(t *testing.T) {
+	dev := newTestDevice()
+	check(t, WriteMBR(dev, 0, []Partition{
+		{Sectors: 2048, Type: 0xDA}, // raw data
+		{},
+	}))
+	raw, err := Open(dev, 1)
+	check(t, err)
+	data := bytes.Repeat([]byte("raw data "), 100)
+	_, err = raw.WriteAt(data, 0)
+	check(t, err)
+
+	pdev, err := Open(dev, 2)
+	check(t, err)
+	fs := fatfs.New(pdev).Configure(&fatfs.Config{SectorSize: fatfs.SectorSize})
+	check(t, fs.Format())
+	check(t, fs.Mount())
+	f, err := fs.OpenFile("track001.mp3", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	check(t, err)
+	_, err = f.Write([]byte("ID3"))
+	check(t, err)
+	check(t, f.Close())
+
+	// the partition table and the raw partition are left intact
+	table, err := Read(dev)
+	check(t, err)
+	if len(table.Partitions) != 2 {
+		t.Errorf("unexpected partitions %v", table.Partitions)
+	}
+	buf := make([]byte, len(data))
+	raw.ReadAt(buf, 0)
+	if !bytes.Equal(buf, data) {
+		t.Error("raw partition overwritten")
+	}
+
+	fs = fatfs.New(pdev).Configure(&fatfs.Config{SectorSize: fatfs.SectorSize})
+	check(t, fs.Mount())
+	f, err = fs.OpenFile("track001.mp3", os.O_RDONLY)
+	check(t, err)
+	n, _ := f.Read(buf)
+	if string(buf[:n]) != "ID3" {
+		t.Errorf("unexpected file content %q", buf[:n])
+	}
+	f.Close()
+}
+
+func comparePartitions(t *testing.T, expected, actual []Partition) {
+	t.Helper()
+	if len(expected) != len(actual) {
+		t.Fatalf("expected %d partitions, got %d", len(expected), len(actual))
+	}
+	for i := range expected {
+		if expected[i] != actual[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], actual[i])
+		}
+	}
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -13,6 +13,8 @@ func init() {
     sdoPin   = machine.GPIO3
     sdiPin   = machine.GPIO4
     csSdPin  = machine.GPIO5
+    cdSdPin  = machine.NoPin // machine.GPIO14 if the CD switch is wired
+    wpSdPin  = machine.NoPin // machine.GPIO15 if the WP switch is wired
     csVsPin  = machine.GPIO6
     xrstPin  = machine.GPIO7
     xdcsPin  = machine.GPIO17
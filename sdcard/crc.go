@@ -0,0 +1,29 @@
+package sdcard
+
+// crc7 calculates CRC7 (x^7 + x^3 + 1) of a command frame.
+func crc7(buf []byte) byte {
+	crc := byte(0)
+	for _, b := range buf {
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if (b^crc)&0x80 != 0 {
+				crc ^= 0x09
+			}
+			b <<= 1
+		}
+	}
+	return crc & 0x7F
+}
+
+// crc16 calculates CRC16-CCITT (x^16 + x^12 + x^5 + 1) of a data block.
+func crc16(buf []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range buf {
+		crc = (crc >> 8) | (crc << 8)
+		crc ^= uint16(b)
+		crc ^= (crc & 0xFF) >> 4
+		crc ^= crc << 12
+		crc ^= (crc & 0xFF) << 5
+	}
+	return crc
+}
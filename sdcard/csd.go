@@ -15,7 +15,8 @@ type CSD struct {
 	WRITE_BLK_MISALIGN byte   //  1 R  [78:78]     0x00 : Write Block Misalignment
 	READ_BLK_MISALIGN  byte   //  1 R  [77:77]     0x00 : Read Block Misalignment
 	DSR_IMP            byte   //  1 R  [76:76]     0x00 : DSR Implemented
-	C_SIZE             uint32 // 22 R  [69:48] 0xXXXXXX : Device Size
+	C_SIZE             uint32 // 22 R  [69:48] 0xXXXXXX : Device Size (CSD 1.0: 12 R [73:62])
+	C_SIZE_MULT        byte   //  3 R  [49:47]     0xXX : Device Size Multiplier (CSD 1.0 only)
 	ERASE_BLK_EN       byte   //  1 R  [46:46]     0x01 : Erase Single Block Enable
 	SECTOR_SIZE        byte   //  7 R  [45:39]     0x7F : Erase Sector Size
 	WP_GRP_SIZE        byte   //  7 R  [38:32]     0x00 : Write Protect Group Size
@@ -29,10 +30,16 @@ type CSD struct {
 	TMP_WRITE_PROTECT  byte   //  1 RW [12:12]     0x00 : Temporary Write Protection
 	FILE_FORMAT        byte   //  2 R  [11:10]     0x00 : File Format
 	CRC                byte   //  7 RW [7:1]       0xXX : CRC
+	legacy             bool   // device size is in CSD 1.0 layout
+	raw                [16]byte
 }
 
 func NewCSD(buf []byte) *CSD {
-	return &CSD{
+	return newCSD(buf, (buf[0]&0xC0)>>6 == 0x00)
+}
+
+func newCSD(buf []byte, legacy bool) *CSD {
+	c := &CSD{
 		CSD_STRUCTURE:      (buf[0] & 0xC0) >> 6,
 		TAAC:               buf[1],
 		NSAC:               buf[2],
@@ -57,7 +64,15 @@ func NewCSD(buf []byte) *CSD {
 		TMP_WRITE_PROTECT:  (buf[14] & 0x10) >> 4,
 		FILE_FORMAT:        (buf[14] & 0x0C) >> 2,
 		CRC:                (buf[15] & 0xFE) >> 1,
+		legacy:             legacy,
 	}
+	copy(c.raw[:], buf)
+	if legacy {
+		// CSD version 1.0 (old, <=2GB)
+		c.C_SIZE = uint32(buf[6]&0x03)<<10 | uint32(buf[7])<<2 | uint32(buf[8])>>6
+		c.C_SIZE_MULT = (buf[9]&0x03)<<1 | (buf[10]&0x80)>>7
+	}
+	return c
 }
 
 func (c *CSD) Dump() {
@@ -72,6 +87,9 @@ func (c *CSD) Dump() {
 	fmt.Printf("READ_BLK_MISALIGN:  %X\r\n", c.READ_BLK_MISALIGN)
 	fmt.Printf("DSR_IMP:            %X\r\n", c.DSR_IMP)
 	fmt.Printf("C_SIZE:             %X\r\n", c.C_SIZE)
+	if c.legacy {
+		fmt.Printf("C_SIZE_MULT:        %X\r\n", c.C_SIZE_MULT)
+	}
 	fmt.Printf("ERASE_BLK_EN:       %X\r\n", c.ERASE_BLK_EN)
 	fmt.Printf("SECTOR_SIZE:        %X\r\n", c.SECTOR_SIZE)
 	fmt.Printf("WP_GRP_SIZE:        %X\r\n", c.WP_GRP_SIZE)
@@ -89,18 +107,57 @@ func (c *CSD) Dump() {
 
 func (c *CSD) Sectors() (int64, error) {
 	sectors := int64(0)
-	if c.CSD_STRUCTURE == 0x01 {
+	if c.legacy {
+		// CSD version 1.0 (old, <=2GB)
+		// capacity = (C_SIZE+1) * 2^(C_SIZE_MULT+2) * 2^READ_BL_LEN
+		shift := uint(c.C_SIZE_MULT) + 2 + uint(c.READ_BL_LEN)
+		if shift < 9 {
+			return 0, fmt.Errorf("invalid CSD READ_BL_LEN %d", c.READ_BL_LEN)
+		}
+		sectors = (int64(c.C_SIZE) + 1) << (shift - 9)
+	} else if c.CSD_STRUCTURE == 0x01 {
 		// CSD version 2.0
 		sectors = (int64(c.C_SIZE) + 1) * 1024
-	} else if c.CSD_STRUCTURE == 0x00 {
-		// CSD version 1.0 (old, <=2GB)
-		return 0, fmt.Errorf("CSD format version 1.0 is not supported")
 	} else {
 		return 0, fmt.Errorf("unknown CSD format")
 	}
 	return sectors, nil
 }
 
+// TranSpeed returns the maximum data transfer rate of the card in bit/s per
+// line, 0 if TRAN_SPEED is invalid.
+func (c *CSD) TranSpeed() uint32 {
+	unit := c.TRAN_SPEED & 0x07
+	if unit > 3 {
+		return 0
+	}
+	// time value is 1.0 .. 8.0 scaled by 10
+	mult := []uint32{0, 10, 12, 13, 15, 20, 25, 30, 35, 40, 45, 50, 55, 60, 70, 80}[(c.TRAN_SPEED>>3)&0x0F]
+	rate := uint32(10000) // 100kbit/s divided by 10
+	for i := byte(0); i < unit; i++ {
+		rate *= 10
+	}
+	return rate * mult
+}
+
+// EraseSectorSize returns the size of an erasable sector in bytes.
+func (c *CSD) EraseSectorSize() int64 {
+	return (int64(c.SECTOR_SIZE) + 1) << c.WRITE_BL_LEN
+}
+
+// WriteProtectGroupSize returns the size of a write protect group in bytes,
+// 0 if the card does not support write protect groups.
+func (c *CSD) WriteProtectGroupSize() int64 {
+	if c.WP_GRP_ENABLE == 0 {
+		return 0
+	}
+	return (int64(c.WP_GRP_SIZE) + 1) * c.EraseSectorSize()
+}
+
 func (c *CSD) Size() uint64 {
-	return uint64(c.C_SIZE) * 512 * 1024
+	sectors, err := c.Sectors()
+	if err != nil {
+		return 0
+	}
+	return uint64(sectors) * 512
 }
@@ -0,0 +1,101 @@
+package sdcard
+
+import (
+	"machine"
+	"sync/atomic"
+)
+
+// Event is a card insertion or removal reported by the card detect pin.
+type Event uint8
+
+const (
+	EventRemoved Event = iota
+	EventInserted
+)
+
+const _EVENT_CH_SZ = 4
+
+// detector holds the state of the card detect and write protect pins. It is
+// shared by the copies of Device because the pin interrupt updates it, the
+// fields written by the interrupt are atomic.
+type detector struct {
+	cd      machine.Pin
+	wp      machine.Pin
+	events  chan Event
+	present atomic.Bool
+	changed atomic.Bool // card was removed since the last initialization
+}
+
+// SetDetectPins sets the card detect and write protect switch pins of the
+// card socket, either may be machine.NoPin. cd is low while a card is
+// inserted and wp is high while the card is write protected. Insertions and
+// removals are reported on Events().
+func (d *Device) SetDetectPins(cd, wp machine.Pin) error {
+	det := &detector{
+		cd:     cd,
+		wp:     wp,
+		events: make(chan Event, _EVENT_CH_SZ),
+	}
+	det.present.Store(true)
+	d.detect = det
+	if wp != machine.NoPin {
+		wp.Configure(machine.PinConfig{Mode: machine.PinInputPullup})
+	}
+	if cd == machine.NoPin {
+		return nil
+	}
+	cd.Configure(machine.PinConfig{Mode: machine.PinInputPullup})
+	det.present.Store(!cd.Get())
+	return cd.SetInterrupt(machine.PinToggle, func(machine.Pin) {
+		det.update()
+	})
+}
+
+// update is called by the card detect pin interrupt. Contact bounce is
+// filtered by reporting changes of the state only.
+func (det *detector) update() {
+	present := !det.cd.Get()
+	if det.present.Swap(present) == present {
+		return
+	}
+	ev := EventInserted
+	if !present {
+		ev = EventRemoved
+		det.changed.Store(true)
+	}
+	select {
+	case det.events <- ev:
+	default:
+		// nobody listens, drop the event
+	}
+}
+
+// Events returns the channel of card insertions and removals. It is nil
+// without card detect pin.
+func (d *Device) Events() <-chan Event {
+	if d.detect == nil {
+		return nil
+	}
+	return d.detect.events
+}
+
+// Present reports whether a card is inserted. It is always true without
+// card detect pin.
+func (d *Device) Present() bool {
+	return d.detect == nil || d.detect.cd == machine.NoPin || d.detect.present.Load()
+}
+
+// WriteProtected reports whether the write protect switch of the card is
+// set.
+func (d *Device) WriteProtected() bool {
+	return d.detect != nil && d.detect.wp != machine.NoPin && d.detect.wp.Get()
+}
+
+// Ready reports whether the inserted card is initialized, i.e. Configure()
+// succeeded and the card was not removed since.
+func (d *Device) Ready() bool {
+	if d.sdCardType == 0 || !d.Present() {
+		return false
+	}
+	return d.detect == nil || !d.detect.changed.Load()
+}
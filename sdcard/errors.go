@@ -0,0 +1,181 @@
+package sdcard
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// R2 (CMD13) second byte
+	_R2_CARD_LOCKED     = 1 << 0
+	_R2_WP_ERASE_SKIP   = 1 << 1 // or lock/unlock command failed
+	_R2_ERROR           = 1 << 2
+	_R2_CC_ERROR        = 1 << 3
+	_R2_CARD_ECC_FAILED = 1 << 4
+	_R2_WP_VIOLATION    = 1 << 5
+	_R2_ERASE_PARAM     = 1 << 6
+	_R2_OUT_OF_RANGE    = 1 << 7
+
+	// data error token
+	_DATA_ERROR           = 1 << 0
+	_DATA_CC_ERROR        = 1 << 1
+	_DATA_CARD_ECC_FAILED = 1 << 2
+	_DATA_OUT_OF_RANGE    = 1 << 3
+
+	// data response token
+	_DATA_RES_MASK     = 0x1F
+	_DATA_RES_ACCEPTED = 0x05
+	_DATA_RES_CRC      = 0x0B
+	_DATA_RES_WRITE    = 0x0D
+)
+
+// Error categories of the sdcard package. Errors returned by Device match
+// them with errors.Is.
+var (
+	ErrNoCard         = errors.New("sdcard: no card")
+	ErrTimeout        = errors.New("sdcard: timeout")
+	ErrCRC            = errors.New("sdcard: CRC error")
+	ErrIllegalCommand = errors.New("sdcard: illegal command")
+	ErrAddress        = errors.New("sdcard: address out of range")
+	ErrParameter      = errors.New("sdcard: parameter error")
+	ErrEraseSequence  = errors.New("sdcard: erase sequence error")
+	ErrWriteProtect   = errors.New("sdcard: write protected")
+	ErrCardLocked     = errors.New("sdcard: card is locked")
+	ErrPassword       = errors.New("sdcard: lock/unlock failed (wrong password)")
+	ErrCard           = errors.New("sdcard: card internal error")
+	// ErrNotInitialized tells that the card is in the idle state, it did not
+	// complete the initialization or it was reset, so Configure is needed.
+	ErrNotInitialized = errors.New("sdcard: card not initialized")
+)
+
+// CommandError is returned when a command is answered by an R1 response
+// with error bits set, or is not answered at all (R1 is 0xFF).
+type CommandError struct {
+	Cmd byte // command index
+	App bool // Cmd is an application specific command (ACMD)
+	R1  byte
+}
+
+func (e CommandError) Error() string {
+	name := fmt.Sprintf("CMD%d", e.Cmd)
+	if e.App {
+		name = "A" + name
+	}
+	if e.R1 == 0xFF {
+		return "sdcard: " + name + " no response"
+	}
+	msg := fmt.Sprintf("sdcard: %s failed (R1 %02X", name, e.R1)
+	for _, b := range []struct {
+		bit  byte
+		name string
+	}{
+		{_R1_IDLE_STATE, "idle"},
+		{_R1_ERASE_RESET, "erase reset"},
+		{_R1_ILLEGAL_COMMAND, "illegal command"},
+		{_R1_COM_CRC_ERROR, "CRC error"},
+		{_R1_ERASE_SEQUENCE_ERROR, "erase sequence error"},
+		{_R1_ADDRESS_ERROR, "address error"},
+		{_R1_PARAMETER_ERROR, "parameter error"},
+	} {
+		if e.R1&b.bit != 0 {
+			msg += ", " + b.name
+		}
+	}
+	return msg + ")"
+}
+
+func (e CommandError) Is(target error) bool {
+	if e.R1 == 0xFF {
+		// no response
+		return target == ErrTimeout
+	}
+	switch target {
+	case ErrNotInitialized:
+		return e.R1&_R1_IDLE_STATE != 0
+	case ErrIllegalCommand:
+		return e.R1&_R1_ILLEGAL_COMMAND != 0
+	case ErrCRC:
+		return e.R1&_R1_COM_CRC_ERROR != 0
+	case ErrEraseSequence:
+		return e.R1&_R1_ERASE_SEQUENCE_ERROR != 0
+	case ErrAddress:
+		return e.R1&_R1_ADDRESS_ERROR != 0
+	case ErrParameter:
+		return e.R1&_R1_PARAMETER_ERROR != 0
+	}
+	return false
+}
+
+// DataError is returned when the card sends a data error token instead of
+// a data block, or no token at all (Token is 0xFF).
+type DataError struct {
+	Block uint32
+	Token byte
+}
+
+func (e DataError) Error() string {
+	if e.Token == 0xFF {
+		return fmt.Sprintf("sdcard: no data token for block %d", e.Block)
+	}
+	return fmt.Sprintf("sdcard: data error token %02X for block %d", e.Token, e.Block)
+}
+
+func (e DataError) Is(target error) bool {
+	if e.Token == 0xFF {
+		return target == ErrTimeout
+	}
+	switch target {
+	case ErrAddress:
+		return e.Token&_DATA_OUT_OF_RANGE != 0
+	case ErrCard:
+		return e.Token&(_DATA_ERROR|_DATA_CC_ERROR|_DATA_CARD_ECC_FAILED) != 0
+	}
+	return false
+}
+
+// DataResponseError is returned when the card rejects a written data block.
+// Status holds the R2 card status read by CMD13 after the rejection, if
+// available.
+type DataResponseError struct {
+	Block  uint32
+	Token  byte
+	Status uint16
+}
+
+func (e DataResponseError) Error() string {
+	msg := fmt.Sprintf("sdcard: write of block %d rejected (token %02X", e.Block, e.Token&_DATA_RES_MASK)
+	if e.Status != 0 {
+		msg += fmt.Sprintf(", status %04X", e.Status)
+	}
+	return msg + ")"
+}
+
+func (e DataResponseError) Is(target error) bool {
+	switch target {
+	case ErrCRC:
+		return e.Token&_DATA_RES_MASK == _DATA_RES_CRC
+	case ErrWriteProtect:
+		return e.Status&_R2_WP_VIOLATION != 0
+	case ErrCardLocked:
+		return e.Status&_R2_CARD_LOCKED != 0
+	case ErrAddress:
+		return e.Status&_R2_OUT_OF_RANGE != 0 || e.Status&(_R1_ADDRESS_ERROR<<8) != 0
+	case ErrCard:
+		return e.Status&(_R2_ERROR|_R2_CC_ERROR|_R2_CARD_ECC_FAILED) != 0
+	}
+	return false
+}
+
+// CRCError is returned when a received data block still fails the CRC
+// check after all retries.
+type CRCError struct {
+	Block uint32
+}
+
+func (e CRCError) Error() string {
+	return fmt.Sprintf("sdcard: CRC error at block %d", e.Block)
+}
+
+func (e CRCError) Is(target error) bool {
+	return target == ErrCRC
+}
@@ -0,0 +1,229 @@
+package sdcard
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// CMD42 lock card data structure flags
+	_LOCK_SET_PWD     = 1 << 0
+	_LOCK_CLR_PWD     = 1 << 1
+	_LOCK_LOCK_UNLOCK = 1 << 2
+	_LOCK_ERASE       = 1 << 3
+
+	_PWD_MAX_LEN = 16
+)
+
+// SetPassword sets the card password to pwd. old is the current password,
+// empty if none is set. The card stays unlocked until Lock() or the next
+// power up.
+func (d *Device) SetPassword(old, pwd []byte) error {
+	if len(pwd) == 0 {
+		return fmt.Errorf("sdcard: empty password")
+	}
+	return d.lockUnlock(_LOCK_SET_PWD, append(append([]byte{}, old...), pwd...))
+}
+
+// ClearPassword removes the card password pwd.
+func (d *Device) ClearPassword(pwd []byte) error {
+	return d.lockUnlock(_LOCK_CLR_PWD, pwd)
+}
+
+// Lock locks the card with its password pwd. A locked card refuses data
+// access, and Configure() returns ErrCardLocked after power up.
+func (d *Device) Lock(pwd []byte) error {
+	return d.lockUnlock(_LOCK_LOCK_UNLOCK, pwd)
+}
+
+// Unlock unlocks the card with its password pwd. A card found locked by
+// Configure() is initialized again.
+func (d *Device) Unlock(pwd []byte) error {
+	if err := d.lockUnlock(0, pwd); err != nil {
+		return err
+	}
+	if d.sdCardType != 0 {
+		return nil
+	}
+
+	d.bus.Lock()
+	defer d.bus.Unlock()
+	err := d.initCard()
+	if err != nil {
+		d.sdCardType = 0
+	}
+	return err
+}
+
+// Locked reports whether the card is locked.
+func (d *Device) Locked() (bool, error) {
+	d.bus.Lock()
+	defer d.bus.Unlock()
+	d.bus.SetBaudRate(d.freq)
+	status, err := d.readStatus()
+	if err != nil {
+		return false, err
+	}
+	return status&_R2_CARD_LOCKED != 0, nil
+}
+
+// lockUnlock sends the lock card data structure with flags and pwd using
+// CMD42.
+func (d *Device) lockUnlock(flags byte, pwd []byte) error {
+	if len(pwd) > 2*_PWD_MAX_LEN || (flags != _LOCK_SET_PWD && len(pwd) > _PWD_MAX_LEN) {
+		return fmt.Errorf("sdcard: password longer than %d bytes", _PWD_MAX_LEN)
+	}
+	buf := make([]byte, 2+len(pwd))
+	buf[0] = flags
+	buf[1] = byte(len(pwd))
+	copy(buf[2:], pwd)
+
+	d.bus.Lock()
+	defer d.bus.Unlock()
+	d.bus.SetBaudRate(d.freq)
+	defer d.cs.High()
+
+	// CMD42 transfers a block of the length set by CMD16
+	if err := d.cmdOK(CMD16_SET_BLOCKLEN, uint32(len(buf))); err != nil {
+		return err
+	}
+	err := d.writeRegister(CMD42_LOCK_UNLOCK, 0, buf)
+	if rerr := d.cmdOK(CMD16_SET_BLOCKLEN, 0x0200); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return err
+	}
+
+	status, err := d.readStatus()
+	if err != nil {
+		return err
+	}
+	if status&_R2_WP_ERASE_SKIP != 0 {
+		return ErrPassword
+	}
+	return nil
+}
+
+// SetTempWriteProtect sets or clears the temporary write protection of the
+// whole card by programming TMP_WRITE_PROTECT of the CSD using CMD27.
+func (d *Device) SetTempWriteProtect(protect bool) error {
+	if d.CSD == nil {
+		return ErrNoCard
+	}
+	csd := d.CSD.raw
+	if protect {
+		csd[14] |= 0x10
+	} else {
+		csd[14] &^= 0x10
+	}
+	csd[15] = crc7(csd[:15])<<1 | 0x01
+
+	d.bus.Lock()
+	defer d.bus.Unlock()
+	d.bus.SetBaudRate(d.freq)
+	defer d.cs.High()
+	if err := d.writeRegister(CMD27_PROGRAM_CSD, 0, csd[:]); err != nil {
+		return d.withStatus(err)
+	}
+	return d.updateCSD()
+}
+
+// TempWriteProtected reads the CSD again and reports whether the card is
+// temporarily or permanently write protected.
+func (d *Device) TempWriteProtected() (bool, error) {
+	d.bus.Lock()
+	defer d.bus.Unlock()
+	d.bus.SetBaudRate(d.freq)
+	if err := d.updateCSD(); err != nil {
+		return false, err
+	}
+	return d.CSD.TMP_WRITE_PROTECT == 1 || d.CSD.PERM_WRITE_PROTECT == 1, nil
+}
+
+// updateCSD reads the CSD into d.CSD.
+func (d *Device) updateCSD() error {
+	var buf [16]byte
+	if err := d.readCSD(buf[:]); err != nil {
+		d.cs.High()
+		return err
+	}
+	d.CSD = newCSD(buf[:], d.CSD.legacy)
+	return nil
+}
+
+// SetWriteProtectGroup sets or clears the write protection of the write
+// protect group containing block using CMD28 or CMD29. Only standard
+// capacity cards with CSD.WP_GRP_ENABLE support write protect groups.
+func (d *Device) SetWriteProtectGroup(block uint32, protect bool) error {
+	cmd := byte(CMD29_CLR_WRITE_PROT)
+	if protect {
+		cmd = CMD28_SET_WRITE_PROT
+	}
+
+	d.bus.Lock()
+	defer d.bus.Unlock()
+	d.bus.SetBaudRate(d.freq)
+	defer d.cs.High()
+	if err := d.cmdOK(cmd, d.address(block)); err != nil {
+		return err
+	}
+	// R1b: busy while programming
+	return d.waitNotBusy(600 * time.Millisecond)
+}
+
+// WriteProtectGroups returns the write protection bits of the 32 write
+// protect groups from the one containing block using CMD30. Bit 0 is the
+// group containing block.
+func (d *Device) WriteProtectGroups(block uint32) (uint32, error) {
+	d.bus.Lock()
+	defer d.bus.Unlock()
+	d.bus.SetBaudRate(d.freq)
+	if err := d.cmdOK(CMD30_SEND_WRITE_PROT, d.address(block)); err != nil {
+		d.cs.High()
+		return 0, err
+	}
+	var buf [4]byte
+	if err := d.readRegisterData(buf[:]); err != nil {
+		return 0, err
+	}
+	return uint32(buf[0])<<24 | uint32(buf[1])<<16 | uint32(buf[2])<<8 | uint32(buf[3]), nil
+}
+
+// address converts block to the command argument, which is a byte address
+// if not SDHC card.
+func (d Device) address(block uint32) uint32 {
+	if d.sdCardType != SD_CARD_TYPE_SDHC {
+		return block << 9
+	}
+	return block
+}
+
+// writeRegister sends cmd with arg followed by the data block data, e.g. the
+// CSD for CMD27, and waits until it is programmed.
+func (d Device) writeRegister(cmd uint8, arg uint32, data []byte) error {
+	if err := d.cmdOK(cmd, arg); err != nil {
+		return err
+	}
+
+	// send Data Token for CMD24 alike commands
+	d.bus.Transfer(byte(0xFE))
+
+	if err := d.bus.Tx(data, nil); err != nil {
+		return err
+	}
+
+	d.writeCRC(data)
+
+	// Data Resp.
+	r, err := d.bus.Transfer(byte(0xFF))
+	if err != nil {
+		return err
+	}
+	if (r & _DATA_RES_MASK) != _DATA_RES_ACCEPTED {
+		return DataResponseError{Token: r}
+	}
+
+	// wait no busy
+	return d.waitNotBusy(600 * time.Millisecond)
+}
@@ -0,0 +1,34 @@
+package sdcard
+
+import (
+	"fmt"
+)
+
+type OCR struct {
+	BUSY       byte   //  1 [31:31] : Card power up status bit
+	CCS        byte   //  1 [30:30] : Card Capacity Status
+	UHS2       byte   //  1 [29:29] : UHS-II Card Status
+	CO2T       byte   //  1 [27:27] : Over 2TB support Status
+	S18A       byte   //  1 [24:24] : Switching to 1.8V Accepted
+	VDD_WINDOW uint16 //  9 [23:15] : VDD Voltage Window (2.7-3.6V)
+}
+
+func NewOCR(buf []byte) *OCR {
+	return &OCR{
+		BUSY:       (buf[0] & 0x80) >> 7,
+		CCS:        (buf[0] & 0x40) >> 6,
+		UHS2:       (buf[0] & 0x20) >> 5,
+		CO2T:       (buf[0] & 0x08) >> 3,
+		S18A:       buf[0] & 0x01,
+		VDD_WINDOW: uint16(buf[1])<<1 | uint16(buf[2])>>7,
+	}
+}
+
+func (o *OCR) Dump() {
+	fmt.Printf("BUSY:               %X\r\n", o.BUSY)
+	fmt.Printf("CCS:                %X\r\n", o.CCS)
+	fmt.Printf("UHS2:               %X\r\n", o.UHS2)
+	fmt.Printf("CO2T:               %X\r\n", o.CO2T)
+	fmt.Printf("S18A:               %X\r\n", o.S18A)
+	fmt.Printf("VDD_WINDOW:         %X\r\n", o.VDD_WINDOW)
+}
@@ -0,0 +1,71 @@
+package sdcard
+
+import (
+	"fmt"
+)
+
+type SCR struct {
+	SCR_STRUCTURE         byte //  4 [63:60] : SCR Structure
+	SD_SPEC               byte //  4 [59:56] : SD Memory Card - Spec. Version
+	DATA_STAT_AFTER_ERASE byte //  1 [55:55] : data_status_after erases
+	SD_SECURITY           byte //  3 [54:52] : CPRM Security Support
+	SD_BUS_WIDTHS         byte //  4 [51:48] : DAT Bus widths supported
+	SD_SPEC3              byte //  1 [47:47] : Spec. Version 3.00 or higher
+	EX_SECURITY           byte //  4 [46:43] : Extended Security Support
+	SD_SPEC4              byte //  1 [42:42] : Spec. Version 4.00 or higher
+	SD_SPECX              byte //  4 [41:38] : Spec. Version 5.00 or higher
+	CMD_SUPPORT           byte //  5 [36:32] : Command Support bits
+}
+
+func NewSCR(buf []byte) *SCR {
+	return &SCR{
+		SCR_STRUCTURE:         (buf[0] & 0xF0) >> 4,
+		SD_SPEC:               buf[0] & 0x0F,
+		DATA_STAT_AFTER_ERASE: (buf[1] & 0x80) >> 7,
+		SD_SECURITY:           (buf[1] & 0x70) >> 4,
+		SD_BUS_WIDTHS:         buf[1] & 0x0F,
+		SD_SPEC3:              (buf[2] & 0x80) >> 7,
+		EX_SECURITY:           (buf[2] & 0x78) >> 3,
+		SD_SPEC4:              (buf[2] & 0x04) >> 2,
+		SD_SPECX:              (buf[2]&0x03)<<2 | (buf[3]&0xC0)>>6,
+		CMD_SUPPORT:           buf[3] & 0x1F,
+	}
+}
+
+func (s *SCR) Dump() {
+	fmt.Printf("SCR_STRUCTURE:         %X\r\n", s.SCR_STRUCTURE)
+	fmt.Printf("SD_SPEC:               %X\r\n", s.SD_SPEC)
+	fmt.Printf("DATA_STAT_AFTER_ERASE: %X\r\n", s.DATA_STAT_AFTER_ERASE)
+	fmt.Printf("SD_SECURITY:           %X\r\n", s.SD_SECURITY)
+	fmt.Printf("SD_BUS_WIDTHS:         %X\r\n", s.SD_BUS_WIDTHS)
+	fmt.Printf("SD_SPEC3:              %X\r\n", s.SD_SPEC3)
+	fmt.Printf("EX_SECURITY:           %X\r\n", s.EX_SECURITY)
+	fmt.Printf("SD_SPEC4:              %X\r\n", s.SD_SPEC4)
+	fmt.Printf("SD_SPECX:              %X\r\n", s.SD_SPECX)
+	fmt.Printf("CMD_SUPPORT:           %X\r\n", s.CMD_SUPPORT)
+}
+
+// Version returns the physical layer specification version of the card,
+// e.g. "3.0".
+func (s *SCR) Version() string {
+	switch {
+	case s.SD_SPEC == 0:
+		return "1.0"
+	case s.SD_SPEC == 1:
+		return "1.1"
+	case s.SD_SPEC != 2:
+		return "unknown"
+	case s.SD_SPECX != 0:
+		return fmt.Sprintf("%d.0", s.SD_SPECX+4)
+	case s.SD_SPEC4 != 0:
+		return "4.0"
+	case s.SD_SPEC3 != 0:
+		return "3.0"
+	}
+	return "2.0"
+}
+
+// BusWidth4 reports whether the card supports the 4 bit SD bus.
+func (s *SCR) BusWidth4() bool {
+	return s.SD_BUS_WIDTHS&0x04 != 0
+}
@@ -1,13 +1,18 @@
 package sdcard
 
 import (
+	"errors"
 	"fmt"
 	"machine"
 	"time"
 )
 
 const (
-	_CMD_TIMEOUT = 100
+	_CMD_TIMEOUT   = 100
+	_ERASE_TIMEOUT = 250 // per erase block
+	_CLOCK_ERRORS  = 3   // consecutive CRC or timeout errors to lower the SPI clock
+
+	_HIGH_SPEED_FREQ = 50000000 // clock of a card switched to high speed mode
 
 	_R1_IDLE_STATE           = 1 << 0
 	_R1_ERASE_RESET          = 1 << 1
@@ -21,8 +26,9 @@ const (
 	SD_CARD_TYPE_SD1  = 1 // Standard capacity V1 SD card
 	SD_CARD_TYPE_SD2  = 2 // Standard capacity V2 SD card
 	SD_CARD_TYPE_SDHC = 3 // High Capacity SD card
+	SD_CARD_TYPE_MMC  = 4 // MultiMediaCard (initialized by CMD1)
 
-	// SPI Frequency
+	// SPI Frequency (FastFreq is the upper limit for the card's clock)
     SlowFreq =   250000
     FastFreq = 50000000
 )
@@ -46,8 +52,17 @@ type Device struct {
 	dummybuf   []byte
 	tokenbuf   []byte
 	sdCardType byte
+	crc        bool
+	crcRetries int
+	eraseSize  int64
+	freq       uint32
+	clockErrs  int
+	detect     *detector
 	CID        *CID
 	CSD        *CSD
+	OCR        *OCR
+	SCR        *SCR      // nil for MMC
+	SDStatus   *SDStatus // nil for MMC
 }
 
 func New(bus SPI, cs machine.Pin) Device {
@@ -58,13 +73,26 @@ func New(bus SPI, cs machine.Pin) Device {
 		dummybuf:   make([]byte, 512),
 		tokenbuf:   make([]byte, 1),
 		sdCardType: 0,
+		freq:       SlowFreq,
 	}
 }
 
 func (d *Device) Configure() error {
+	if !d.Present() {
+		d.sdCardType = 0
+		return ErrNoCard
+	}
+	if d.detect != nil {
+		d.detect.changed.Store(false)
+	}
+
 	d.bus.Lock()
 	defer d.bus.Unlock()
-	return d.initCard()
+	err := d.initCard()
+	if err != nil {
+		d.sdCardType = 0
+	}
+	return err
 }
 
 func (d *Device) initCard() error {
@@ -72,7 +100,9 @@ func (d *Device) initCard() error {
 	d.cs.Configure(machine.PinConfig{Mode: machine.PinOutput})
 	d.cs.High()
 
-	d.bus.SetBaudRate(SlowFreq)
+	d.freq = SlowFreq
+	d.clockErrs = 0
+	d.bus.SetBaudRate(d.freq)
 
 	for i := range dummy {
 		dummy[i] = 0xFF
@@ -89,20 +119,19 @@ func (d *Device) initCard() error {
 	tm := setTimeout(0, 2*time.Second)
 	for !tm.expired() {
 		// Wait up to 2 seconds to be the same as the Arduino
-		if d.cmd(CMD0_GO_IDLE_STATE, 0, 0x95) == _R1_IDLE_STATE {
+		if d.cmd(CMD0_GO_IDLE_STATE, 0) == _R1_IDLE_STATE {
 			ok = true
 			break
 		}
 	}
 	if !ok {
-		return fmt.Errorf("no SD card")
+		return ErrNoCard
 	}
 
 	// CMD8: determine card version
-	r := d.cmd(CMD8_SEND_IF_COND, 0x01AA, 0x87)
+	r := d.cmd(CMD8_SEND_IF_COND, 0x01AA)
 	if (r & _R1_ILLEGAL_COMMAND) == _R1_ILLEGAL_COMMAND {
 		d.sdCardType = SD_CARD_TYPE_SD1
-		return fmt.Errorf("init_card_v1 not impl\r\n")
 	} else {
 		// r7 response
 		status := byte(0)
@@ -140,37 +169,56 @@ func (d *Device) initCard() error {
 	ok = false
 	tm = setTimeout(0, 2*time.Second)
 	for !tm.expired() {
-		if d.acmd(ACMD41_SD_APP_OP_COND, arg) == 0 {
+		r = d.acmd(ACMD41_SD_APP_OP_COND, arg)
+		if r == 0 {
 			ok = true
 			break
 		}
+		if d.sdCardType == SD_CARD_TYPE_SD1 && (r&_R1_ILLEGAL_COMMAND) == _R1_ILLEGAL_COMMAND {
+			// not an SD card
+			break
+		}
 	}
 
-	if !ok {
-		return fmt.Errorf("SD_CARD_ERROR_ACMD41")
+	// MMC does not know ACMD41, initialize it by CMD1 instead
+	if !ok && d.sdCardType == SD_CARD_TYPE_SD1 {
+		tm = setTimeout(0, 2*time.Second)
+		for !tm.expired() {
+			r = d.cmd(CMD1_SEND_OP_CND, 0)
+			if r == 0 {
+				ok = true
+				d.sdCardType = SD_CARD_TYPE_MMC
+				break
+			}
+		}
+		if !ok {
+			return CommandError{Cmd: CMD1_SEND_OP_CND, R1: r}
+		}
 	}
 
-	// if SD2 read OCR register to check for SDHC card
-	if d.sdCardType == SD_CARD_TYPE_SD2 {
-		if d.cmd(CMD58_READ_OCR, 0, 0xFF) != 0 {
-			return fmt.Errorf("SD_CARD_ERROR_CMD58")
-		}
+	if !ok {
+		return CommandError{Cmd: ACMD41_SD_APP_OP_COND, App: true, R1: r}
+	}
 
-		status, err := d.bus.Transfer(byte(0xFF))
-		if err != nil {
+	if d.crc {
+		if err := d.crcOnOff(); err != nil {
 			return err
 		}
-		if (status & 0xC0) == 0xC0 {
+	}
+
+	// read OCR register, if SD2 to check for SDHC card
+	var ocr [4]byte
+	if err := d.readOCR(ocr[:]); err == nil {
+		d.OCR = NewOCR(ocr[:])
+		if d.sdCardType == SD_CARD_TYPE_SD2 && d.OCR.BUSY == 1 && d.OCR.CCS == 1 {
 			d.sdCardType = SD_CARD_TYPE_SDHC
 		}
-		// discard rest of ocr - contains allowed voltage range
-		for i := 1; i < 4; i++ {
-			d.bus.Transfer(byte(0xFF))
-		}
+	} else if d.sdCardType == SD_CARD_TYPE_SD2 {
+		return err
 	}
 
-	if d.cmd(CMD16_SET_BLOCKLEN, 0x0200, 0xFF) != 0 {
-		return fmt.Errorf("SD_CARD_ERROR_CMD16")
+	if err := d.cmdOK(CMD16_SET_BLOCKLEN, 0x0200); err != nil {
+		return err
 	}
 
 	var buf [16]byte
@@ -186,25 +234,171 @@ func (d *Device) initCard() error {
 	if err != nil {
 		return err
 	}
-	d.CSD = NewCSD(buf[:])
+	if d.sdCardType == SD_CARD_TYPE_MMC {
+		// MMC uses the CSD 1.0 device size layout for all CSD structures
+		d.CSD = newCSD(buf[:], true)
+	} else {
+		d.CSD = NewCSD(buf[:])
+	}
+
+	// a locked card only accepts basic and lock commands until Unlock()
+	status, err := d.readStatus()
+	if err != nil {
+		return err
+	}
+	if status&_R2_CARD_LOCKED != 0 {
+		return ErrCardLocked
+	}
+
+	// read SCR and SD Status, left nil if the card does not provide them
+	if d.sdCardType != SD_CARD_TYPE_MMC {
+		if err := d.readSCR(buf[:]); err == nil {
+			d.SCR = NewSCR(buf[:])
+		}
+		var status [64]byte
+		if err := d.readSDStatus(status[:]); err == nil {
+			d.SDStatus = NewSDStatus(status[:])
+		}
+	}
+
+	// erase unit: AU size from SD Status, or erase sector size from CSD
+	d.eraseSize = d.CSD.EraseSectorSize()
+	if d.SDStatus != nil && d.SDStatus.AUSize() != 0 {
+		d.eraseSize = d.SDStatus.AUSize()
+	}
+
+	// SPI clock: maximum transfer rate of the card, raised if it switches to
+	// high speed mode
+	d.freq = d.CSD.TranSpeed()
+	if d.freq < FastFreq && d.switchHighSpeed() {
+		d.freq = _HIGH_SPEED_FREQ
+	}
+	if d.freq > FastFreq {
+		d.freq = FastFreq
+	} else if d.freq < SlowFreq {
+		d.freq = SlowFreq
+	}
 
 	d.cs.High()
 
-	d.bus.SetBaudRate(FastFreq)
+	d.bus.SetBaudRate(d.freq)
 
 	return nil
 }
 
+// Frequency returns the SPI clock used for data transfers. It is chosen by
+// Configure() and lowered when CRC or timeout errors repeat.
+func (d *Device) Frequency() uint32 {
+	return d.freq
+}
+
+// switchHighSpeed switches the card to high speed mode using CMD6 and
+// reports whether it succeeded.
+func (d Device) switchHighSpeed() bool {
+	// CMD6 is supported by SD spec 1.1 or later with command class 10
+	if d.SCR == nil || d.SCR.SD_SPEC < 1 || d.CSD.CCC&(1<<10) == 0 {
+		return false
+	}
+
+	var status [64]byte
+	// check function: group 1 (access mode) function 1 (high speed)
+	if err := d.switchFunc(0x00FFFFF1, status[:]); err != nil {
+		return false
+	}
+	if status[13]&0x02 == 0 || status[16]&0x0F != 0x01 {
+		return false
+	}
+	// switch function
+	if err := d.switchFunc(0x80FFFFF1, status[:]); err != nil {
+		return false
+	}
+	return status[16]&0x0F == 0x01
+}
+
+// switchFunc sends CMD6 with arg and reads the 64 bytes switch status.
+func (d Device) switchFunc(arg uint32, status []byte) error {
+	if err := d.cmdOK(CMD6_SWITCH_FUNC, arg); err != nil {
+		d.cs.High()
+		return err
+	}
+	return d.readRegisterData(status[:64])
+}
+
+// countError counts consecutive CRC and timeout errors and halves the SPI
+// clock after _CLOCK_ERRORS of them. A nil err resets the count.
+func (d *Device) countError(err error) {
+	if err == nil {
+		d.clockErrs = 0
+		return
+	}
+	if !errors.Is(err, ErrCRC) && !errors.Is(err, ErrTimeout) {
+		return
+	}
+	d.clockErrs++
+	if d.clockErrs < _CLOCK_ERRORS || d.freq/2 < SlowFreq {
+		return
+	}
+	d.clockErrs = 0
+	d.freq /= 2
+	d.bus.SetBaudRate(d.freq)
+}
+
+// SetCRC enables or disables CRC protection of commands and data blocks
+// (CMD59). A data block that fails the CRC check is transferred again up to
+// retries times before CRCError is returned. The mode is applied to the card
+// immediately if it is already initialized, otherwise by Configure().
+func (d *Device) SetCRC(enable bool, retries int) error {
+	d.crc = enable
+	d.crcRetries = retries
+	if d.sdCardType == 0 {
+		return nil
+	}
+
+	d.bus.Lock()
+	defer d.bus.Unlock()
+	defer d.cs.High()
+	return d.crcOnOff()
+}
+
+// crcOnOff sends CMD59 to turn CRC checking of the card on or off.
+func (d Device) crcOnOff() error {
+	arg := uint32(0)
+	if d.crc {
+		arg = 1
+	}
+	return d.cmdOK(CMD59_CRC_ON_OFF, arg)
+}
+
 func (d Device) acmd(cmd byte, arg uint32) byte {
-	d.cmd(CMD55_APP_CMD, 0, 0xFF)
-	return d.cmd(cmd, arg, 0xFF)
+	d.cmd(CMD55_APP_CMD, 0)
+	return d.cmd(cmd, arg)
 }
 
-func (d Device) cmd(cmd byte, arg uint32, crc byte) byte {
+// cmdOK sends cmd and returns CommandError unless the card answers R1 0.
+func (d Device) cmdOK(cmd byte, arg uint32) error {
+	if r := d.cmd(cmd, arg); r != 0 {
+		return CommandError{Cmd: cmd, R1: r}
+	}
+	return nil
+}
+
+// acmdOK sends the application command cmd and returns CommandError unless
+// the card answers R1 0.
+func (d Device) acmdOK(cmd byte, arg uint32) error {
+	if r := d.acmd(cmd, arg); r != 0 {
+		return CommandError{Cmd: cmd, App: true, R1: r}
+	}
+	return nil
+}
+
+func (d Device) cmd(cmd byte, arg uint32) byte {
 	d.cs.Low()
 
 	if cmd != 12 {
-		d.waitNotBusy(300 * time.Millisecond)
+		if err := d.waitNotBusy(300 * time.Millisecond); err != nil {
+			d.cs.High()
+			return 0xFF // -1
+		}
 	}
 
 	// create and send the command
@@ -214,7 +408,7 @@ func (d Device) cmd(cmd byte, arg uint32, crc byte) byte {
 	buf[2] = byte(arg >> 16)
 	buf[3] = byte(arg >> 8)
 	buf[4] = byte(arg)
-	buf[5] = crc
+	buf[5] = crc7(buf[:5])<<1 | 0x01
 	d.bus.Tx(buf, nil)
 
 	if cmd == 12 {
@@ -223,7 +417,8 @@ func (d Device) cmd(cmd byte, arg uint32, crc byte) byte {
 	}
 
 	// wait for the response (response[7] == 0)
-	for i := 0; i < 0xFFFF; i++ {
+	tm := setTimeout(2, _CMD_TIMEOUT*time.Millisecond)
+	for !tm.expired() {
 		d.bus.Tx([]byte{0xFF}, d.tokenbuf)
 		response := d.tokenbuf[0]
 		if (response & 0x80) == 0 {
@@ -231,8 +426,7 @@ func (d Device) cmd(cmd byte, arg uint32, crc byte) byte {
 		}
 	}
 
-	// TODO
-	//// timeout
+	// timeout
 	d.cs.High()
 	d.bus.Transfer(byte(0xFF))
 
@@ -250,10 +444,12 @@ func (d Device) waitNotBusy(timeout time.Duration) error {
 			return nil
 		}
 	}
-	return nil
+	return ErrTimeout
 }
 
-func (d Device) waitStartBlock() error {
+// waitStartBlock waits for the start block token of block. A data error
+// token or timeout is returned as DataError.
+func (d Device) waitStartBlock(block uint32) error {
 	status := byte(0xFF)
 
 	tm := setTimeout(0, 300*time.Millisecond)
@@ -271,7 +467,7 @@ func (d Device) waitStartBlock() error {
 
 	if status != 254 {
 		d.cs.High()
-		return fmt.Errorf("SD_CARD_START_BLOCK")
+		return DataError{Block: block, Token: status}
 	}
 
 	return nil
@@ -288,27 +484,93 @@ func (d Device) readCID(csd []byte) error {
 }
 
 func (d Device) readRegister(cmd uint8, dst []byte) error {
-	if d.cmd(cmd, 0, 0xFF) != 0 {
-		return fmt.Errorf("SD_CARD_ERROR_READ_REG")
+	if err := d.cmdOK(cmd, 0); err != nil {
+		return err
+	}
+	return d.readRegisterData(dst[:16])
+}
+
+// readOCR reads the OCR using CMD58.
+func (d Device) readOCR(ocr []byte) error {
+	if err := d.cmdOK(CMD58_READ_OCR, 0); err != nil {
+		return err
 	}
-	if err := d.waitStartBlock(); err != nil {
+	for i := range ocr[:4] {
+		r, err := d.bus.Transfer(byte(0xFF))
+		if err != nil {
+			return err
+		}
+		ocr[i] = r
+	}
+	return nil
+}
+
+// readSCR reads the 8 bytes SCR using ACMD51.
+func (d Device) readSCR(scr []byte) error {
+	if err := d.acmdOK(ACMD51_SEND_SCR, 0); err != nil {
+		d.cs.High()
+		return err
+	}
+	return d.readRegisterData(scr[:8])
+}
+
+// readSDStatus reads the 64 bytes SD Status using ACMD13.
+func (d Device) readSDStatus(dst []byte) error {
+	if err := d.acmdOK(ACMD13_SD_STATUS, 0); err != nil {
+		d.cs.High()
+		return err
+	}
+	// skip second byte of R2 response
+	d.bus.Transfer(byte(0xFF))
+	return d.readRegisterData(dst[:64])
+}
+
+// readRegisterData receives the data block of a register read command.
+func (d Device) readRegisterData(dst []byte) error {
+	if err := d.waitStartBlock(0); err != nil {
 		return err
 	}
 	// transfer data
-	for i := uint16(0); i < 16; i++ {
+	for i := range dst {
 		r, err := d.bus.Transfer(byte(0xFF))
 		if err != nil {
 			return err
 		}
 		dst[i] = r
 	}
-	d.bus.Transfer(byte(0xFF))
-	d.bus.Transfer(byte(0xFF))
+	err := d.readCRC(0, dst)
 	d.cs.High()
 
+	return err
+}
+
+// readCRC receives the CRC16 following a data block and checks it against
+// data if CRC mode is enabled.
+func (d Device) readCRC(block uint32, data []byte) error {
+	hi, err := d.bus.Transfer(byte(0xFF))
+	if err != nil {
+		return err
+	}
+	lo, err := d.bus.Transfer(byte(0xFF))
+	if err != nil {
+		return err
+	}
+	if d.crc && (uint16(hi)<<8|uint16(lo)) != crc16(data) {
+		return CRCError{Block: block}
+	}
 	return nil
 }
 
+// writeCRC sends the CRC16 of data, or a dummy CRC if CRC mode is disabled.
+func (d Device) writeCRC(data []byte) {
+	crc := uint16(0xFFFF)
+	if d.crc {
+		crc = crc16(data)
+	}
+	d.bus.Transfer(byte(crc >> 8))
+	d.bus.Transfer(byte(crc))
+}
+
 // readData reads 512 bytes from sdcard into dst.
 func (d Device) readData(block uint32, dst []byte) error {
 	if len(dst) < 512 {
@@ -316,39 +578,132 @@ func (d Device) readData(block uint32, dst []byte) error {
 	}
 
 	// use address if not SDHC card
+	addr := block
 	if d.sdCardType != SD_CARD_TYPE_SDHC {
-		block <<= 9
+		addr <<= 9
 	}
-	if d.cmd(CMD17_READ_SINGLE_BLOCK, block, 0xFF) != 0 {
-		return fmt.Errorf("CMD17 error")
+	if err := d.cmdOK(CMD17_READ_SINGLE_BLOCK, addr); err != nil {
+		return err
 	}
-	if err := d.waitStartBlock(); err != nil {
-		return fmt.Errorf("waitStartBlock()")
+	if err := d.waitStartBlock(block); err != nil {
+		return err
 	}
 
-	err := d.bus.Tx([]byte{0xFF}, dst)
+	err := d.bus.Tx([]byte{0xFF}, dst[:512])
 	if err != nil {
 		return err
 	}
 
-	// skip CRC (2byte)
-	d.bus.Transfer(byte(0xFF))
-	d.bus.Transfer(byte(0xFF))
+	err = d.readCRC(block, dst[:512])
 
 	// TODO: probably not necessary
 	d.cs.High()
 
-	return nil
+	return err
 }
 
-// writeMultiStart starts the continuous write mode using CMD25.
-func (d Device) writeMultiStart(block uint32) error {
+// readMultiStart starts the continuous read mode using CMD18.
+func (d Device) readMultiStart(block uint32) error {
 	// use address if not SDHC card
 	if d.sdCardType != SD_CARD_TYPE_SDHC {
 		block <<= 9
 	}
-	if d.cmd(CMD25_WRITE_MULTIPLE_BLOCK, block, 0xFF) != 0 {
-		return fmt.Errorf("CMD25 error")
+	return d.cmdOK(CMD18_READ_MULTIPLE_BLOCK, block)
+}
+
+// readMulti performs continuous reading of 512 bytes of block into dst. It
+// is necessary to call readMultiStart() in prior.
+func (d Device) readMulti(block uint32, dst []byte) error {
+	if err := d.waitStartBlock(block); err != nil {
+		return err
+	}
+
+	err := d.bus.Tx([]byte{0xFF}, dst[:512])
+	if err != nil {
+		return err
+	}
+
+	return d.readCRC(block, dst[:512])
+}
+
+// readMultiStop exits the continuous read mode using CMD12.
+func (d Device) readMultiStop() error {
+	defer d.cs.High()
+
+	if err := d.cmdOK(CMD12_STOP_TRANSMISSION, 0); err != nil {
+		return err
+	}
+
+	return d.waitNotBusy(300 * time.Millisecond)
+}
+
+// readBlocks reads len(dst)/512 contiguous blocks into dst. A block failing
+// the CRC check is read again up to d.crcRetries times, at a lower clock if
+// the errors repeat.
+func (d *Device) readBlocks(block uint32, dst []byte) error {
+	count := uint32(len(dst) / 512)
+	done := uint32(0)
+	retry := 0
+	for {
+		n, err := d.readBlocksOnce(block+done, dst[done*512:count*512])
+		done += n
+		d.countError(err)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrCRC) {
+			return err
+		}
+		if n > 0 {
+			retry = 0
+		}
+		if retry >= d.crcRetries {
+			return err
+		}
+		retry++
+	}
+}
+
+// readBlocksOnce reads len(dst)/512 contiguous blocks into dst and returns
+// the number of blocks read before an error. A single block is read by
+// CMD17, otherwise CMD18 is used until CMD12 stops it.
+func (d Device) readBlocksOnce(block uint32, dst []byte) (uint32, error) {
+	count := uint32(len(dst) / 512)
+	if count == 1 {
+		if err := d.readData(block, dst); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+
+	if err := d.readMultiStart(block); err != nil {
+		return 0, err
+	}
+	for i := uint32(0); i < count; i++ {
+		if err := d.readMulti(block+i, dst[i*512:(i+1)*512]); err != nil {
+			d.readMultiStop()
+			return i, err
+		}
+	}
+
+	return count, d.readMultiStop()
+}
+
+// writeMultiStart starts the continuous write mode using CMD25. The card is
+// told by ACMD23 to pre-erase count blocks ahead of the write.
+func (d Device) writeMultiStart(block uint32, count uint32) error {
+	// use address if not SDHC card
+	if d.sdCardType != SD_CARD_TYPE_SDHC {
+		block <<= 9
+	}
+	// pre-erase (MMC has no application commands)
+	if d.sdCardType != SD_CARD_TYPE_MMC {
+		if err := d.acmdOK(ACMD23_SET_WR_BLK_ERASE_COUNT, count); err != nil {
+			return err
+		}
+	}
+	if err := d.cmdOK(CMD25_WRITE_MULTIPLE_BLOCK, block); err != nil {
+		return err
 	}
 
 	// skip 1 byte
@@ -357,36 +712,32 @@ func (d Device) writeMultiStart(block uint32) error {
 	return nil
 }
 
-// writeMulti performs continuous writing. It is necessary to call
-// writeMultiStart() in prior.
-func (d Device) writeMulti(buf []byte) error {
+// writeMulti performs continuous writing of buf to block. It is necessary
+// to call writeMultiStart() in prior.
+func (d Device) writeMulti(block uint32, buf []byte) error {
 	// send Data Token for CMD25
 	d.bus.Transfer(byte(0xFC))
 
-	for i := 0; i < 512; i++ {
-		_, err := d.bus.Transfer(buf[i])
-		if err != nil {
-			return err
-		}
+	err := d.bus.Tx(buf[:512], nil)
+	if err != nil {
+		return err
 	}
 
-	// send dummy CRC (2 byte)
-	d.bus.Transfer(byte(0xFF))
-	d.bus.Transfer(byte(0xFF))
+	d.writeCRC(buf[:512])
 
 	// Data Resp.
 	r, err := d.bus.Transfer(byte(0xFF))
 	if err != nil {
 		return err
 	}
-	if (r & 0x1F) != 0x05 {
-		return fmt.Errorf("SD_CARD_ERROR_WRITE")
+	if (r & _DATA_RES_MASK) != _DATA_RES_ACCEPTED {
+		return DataResponseError{Block: block, Token: r}
 	}
 
 	// wait no busy
 	err = d.waitNotBusy(600 * time.Millisecond)
 	if err != nil {
-		return fmt.Errorf("SD_CARD_ERROR_WRITE_TIMEOUT")
+		return err
 	}
 
 	return nil
@@ -402,12 +753,7 @@ func (d Device) writeMultiStop() error {
 	// skip 1 byte
 	d.bus.Transfer(byte(0xFF))
 
-	err := d.waitNotBusy(600 * time.Millisecond)
-	if err != nil {
-		return nil
-	}
-
-	return nil
+	return d.waitNotBusy(600 * time.Millisecond)
 }
 
 // writeData writes 512 bytes from dst to sdcard.
@@ -417,11 +763,12 @@ func (d Device) writeData(block uint32, src []byte) error {
 	}
 
 	// use address if not SDHC card
+	addr := block
 	if d.sdCardType != SD_CARD_TYPE_SDHC {
-		block <<= 9
+		addr <<= 9
 	}
-	if d.cmd(CMD24_WRITE_BLOCK, block, 0xFF) != 0 {
-		return fmt.Errorf("CMD24 error")
+	if err := d.cmdOK(CMD24_WRITE_BLOCK, addr); err != nil {
+		return err
 	}
 
 	// wait 1 byte?
@@ -433,23 +780,21 @@ func (d Device) writeData(block uint32, src []byte) error {
 		return err
 	}
 
-	// send dummy CRC (2 byte)
-	d.bus.Transfer(byte(0xFF))
-	d.bus.Transfer(byte(0xFF))
+	d.writeCRC(src[:512])
 
 	// Data Resp.
 	r, err := d.bus.Transfer(byte(0xFF))
 	if err != nil {
 		return err
 	}
-	if (r & 0x1F) != 0x05 {
-		return fmt.Errorf("SD_CARD_ERROR_WRITE")
+	if (r & _DATA_RES_MASK) != _DATA_RES_ACCEPTED {
+		return DataResponseError{Block: block, Token: r}
 	}
 
 	// wait no busy
 	err = d.waitNotBusy(600 * time.Millisecond)
 	if err != nil {
-		return fmt.Errorf("SD_CARD_ERROR_WRITE_TIMEOUT")
+		return err
 	}
 
 	// TODO: probably not necessary
@@ -457,16 +802,97 @@ func (d Device) writeData(block uint32, src []byte) error {
 	return nil
 }
 
+// writeBlocks writes len(src)/512 contiguous blocks from src. A block
+// rejected by the card for a CRC error is written again up to d.crcRetries
+// times, at a lower clock if the errors repeat.
+func (d *Device) writeBlocks(block uint32, src []byte) error {
+	count := uint32(len(src) / 512)
+	done := uint32(0)
+	retry := 0
+	for {
+		n, err := d.writeBlocksOnce(block+done, src[done*512:count*512])
+		done += n
+		d.countError(err)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrCRC) {
+			return err
+		}
+		if n > 0 {
+			retry = 0
+		}
+		if retry >= d.crcRetries {
+			return err
+		}
+		retry++
+	}
+}
+
+// writeBlocksOnce writes len(src)/512 contiguous blocks from src and returns
+// the number of blocks written before an error. A single block is written
+// by CMD24, otherwise CMD25 is used until the Stop Tran token.
+func (d Device) writeBlocksOnce(block uint32, src []byte) (uint32, error) {
+	count := uint32(len(src) / 512)
+	if count == 1 {
+		if err := d.writeData(block, src); err != nil {
+			return 0, d.withStatus(err)
+		}
+		return 1, nil
+	}
+
+	if err := d.writeMultiStart(block, count); err != nil {
+		return 0, err
+	}
+	for i := uint32(0); i < count; i++ {
+		if err := d.writeMulti(block+i, src[i*512:(i+1)*512]); err != nil {
+			d.writeMultiStop()
+			return i, d.withStatus(err)
+		}
+	}
+
+	return count, d.writeMultiStop()
+}
+
+// readStatus reads the card status using CMD13. The R1 response is in the
+// upper byte and the second byte of R2 in the lower byte.
+func (d Device) readStatus() (uint16, error) {
+	defer d.cs.High()
+
+	r1 := d.cmd(CMD13_SEND_STATUS, 0)
+	if r1 == 0xFF {
+		return 0, CommandError{Cmd: CMD13_SEND_STATUS, R1: r1}
+	}
+	r2, err := d.bus.Transfer(byte(0xFF))
+	if err != nil {
+		return 0, err
+	}
+	return uint16(r1)<<8 | uint16(r2), nil
+}
+
+// withStatus adds the card status to a write rejected for other reasons
+// than a CRC error, which tells e.g. a write protect violation.
+func (d Device) withStatus(err error) error {
+	e, ok := err.(DataResponseError)
+	if !ok || (e.Token&_DATA_RES_MASK) == _DATA_RES_CRC {
+		return err
+	}
+	if status, serr := d.readStatus(); serr == nil {
+		e.Status = status
+	}
+	return e
+}
+
 // ReadAt reads the given number of bytes from the sdcard.
 func (d *Device) ReadAt(buf []byte, addr int64) (int, error) {
+	if !d.Ready() {
+		return 0, ErrNoCard
+	}
 	d.bus.Lock()
 	defer d.bus.Unlock()
-	d.bus.SetBaudRate(FastFreq)
-	block := uint64(addr)
-	// use address if not SDHC card
-	if d.sdCardType == SD_CARD_TYPE_SDHC {
-		block >>= 9
-	}
+	d.bus.SetBaudRate(d.freq)
+	// block number (readData converts it to address if not SDHC card)
+	block := uint32(addr >> 9)
 
 	idx := uint32(0)
 
@@ -482,7 +908,7 @@ func (d *Device) ReadAt(buf []byte, addr int64) (int, error) {
 			end = 512
 		}
 
-		err := d.readData(uint32(block), d.dummybuf)
+		err := d.readBlocks(block, d.dummybuf)
 		if err != nil {
 			return 0, err
 		}
@@ -493,20 +919,18 @@ func (d *Device) ReadAt(buf []byte, addr int64) (int, error) {
 		block++
 	}
 
-	// If more than 512 bytes left
-	for 512 <= remain {
-		start = 0
-		end = 512
+	// If more than 512 bytes left, read aligned blocks directly into buf
+	if 512 <= remain {
+		count := remain / 512
 
-		err := d.readData(uint32(block), d.dummybuf)
+		err := d.readBlocks(block, buf[idx:idx+count*512])
 		if err != nil {
 			return 0, err
 		}
-		copy(buf[idx:], d.dummybuf[start:end])
 
-		remain -= end - start
-		idx += end - start
-		block++
+		remain -= count * 512
+		idx += count * 512
+		block += count
 	}
 
 	// Read to the end
@@ -514,7 +938,7 @@ func (d *Device) ReadAt(buf []byte, addr int64) (int, error) {
 		start = 0
 		end = remain
 
-		err := d.readData(uint32(block), d.dummybuf)
+		err := d.readBlocks(block, d.dummybuf)
 		if err != nil {
 			return 0, err
 		}
@@ -530,14 +954,17 @@ func (d *Device) ReadAt(buf []byte, addr int64) (int, error) {
 
 // WriteAt writes the given number of bytes to sdcard.
 func (d *Device) WriteAt(buf []byte, addr int64) (n int, err error) {
+	if !d.Ready() {
+		return 0, ErrNoCard
+	}
+	if d.WriteProtected() {
+		return 0, ErrWriteProtect
+	}
 	d.bus.Lock()
 	defer d.bus.Unlock()
-	d.bus.SetBaudRate(FastFreq)
-	block := uint64(addr)
-	// use address if not SDHC card
-	if d.sdCardType == SD_CARD_TYPE_SDHC {
-		block >>= 9
-	}
+	d.bus.SetBaudRate(d.freq)
+	// block number (writeData converts it to address if not SDHC card)
+	block := uint32(addr >> 9)
 
 	idx := uint32(0)
 
@@ -553,13 +980,13 @@ func (d *Device) WriteAt(buf []byte, addr int64) (n int, err error) {
 			end = 512
 		}
 
-		err := d.readData(uint32(block), d.dummybuf)
+		err := d.readBlocks(block, d.dummybuf)
 		if err != nil {
 			return 0, err
 		}
 		copy(d.dummybuf[start:end], buf[idx:])
 
-		err = d.writeData(uint32(block), d.dummybuf)
+		err = d.writeBlocks(block, d.dummybuf)
 		if err != nil {
 			return 0, err
 		}
@@ -569,19 +996,18 @@ func (d *Device) WriteAt(buf []byte, addr int64) (n int, err error) {
 		block++
 	}
 
-	// If more than 512 bytes left
-	for 512 <= remain {
-		start = 0
-		end = 512
+	// If more than 512 bytes left, write aligned blocks directly from buf
+	if 512 <= remain {
+		count := remain / 512
 
-		err := d.writeData(uint32(block), buf[idx:idx+512])
+		err := d.writeBlocks(block, buf[idx:idx+count*512])
 		if err != nil {
 			return 0, err
 		}
 
-		remain -= end - start
-		idx += end - start
-		block++
+		remain -= count * 512
+		idx += count * 512
+		block += count
 	}
 
 	// Write to the end
@@ -589,13 +1015,13 @@ func (d *Device) WriteAt(buf []byte, addr int64) (n int, err error) {
 		start = 0
 		end = remain
 
-		err := d.readData(uint32(block), d.dummybuf)
+		err := d.readBlocks(block, d.dummybuf)
 		if err != nil {
 			return 0, err
 		}
 		copy(d.dummybuf[start:end], buf[idx:])
 
-		err = d.writeData(uint32(block), d.dummybuf)
+		err = d.writeBlocks(block, d.dummybuf)
 		if err != nil {
 			return 0, err
 		}
@@ -620,25 +1046,86 @@ func (d *Device) WriteBlockSize() int64 {
 }
 
 // EraseBlockSize returns the smallest erasable area on this sdcard in bytes.
+// It is the allocation unit (AU) size reported by SD Status, or the erase
+// sector size of the CSD if the card does not report one.
 func (d *Device) EraseBlockSize() int64 {
-	return 512
+	if d.eraseSize == 0 {
+		return 512
+	}
+	return d.eraseSize
 }
 
-// EraseBlocks erases the given number of blocks.
+// EraseBlocks erases the given number of blocks of EraseBlockSize() bytes.
 func (d *Device) EraseBlocks(start, len int64) error {
+	n := d.EraseBlockSize() / 512
+	return d.eraseSectors(start*n, len*n)
+}
+
+// Trim erases the 512 bytes sectors in the n bytes at offset off. Unlike
+// EraseBlocks it is not limited to EraseBlockSize() granularity, so that a
+// file system can discard the clusters of deleted files.
+func (d *Device) Trim(off, n int64) error {
+	return d.eraseSectors(off>>9, n>>9)
+}
+
+// eraseSectors erases count sectors from start using CMD32, CMD33 and CMD38.
+func (d *Device) eraseSectors(start, count int64) error {
+	if count <= 0 {
+		return nil
+	}
+	if !d.Ready() {
+		return ErrNoCard
+	}
+	if d.WriteProtected() {
+		return ErrWriteProtect
+	}
+
 	d.bus.Lock()
 	defer d.bus.Unlock()
-	d.bus.SetBaudRate(FastFreq)
-	d.writeMultiStart(uint32(start))
+	d.bus.SetBaudRate(d.freq)
+	if d.sdCardType == SD_CARD_TYPE_MMC {
+		// MMC has erase groups (CMD35/CMD36) instead, overwrite the sectors
+		return d.zeroBlocks(uint32(start), uint32(count))
+	}
+	defer d.cs.High()
+
+	// use address if not SDHC card
+	first, last := uint32(start), uint32(start+count-1)
+	if d.sdCardType != SD_CARD_TYPE_SDHC {
+		first <<= 9
+		last <<= 9
+	}
+	if err := d.cmdOK(CMD32_ERASE_WR_BLK_START_ADDR, first); err != nil {
+		return err
+	}
+	if err := d.cmdOK(CMD33_ERASE_WR_BLK_END_ADDR, last); err != nil {
+		return err
+	}
+	if err := d.cmdOK(CMD38_ERASE, 0); err != nil {
+		return err
+	}
+
+	// R1b: busy until the erase is done
+	units := count*512/d.EraseBlockSize() + 1
+	return d.waitNotBusy(time.Duration(units) * _ERASE_TIMEOUT * time.Millisecond)
+}
+
+// zeroBlocks overwrites count blocks from start with zeros using CMD25.
+func (d Device) zeroBlocks(start, count uint32) error {
+	if err := d.writeMultiStart(start, count); err != nil {
+		return err
+	}
 
 	for i := range d.dummybuf {
 		d.dummybuf[i] = 0
 	}
 
-	for i := 0; i < int(len); i++ {
-		d.writeMulti(d.dummybuf)
+	for i := uint32(0); i < count; i++ {
+		if err := d.writeMulti(start+i, d.dummybuf); err != nil {
+			d.writeMultiStop()
+			return err
+		}
 	}
 
-	d.writeMultiStop()
-	return nil
+	return d.writeMultiStop()
 }
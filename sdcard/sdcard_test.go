@@ -0,0 +1,1056 @@
+package sdcard
+
+import (
+	"errors"
+	"fmt"
+	"machine"
+	"testing"
+)
+
+// fakeCard is a scripted SPI peer. It decodes the command frames sent by
+// the driver, logs them together with the data tokens it answers with, and
+// queues the response bytes the driver clocks out afterwards.
+type fakeCard struct {
+	byteAddr  bool // standard capacity card (argument is byte address)
+	sd1       bool // CMD8 is illegal
+	mmc       bool // CMD8, CMD55 and ACMD41 are illegal
+	csd       []byte
+	scr       []byte         // SCR (ACMD51)
+	status    []byte         // SD Status (ACMD13)
+	crc       bool           // CMD59 turned CRC checking on
+	corrupt   map[uint32]int // number of times a block is sent with bad CRC
+	reject    map[uint32]int // number of times a written block is rejected
+	wp        bool           // card is write protected
+	count     uint32         // number of blocks (address error beyond, 0: unlimited)
+	mute      bool           // card never answers
+	highSpeed bool           // CMD6 supports high speed mode
+	freq      uint32         // SPI clock set by the driver
+	blockLen  uint32         // set by CMD16
+	password  []byte
+	locked    bool
+	lockFail  bool   // last CMD42 failed
+	wpGroups  uint32 // write protect groups of 64 blocks
+	stuck     bool   // card stays busy after a write
+	busy      bool
+	miso      []byte
+	frame     []byte
+	log       []string
+	reading   bool
+	next      uint32
+	erase     [2]uint32 // erase range set by CMD32 and CMD33
+	app       bool      // previous command was CMD55
+	writing   byte      // CMD24 or CMD25 while data blocks are accepted
+	data      []byte    // data block being received
+	blocks    map[uint32][]byte
+}
+
+func (f *fakeCard) Lock()                       {}
+func (f *fakeCard) Unlock()                     {}
+func (f *fakeCard) SetBaudRate(br uint32) error { f.freq = br; return nil }
+
+func (f *fakeCard) Transfer(w byte) (byte, error) {
+	// stream the next block while the driver clocks idle bytes
+	if len(f.miso) == 0 && len(f.frame) == 0 && f.reading && w == 0xFF {
+		f.queueBlock(f.next)
+		f.next++
+	}
+	r := byte(0xFF)
+	if f.busy && len(f.miso) == 0 {
+		r = 0x00
+	} else if len(f.miso) > 0 {
+		r = f.miso[0]
+		f.miso = f.miso[1:]
+	}
+	if !f.mute {
+		f.receive(w)
+	}
+	return r, nil
+}
+
+func (f *fakeCard) Tx(w, r []byte) error {
+	switch {
+	case w == nil:
+		for i := range r {
+			r[i], _ = f.Transfer(0)
+		}
+	case r == nil:
+		for _, b := range w {
+			f.Transfer(b)
+		}
+	case len(w) == 1 && len(r) > 1:
+		for i := range r {
+			r[i], _ = f.Transfer(w[0])
+		}
+	default:
+		for i := range w {
+			r[i], _ = f.Transfer(w[i])
+		}
+	}
+	return nil
+}
+
+func (f *fakeCard) receive(w byte) {
+	if f.data != nil {
+		f.receiveData(w)
+		return
+	}
+	if f.writing != 0 && len(f.frame) == 0 {
+		switch {
+		case w == 0xFE && f.writing == CMD24_WRITE_BLOCK, w == 0xFC && f.writing == CMD25_WRITE_MULTIPLE_BLOCK:
+			f.data = make([]byte, 0, 514)
+			return
+		case w == 0xFE && f.writing == CMD42_LOCK_UNLOCK:
+			f.data = make([]byte, 0, f.blockLen+2)
+			return
+		case w == 0xFE && f.writing == CMD27_PROGRAM_CSD:
+			f.data = make([]byte, 0, 16+2)
+			return
+		case w == 0xFD && f.writing == CMD25_WRITE_MULTIPLE_BLOCK:
+			f.log = append(f.log, "STOP")
+			f.writing = 0
+			// stuff byte, then busy for a byte
+			f.miso = append(f.miso, 0xFF, 0x00)
+			return
+		}
+	}
+	if len(f.frame) == 0 && (w&0xC0) != 0x40 {
+		return
+	}
+	f.frame = append(f.frame, w)
+	if len(f.frame) < 6 {
+		return
+	}
+	cmd := f.frame[0] & 0x3F
+	arg := uint32(f.frame[1])<<24 | uint32(f.frame[2])<<16 | uint32(f.frame[3])<<8 | uint32(f.frame[4])
+	if f.crc && f.frame[5] != crc7(f.frame[:5])<<1|0x01 {
+		f.frame = f.frame[:0]
+		f.miso = append(f.miso, 0xFF, _R1_COM_CRC_ERROR)
+		return
+	}
+	f.frame = f.frame[:0]
+	block := arg
+	if f.byteAddr {
+		block >>= 9
+	}
+
+	if f.app {
+		f.app = false
+		f.log = append(f.log, fmt.Sprintf("ACMD%d(%d)", cmd, arg))
+		switch cmd {
+		case ACMD13_SD_STATUS:
+			status := make([]byte, 64)
+			copy(status, f.status)
+			crc := crc16(status)
+			// R2 response
+			f.miso = append(f.miso, 0xFF, 0x00, 0x00, 0xFF, 0xFE)
+			f.miso = append(f.miso, status...)
+			f.miso = append(f.miso, byte(crc>>8), byte(crc))
+			return
+		case ACMD51_SEND_SCR:
+			scr := make([]byte, 8)
+			copy(scr, f.scr)
+			crc := crc16(scr)
+			f.miso = append(f.miso, 0xFF, 0x00, 0xFF, 0xFE)
+			f.miso = append(f.miso, scr...)
+			f.miso = append(f.miso, byte(crc>>8), byte(crc))
+			return
+		}
+		f.miso = append(f.miso, 0xFF, 0x00)
+		return
+	}
+
+	if f.locked {
+		switch cmd {
+		case CMD17_READ_SINGLE_BLOCK, CMD18_READ_MULTIPLE_BLOCK, CMD24_WRITE_BLOCK, CMD25_WRITE_MULTIPLE_BLOCK:
+			f.log = append(f.log, fmt.Sprintf("CMD%d(%d)", cmd, block))
+			f.miso = append(f.miso, 0xFF, _R1_ILLEGAL_COMMAND)
+			return
+		}
+	}
+
+	switch cmd {
+	case CMD0_GO_IDLE_STATE:
+		f.log = append(f.log, "CMD0")
+		f.miso = append(f.miso, 0xFF, _R1_IDLE_STATE)
+	case CMD8_SEND_IF_COND:
+		f.log = append(f.log, "CMD8")
+		if f.sd1 || f.mmc {
+			f.miso = append(f.miso, 0xFF, _R1_IDLE_STATE|_R1_ILLEGAL_COMMAND)
+		} else {
+			f.miso = append(f.miso, 0xFF, _R1_IDLE_STATE, 0x00, 0x00, 0x01, 0xAA)
+		}
+	case CMD55_APP_CMD:
+		if f.mmc {
+			f.miso = append(f.miso, 0xFF, _R1_IDLE_STATE|_R1_ILLEGAL_COMMAND)
+			return
+		}
+		f.app = true
+		f.miso = append(f.miso, 0xFF, _R1_IDLE_STATE)
+	case ACMD41_SD_APP_OP_COND:
+		// only reached by MMC, which has no CMD55
+		f.log = append(f.log, "CMD41")
+		f.miso = append(f.miso, 0xFF, _R1_IDLE_STATE|_R1_ILLEGAL_COMMAND)
+	case CMD58_READ_OCR:
+		f.log = append(f.log, "CMD58")
+		ocr := byte(0x80)
+		if !f.byteAddr {
+			ocr |= 0x40
+		}
+		f.miso = append(f.miso, 0xFF, 0x00, ocr, 0xFF, 0x80, 0x00)
+	case CMD9_SEND_CSD, CMD10_SEND_CID:
+		f.log = append(f.log, fmt.Sprintf("CMD%d", cmd))
+		reg := make([]byte, 16)
+		if cmd == CMD9_SEND_CSD {
+			reg = f.csd
+		}
+		crc := crc16(reg)
+		f.miso = append(f.miso, 0xFF, 0x00, 0xFF, 0xFE)
+		f.miso = append(f.miso, reg...)
+		f.miso = append(f.miso, byte(crc>>8), byte(crc))
+	case CMD6_SWITCH_FUNC:
+		f.log = append(f.log, fmt.Sprintf("CMD6(%08X)", arg))
+		status := make([]byte, 64)
+		if f.highSpeed {
+			// group 1 supports function 1, which is selected
+			status[13] = 0x03
+			status[16] = byte(arg & 0x0F)
+		}
+		crc := crc16(status)
+		f.miso = append(f.miso, 0xFF, 0x00, 0xFF, 0xFE)
+		f.miso = append(f.miso, status...)
+		f.miso = append(f.miso, byte(crc>>8), byte(crc))
+	case CMD59_CRC_ON_OFF:
+		f.log = append(f.log, fmt.Sprintf("CMD59(%d)", arg))
+		f.crc = arg&0x01 != 0
+		f.miso = append(f.miso, 0xFF, 0x00)
+	case CMD13_SEND_STATUS:
+		f.log = append(f.log, "CMD13")
+		status := byte(0)
+		if f.wp {
+			status |= _R2_WP_VIOLATION
+		}
+		if f.locked {
+			status |= _R2_CARD_LOCKED
+		}
+		if f.lockFail {
+			status |= _R2_WP_ERASE_SKIP
+			f.lockFail = false
+		}
+		f.miso = append(f.miso, 0xFF, 0x00, status)
+	case CMD12_STOP_TRANSMISSION:
+		f.log = append(f.log, "CMD12")
+		f.reading = false
+		// stuff byte, R1, then busy for a byte
+		f.miso = []byte{0xFF, 0x00, 0x00}
+	case CMD17_READ_SINGLE_BLOCK:
+		if f.count > 0 && block >= f.count {
+			f.log = append(f.log, fmt.Sprintf("CMD17(%d)", block))
+			f.miso = append(f.miso, 0xFF, _R1_ADDRESS_ERROR)
+			return
+		}
+		f.log = append(f.log, fmt.Sprintf("CMD17(%d)", block))
+		f.miso = append(f.miso, 0xFF, 0x00)
+		f.queueBlock(block)
+	case CMD18_READ_MULTIPLE_BLOCK:
+		f.log = append(f.log, fmt.Sprintf("CMD18(%d)", block))
+		f.miso = append(f.miso, 0xFF, 0x00)
+		f.reading = true
+		f.next = block
+	case CMD24_WRITE_BLOCK, CMD25_WRITE_MULTIPLE_BLOCK:
+		f.log = append(f.log, fmt.Sprintf("CMD%d(%d)", cmd, block))
+		f.miso = append(f.miso, 0xFF, 0x00)
+		f.writing = cmd
+		f.next = block
+	case CMD16_SET_BLOCKLEN:
+		f.log = append(f.log, "CMD16")
+		f.blockLen = arg
+		f.miso = append(f.miso, 0xFF, 0x00)
+	case CMD42_LOCK_UNLOCK, CMD27_PROGRAM_CSD:
+		f.miso = append(f.miso, 0xFF, 0x00)
+		f.writing = cmd
+	case CMD28_SET_WRITE_PROT, CMD29_CLR_WRITE_PROT:
+		f.log = append(f.log, fmt.Sprintf("CMD%d(%d)", cmd, block))
+		if cmd == CMD28_SET_WRITE_PROT {
+			f.wpGroups |= 1 << (block / 64)
+		} else {
+			f.wpGroups &^= 1 << (block / 64)
+		}
+		// R1, then busy for a byte
+		f.miso = append(f.miso, 0xFF, 0x00, 0x00)
+	case CMD30_SEND_WRITE_PROT:
+		f.log = append(f.log, fmt.Sprintf("CMD30(%d)", block))
+		groups := f.wpGroups >> (block / 64)
+		reg := []byte{byte(groups >> 24), byte(groups >> 16), byte(groups >> 8), byte(groups)}
+		crc := crc16(reg)
+		f.miso = append(f.miso, 0xFF, 0x00, 0xFF, 0xFE)
+		f.miso = append(f.miso, reg...)
+		f.miso = append(f.miso, byte(crc>>8), byte(crc))
+	case CMD32_ERASE_WR_BLK_START_ADDR, CMD33_ERASE_WR_BLK_END_ADDR:
+		f.log = append(f.log, fmt.Sprintf("CMD%d(%d)", cmd, block))
+		f.erase[cmd-CMD32_ERASE_WR_BLK_START_ADDR] = block
+		f.miso = append(f.miso, 0xFF, 0x00)
+	case CMD38_ERASE:
+		f.log = append(f.log, "CMD38")
+		if f.blocks == nil {
+			f.blocks = map[uint32][]byte{}
+		}
+		for b := f.erase[0]; b <= f.erase[1]; b++ {
+			f.blocks[b] = make([]byte, 512)
+		}
+		// R1, then busy for a byte
+		f.miso = append(f.miso, 0xFF, 0x00, 0x00)
+		f.busy = f.stuck
+	default:
+		f.log = append(f.log, fmt.Sprintf("CMD%d", cmd))
+		f.miso = append(f.miso, 0xFF, 0x00)
+	}
+}
+
+func (f *fakeCard) receiveData(w byte) {
+	f.data = append(f.data, w)
+	if len(f.data) < cap(f.data) {
+		return
+	}
+	switch f.writing {
+	case CMD42_LOCK_UNLOCK:
+		f.receiveLock()
+		return
+	case CMD27_PROGRAM_CSD:
+		f.log = append(f.log, "CMD27")
+		if f.data[15] != crc7(f.data[:15])<<1|0x01 {
+			// CSD CRC error, then busy for a byte
+			f.miso = append(f.miso, 0x0D, 0x00)
+		} else {
+			f.csd = f.data[:16]
+			f.miso = append(f.miso, 0x05, 0x00)
+		}
+		f.data = nil
+		f.writing = 0
+		return
+	}
+	f.log = append(f.log, fmt.Sprintf("DATA(%d)", f.next))
+	if f.blocks == nil {
+		f.blocks = map[uint32][]byte{}
+	}
+	if f.writing == CMD24_WRITE_BLOCK {
+		f.writing = 0
+	}
+	crc := uint16(f.data[512])<<8 | uint16(f.data[513])
+	rejected := f.crc && crc != crc16(f.data[:512])
+	if f.reject[f.next] > 0 {
+		f.reject[f.next]--
+		rejected = true
+	}
+	if rejected {
+		f.data = nil
+		// data rejected due to a CRC error
+		f.miso = append(f.miso, 0x0B)
+		return
+	}
+	if f.wp {
+		f.data = nil
+		// data rejected due to a write error, then busy for a byte
+		f.miso = append(f.miso, 0x0D, 0x00)
+		return
+	}
+	f.blocks[f.next] = f.data[:512]
+	f.data = nil
+	f.next++
+	// data accepted, then busy for a byte
+	f.miso = append(f.miso, 0x05, 0x00)
+	f.busy = f.stuck
+}
+
+// receiveLock handles the lock card data structure of CMD42.
+func (f *fakeCard) receiveLock() {
+	flags, pwd := f.data[0], string(f.data[2:2+f.data[1]])
+	f.log = append(f.log, fmt.Sprintf("CMD42(%X)", flags))
+	f.data = nil
+	f.writing = 0
+	old := string(f.password)
+	switch {
+	case flags&_LOCK_SET_PWD != 0 && len(pwd) > len(old) && pwd[:len(old)] == old:
+		f.password = []byte(pwd[len(old):])
+		f.locked = flags&_LOCK_LOCK_UNLOCK != 0
+	case flags == _LOCK_CLR_PWD && pwd == old:
+		f.password = nil
+		f.locked = false
+	case flags == _LOCK_LOCK_UNLOCK && old != "" && pwd == old:
+		f.locked = true
+	case flags == 0 && old != "" && pwd == old:
+		f.locked = false
+	default:
+		f.lockFail = true
+	}
+	// data accepted, then busy for a byte
+	f.miso = append(f.miso, 0x05, 0x00)
+}
+
+func (f *fakeCard) queueBlock(block uint32) {
+	f.log = append(f.log, fmt.Sprintf("BLOCK(%d)", block))
+	data, ok := f.blocks[block]
+	if !ok {
+		data = blockPattern(block)
+	}
+	crc := crc16(data)
+	if f.corrupt[block] > 0 {
+		f.corrupt[block]--
+		crc = ^crc
+	}
+	f.miso = append(f.miso, 0xFF, 0xFE)
+	f.miso = append(f.miso, data...)
+	f.miso = append(f.miso, byte(crc>>8), byte(crc))
+}
+
+func blockPattern(block uint32) []byte {
+	buf := make([]byte, 512)
+	for i := range buf {
+		buf[i] = byte(block*7) + byte(i)
+	}
+	return buf
+}
+
+func newTestDevice(card *fakeCard) *Device {
+	d := New(card, machine.NoPin)
+	d.sdCardType = SD_CARD_TYPE_SDHC
+	if card.byteAddr {
+		d.sdCardType = SD_CARD_TYPE_SD2
+	}
+	return &d
+}
+
+func expectLog(t *testing.T, card *fakeCard, expected ...string) {
+	t.Helper()
+	if fmt.Sprint(card.log) != fmt.Sprint(expected) {
+		t.Fatalf("expected token sequence %v, was actually %v", expected, card.log)
+	}
+}
+
+func expectBlocks(t *testing.T, buf []byte, addr int64) {
+	t.Helper()
+	for i := range buf {
+		pos := addr + int64(i)
+		if want := blockPattern(uint32(pos / 512))[pos%512]; buf[i] != want {
+			t.Fatalf("byte at %d: expected %02X, was actually %02X", pos, want, buf[i])
+		}
+	}
+}
+
+func TestReadAt(t *testing.T) {
+	t.Run("SingleBlock", func(t *testing.T) {
+		card := &fakeCard{}
+		d := newTestDevice(card)
+		buf := make([]byte, 512)
+		n, err := d.ReadAt(buf, 3*512)
+		if err != nil || n != len(buf) {
+			t.Fatal(n, err)
+		}
+		expectLog(t, card, "CMD17(3)", "BLOCK(3)")
+		expectBlocks(t, buf, 3*512)
+	})
+	t.Run("MultiBlock", func(t *testing.T) {
+		card := &fakeCard{}
+		d := newTestDevice(card)
+		buf := make([]byte, 4*512)
+		n, err := d.ReadAt(buf, 10*512)
+		if err != nil || n != len(buf) {
+			t.Fatal(n, err)
+		}
+		expectLog(t, card, "CMD18(10)", "BLOCK(10)", "BLOCK(11)", "BLOCK(12)", "BLOCK(13)", "CMD12")
+		expectBlocks(t, buf, 10*512)
+	})
+	t.Run("Unaligned", func(t *testing.T) {
+		card := &fakeCard{}
+		d := newTestDevice(card)
+		buf := make([]byte, 3*512)
+		n, err := d.ReadAt(buf, 10*512+100)
+		if err != nil || n != len(buf) {
+			t.Fatal(n, err)
+		}
+		expectLog(t, card, "CMD17(10)", "BLOCK(10)", "CMD18(11)", "BLOCK(11)", "BLOCK(12)", "CMD12", "CMD17(13)", "BLOCK(13)")
+		expectBlocks(t, buf, 10*512+100)
+	})
+	t.Run("StandardCapacity", func(t *testing.T) {
+		card := &fakeCard{byteAddr: true}
+		d := newTestDevice(card)
+		buf := make([]byte, 2*512)
+		n, err := d.ReadAt(buf, 5*512)
+		if err != nil || n != len(buf) {
+			t.Fatal(n, err)
+		}
+		expectLog(t, card, "CMD18(5)", "BLOCK(5)", "BLOCK(6)", "CMD12")
+		expectBlocks(t, buf, 5*512)
+	})
+}
+
+func TestWriteAt(t *testing.T) {
+	pattern := func(n int) []byte {
+		buf := make([]byte, n)
+		for i := range buf {
+			buf[i] = byte(i*3 + 1)
+		}
+		return buf
+	}
+	expectWritten := func(t *testing.T, card *fakeCard, buf []byte, addr int64) {
+		t.Helper()
+		for i := range buf {
+			pos := addr + int64(i)
+			if got := card.blocks[uint32(pos/512)][pos%512]; got != buf[i] {
+				t.Fatalf("byte at %d: expected %02X, was actually %02X", pos, buf[i], got)
+			}
+		}
+	}
+
+	t.Run("SingleBlock", func(t *testing.T) {
+		card := &fakeCard{}
+		d := newTestDevice(card)
+		buf := pattern(512)
+		n, err := d.WriteAt(buf, 7*512)
+		if err != nil || n != len(buf) {
+			t.Fatal(n, err)
+		}
+		expectLog(t, card, "CMD24(7)", "DATA(7)")
+		expectWritten(t, card, buf, 7*512)
+	})
+	t.Run("MultiBlock", func(t *testing.T) {
+		card := &fakeCard{}
+		d := newTestDevice(card)
+		buf := pattern(4 * 512)
+		n, err := d.WriteAt(buf, 20*512)
+		if err != nil || n != len(buf) {
+			t.Fatal(n, err)
+		}
+		expectLog(t, card, "ACMD23(4)", "CMD25(20)", "DATA(20)", "DATA(21)", "DATA(22)", "DATA(23)", "STOP")
+		expectWritten(t, card, buf, 20*512)
+	})
+	t.Run("Unaligned", func(t *testing.T) {
+		card := &fakeCard{}
+		d := newTestDevice(card)
+		buf := pattern(3 * 512)
+		n, err := d.WriteAt(buf, 20*512+100)
+		if err != nil || n != len(buf) {
+			t.Fatal(n, err)
+		}
+		expectLog(t, card,
+			"CMD17(20)", "BLOCK(20)", "CMD24(20)", "DATA(20)",
+			"ACMD23(2)", "CMD25(21)", "DATA(21)", "DATA(22)", "STOP",
+			"CMD17(23)", "BLOCK(23)", "CMD24(23)", "DATA(23)")
+		expectWritten(t, card, buf, 20*512+100)
+		// bytes outside of buf are preserved by read-modify-write
+		expectBlocks(t, card.blocks[20][:100], 20*512)
+		expectBlocks(t, card.blocks[23][100:], 23*512+100)
+	})
+}
+
+var (
+	// 2GB standard capacity card: C_SIZE=0xF13, C_SIZE_MULT=7, READ_BL_LEN=10
+	testCSDv1 = []byte{0x00, 0x26, 0x00, 0x32, 0x5F, 0x5A, 0x83, 0xC4, 0xFF, 0xFF, 0xCF, 0xFF, 0x92, 0x80, 0x40, 0xDF}
+	// 8GB high capacity card: C_SIZE=0x3B37
+	testCSDv2 = []byte{0x40, 0x0E, 0x00, 0x32, 0x5B, 0x59, 0x00, 0x00, 0x3B, 0x37, 0x7F, 0x80, 0x0A, 0x40, 0x00, 0x8B}
+)
+
+func TestCSD(t *testing.T) {
+	t.Run("Version1", func(t *testing.T) {
+		csd := NewCSD(testCSDv1)
+		if csd.C_SIZE != 0xF13 || csd.C_SIZE_MULT != 7 || csd.READ_BL_LEN != 10 {
+			t.Fatalf("C_SIZE %X, C_SIZE_MULT %X, READ_BL_LEN %X", csd.C_SIZE, csd.C_SIZE_MULT, csd.READ_BL_LEN)
+		}
+		sectors, err := csd.Sectors()
+		if err != nil || sectors != 0xF14*512*2 {
+			t.Fatal(sectors, err)
+		}
+		if csd.Size() != 0xF14*512*1024 {
+			t.Fatal(csd.Size())
+		}
+	})
+	t.Run("Version2", func(t *testing.T) {
+		csd := NewCSD(testCSDv2)
+		sectors, err := csd.Sectors()
+		if err != nil || sectors != 0x3B38*1024 {
+			t.Fatal(sectors, err)
+		}
+		if csd.Size() != 0x3B38*512*1024 {
+			t.Fatal(csd.Size())
+		}
+	})
+}
+
+var (
+	// spec version 5.0, 1 and 4 bit bus, CMD23 supported
+	testSCR = []byte{0x02, 0x35, 0x84, 0x43, 0x00, 0x00, 0x00, 0x00}
+	// class 10, U1, 4MB AU, protected area 0x50000
+	testSDStatus = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x05, 0x00, 0x00, 0x04, 0x00, 0x90, 0x00, 0x08, 0x0A, 0x11, 0x06, 0x02, 0x00}
+)
+
+func TestRegisters(t *testing.T) {
+	t.Run("OCR", func(t *testing.T) {
+		ocr := NewOCR([]byte{0xC0, 0xFF, 0x80, 0x00})
+		if ocr.BUSY != 1 || ocr.CCS != 1 || ocr.UHS2 != 0 || ocr.VDD_WINDOW != 0x1FF {
+			t.Fatalf("BUSY %X, CCS %X, UHS2 %X, VDD_WINDOW %X", ocr.BUSY, ocr.CCS, ocr.UHS2, ocr.VDD_WINDOW)
+		}
+	})
+	t.Run("SCR", func(t *testing.T) {
+		scr := NewSCR(testSCR)
+		if scr.SD_SECURITY != 3 || !scr.BusWidth4() || scr.CMD_SUPPORT != 3 {
+			t.Fatalf("SD_SECURITY %X, SD_BUS_WIDTHS %X, CMD_SUPPORT %X", scr.SD_SECURITY, scr.SD_BUS_WIDTHS, scr.CMD_SUPPORT)
+		}
+		expectString(t, "5.0", scr.Version())
+		expectString(t, "2.0", NewSCR([]byte{0x02, 0x25, 0x00, 0x00}).Version())
+		expectString(t, "1.1", NewSCR([]byte{0x01, 0x25, 0x00, 0x00}).Version())
+	})
+	t.Run("SDStatus", func(t *testing.T) {
+		status := NewSDStatus(append(testSDStatus, make([]byte, 64-len(testSDStatus))...))
+		if status.SpeedClass() != 10 || status.UHS_SPEED_GRADE != 1 || status.VIDEO_SPEED_CLASS != 6 {
+			t.Fatalf("SPEED_CLASS %X, UHS_SPEED_GRADE %X, VIDEO_SPEED_CLASS %X", status.SPEED_CLASS, status.UHS_SPEED_GRADE, status.VIDEO_SPEED_CLASS)
+		}
+		if status.AUSize() != 4*1024*1024 || status.SIZE_OF_PROTECTED_AREA != 0x50000 {
+			t.Fatalf("AU_SIZE %X, SIZE_OF_PROTECTED_AREA %X", status.AU_SIZE, status.SIZE_OF_PROTECTED_AREA)
+		}
+		if status.ERASE_SIZE != 8 || status.ERASE_TIMEOUT != 2 || status.ERASE_OFFSET != 2 || status.VSC_AU_SIZE != 0x200 {
+			t.Fatalf("ERASE_SIZE %X, ERASE_TIMEOUT %X, ERASE_OFFSET %X, VSC_AU_SIZE %X", status.ERASE_SIZE, status.ERASE_TIMEOUT, status.ERASE_OFFSET, status.VSC_AU_SIZE)
+		}
+	})
+}
+
+func TestInitCard(t *testing.T) {
+	t.Run("SD1", func(t *testing.T) {
+		card := &fakeCard{sd1: true, byteAddr: true, csd: testCSDv1}
+		d := New(card, machine.NoPin)
+		if err := d.Configure(); err != nil {
+			t.Fatal(err)
+		}
+		if d.sdCardType != SD_CARD_TYPE_SD1 {
+			t.Fatalf("expected card type %d, was actually %d", SD_CARD_TYPE_SD1, d.sdCardType)
+		}
+		expectLog(t, card, "CMD0", "CMD8", "ACMD41(0)", "CMD58", "CMD16", "CMD10", "CMD9", "CMD13", "ACMD51(0)", "ACMD13(0)")
+		if d.Size() != 0xF14*512*1024 {
+			t.Fatal(d.Size())
+		}
+		// no AU size, erase sector size of CSD
+		if d.EraseBlockSize() != 32*1024 {
+			t.Fatal(d.EraseBlockSize())
+		}
+	})
+	t.Run("MMC", func(t *testing.T) {
+		card := &fakeCard{mmc: true, byteAddr: true, csd: testCSDv1}
+		d := New(card, machine.NoPin)
+		if err := d.Configure(); err != nil {
+			t.Fatal(err)
+		}
+		if d.sdCardType != SD_CARD_TYPE_MMC {
+			t.Fatalf("expected card type %d, was actually %d", SD_CARD_TYPE_MMC, d.sdCardType)
+		}
+		expectLog(t, card, "CMD0", "CMD8", "CMD41", "CMD1", "CMD58", "CMD16", "CMD10", "CMD9", "CMD13")
+		if d.SCR != nil || d.SDStatus != nil {
+			t.Fatal("MMC has no SCR and SD Status")
+		}
+	})
+	t.Run("SDHC", func(t *testing.T) {
+		card := &fakeCard{csd: testCSDv2, scr: testSCR, status: testSDStatus}
+		d := New(card, machine.NoPin)
+		if err := d.Configure(); err != nil {
+			t.Fatal(err)
+		}
+		if d.sdCardType != SD_CARD_TYPE_SDHC {
+			t.Fatalf("expected card type %d, was actually %d", SD_CARD_TYPE_SDHC, d.sdCardType)
+		}
+		expectLog(t, card, "CMD0", "CMD8", "ACMD41(1073741824)", "CMD58", "CMD16", "CMD10", "CMD9", "CMD13", "ACMD51(0)", "ACMD13(0)", "CMD6(00FFFFF1)")
+		if d.OCR.CCS != 1 || d.OCR.VDD_WINDOW != 0x1FF {
+			t.Fatalf("OCR CCS %X, VDD_WINDOW %X", d.OCR.CCS, d.OCR.VDD_WINDOW)
+		}
+		// AU_SIZE 9
+		if d.EraseBlockSize() != 4*1024*1024 {
+			t.Fatal(d.EraseBlockSize())
+		}
+		// TRAN_SPEED 25MHz, no high speed mode
+		if d.Frequency() != 25000000 || card.freq != 25000000 {
+			t.Fatal(d.Frequency(), card.freq)
+		}
+	})
+	t.Run("HighSpeed", func(t *testing.T) {
+		card := &fakeCard{csd: testCSDv2, scr: testSCR, highSpeed: true}
+		d := New(card, machine.NoPin)
+		if err := d.Configure(); err != nil {
+			t.Fatal(err)
+		}
+		expectLog(t, card, "CMD0", "CMD8", "ACMD41(1073741824)", "CMD58", "CMD16", "CMD10", "CMD9", "CMD13", "ACMD51(0)", "ACMD13(0)", "CMD6(00FFFFF1)", "CMD6(80FFFFF1)")
+		if d.Frequency() != 50000000 || card.freq != 50000000 {
+			t.Fatal(d.Frequency(), card.freq)
+		}
+	})
+}
+
+func TestCRC(t *testing.T) {
+	// CRC of CMD0 and CMD8 are fixed values used before CRC mode is known
+	if crc := crc7([]byte{0x40, 0x00, 0x00, 0x00, 0x00}); crc != 0x95>>1 {
+		t.Fatalf("CMD0 CRC7: expected %02X, was actually %02X", 0x95>>1, crc)
+	}
+	if crc := crc7([]byte{0x48, 0x00, 0x00, 0x01, 0xAA}); crc != 0x87>>1 {
+		t.Fatalf("CMD8 CRC7: expected %02X, was actually %02X", 0x87>>1, crc)
+	}
+	buf := make([]byte, 512)
+	for i := range buf {
+		buf[i] = 0xFF
+	}
+	if crc := crc16(buf); crc != 0x7FA1 {
+		t.Fatalf("CRC16: expected %04X, was actually %04X", 0x7FA1, crc)
+	}
+
+	t.Run("ReadRetry", func(t *testing.T) {
+		card := &fakeCard{corrupt: map[uint32]int{11: 1}}
+		d := newTestDevice(card)
+		check(t, d.SetCRC(true, 2))
+		buf := make([]byte, 3*512)
+		if _, err := d.ReadAt(buf, 10*512); err != nil {
+			t.Fatal(err)
+		}
+		expectLog(t, card, "CMD59(1)",
+			"CMD18(10)", "BLOCK(10)", "BLOCK(11)", "CMD12",
+			"CMD18(11)", "BLOCK(11)", "BLOCK(12)", "CMD12")
+		expectBlocks(t, buf, 10*512)
+	})
+	t.Run("ReadFail", func(t *testing.T) {
+		card := &fakeCard{corrupt: map[uint32]int{4: 3}}
+		d := newTestDevice(card)
+		check(t, d.SetCRC(true, 2))
+		buf := make([]byte, 512)
+		_, err := d.ReadAt(buf, 4*512)
+		var crcErr CRCError
+		if !errors.As(err, &crcErr) || crcErr.Block != 4 {
+			t.Fatalf("expected CRCError at block 4, was actually %v", err)
+		}
+		expectLog(t, card, "CMD59(1)", "CMD17(4)", "BLOCK(4)", "CMD17(4)", "BLOCK(4)", "CMD17(4)", "BLOCK(4)")
+	})
+	t.Run("WriteRetry", func(t *testing.T) {
+		card := &fakeCard{reject: map[uint32]int{21: 1}}
+		d := newTestDevice(card)
+		check(t, d.SetCRC(true, 1))
+		buf := make([]byte, 2*512)
+		if _, err := d.WriteAt(buf, 20*512); err != nil {
+			t.Fatal(err)
+		}
+		expectLog(t, card, "CMD59(1)", "ACMD23(2)", "CMD25(20)", "DATA(20)", "DATA(21)", "STOP", "CMD24(21)", "DATA(21)")
+	})
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	t.Run("NoResponse", func(t *testing.T) {
+		err := error(CommandError{Cmd: CMD17_READ_SINGLE_BLOCK, R1: 0xFF})
+		if !errors.Is(err, ErrTimeout) || errors.Is(err, ErrCRC) {
+			t.Fatal(err)
+		}
+		expectString(t, "sdcard: CMD17 no response", err.Error())
+	})
+	t.Run("R1", func(t *testing.T) {
+		err := error(CommandError{Cmd: CMD24_WRITE_BLOCK, R1: _R1_COM_CRC_ERROR | _R1_ADDRESS_ERROR})
+		if !errors.Is(err, ErrCRC) || !errors.Is(err, ErrAddress) || errors.Is(err, ErrTimeout) {
+			t.Fatal(err)
+		}
+		expectString(t, "sdcard: CMD24 failed (R1 28, CRC error, address error)", err.Error())
+	})
+	t.Run("Idle", func(t *testing.T) {
+		err := error(CommandError{Cmd: ACMD41_SD_APP_OP_COND, App: true, R1: _R1_IDLE_STATE})
+		if !errors.Is(err, ErrNotInitialized) || errors.Is(err, ErrTimeout) {
+			t.Fatal(err)
+		}
+		expectString(t, "sdcard: ACMD41 failed (R1 01, idle)", err.Error())
+	})
+	t.Run("AddressError", func(t *testing.T) {
+		card := &fakeCard{count: 16}
+		d := newTestDevice(card)
+		_, err := d.ReadAt(make([]byte, 512), 16*512)
+		var cmdErr CommandError
+		if !errors.As(err, &cmdErr) || cmdErr.Cmd != CMD17_READ_SINGLE_BLOCK || !errors.Is(err, ErrAddress) {
+			t.Fatalf("expected CMD17 address error, was actually %v", err)
+		}
+	})
+	t.Run("WriteProtect", func(t *testing.T) {
+		card := &fakeCard{wp: true}
+		d := newTestDevice(card)
+		_, err := d.WriteAt(make([]byte, 512), 3*512)
+		var resErr DataResponseError
+		if !errors.As(err, &resErr) || resErr.Block != 3 || !errors.Is(err, ErrWriteProtect) {
+			t.Fatalf("expected write protect error at block 3, was actually %v", err)
+		}
+		expectLog(t, card, "CMD24(3)", "DATA(3)", "CMD13")
+	})
+}
+
+func TestErase(t *testing.T) {
+	t.Run("EraseBlocks", func(t *testing.T) {
+		card := &fakeCard{}
+		d := newTestDevice(card)
+		d.eraseSize = 64 * 1024
+		check(t, d.EraseBlocks(2, 3))
+		expectLog(t, card, "CMD32(256)", "CMD33(639)", "CMD38")
+	})
+	t.Run("Trim", func(t *testing.T) {
+		card := &fakeCard{byteAddr: true}
+		d := newTestDevice(card)
+		check(t, d.Trim(10*512, 4*512))
+		expectLog(t, card, "CMD32(10)", "CMD33(13)", "CMD38")
+		buf := make([]byte, 6*512)
+		_, err := d.ReadAt(buf, 9*512)
+		check(t, err)
+		expectBlocks(t, buf[:512], 9*512)
+		for i, b := range buf[512 : 5*512] {
+			if b != 0 {
+				t.Fatalf("byte at %d: expected 00, was actually %02X", 10*512+i, b)
+			}
+		}
+		expectBlocks(t, buf[5*512:], 14*512)
+	})
+	t.Run("MMC", func(t *testing.T) {
+		card := &fakeCard{mmc: true, byteAddr: true}
+		d := newTestDevice(card)
+		d.sdCardType = SD_CARD_TYPE_MMC
+		check(t, d.EraseBlocks(4, 2))
+		expectLog(t, card, "CMD25(4)", "DATA(4)", "DATA(5)", "STOP")
+	})
+}
+
+func TestClock(t *testing.T) {
+	t.Run("TranSpeed", func(t *testing.T) {
+		for _, c := range []struct {
+			tranSpeed byte
+			freq      uint32
+		}{
+			{0x32, 25000000},
+			{0x5A, 50000000},
+			{0x2A, 20000000},
+			{0x0B, 100000000},
+			{0x07, 0},
+		} {
+			csd := CSD{TRAN_SPEED: c.tranSpeed}
+			if freq := csd.TranSpeed(); freq != c.freq {
+				t.Errorf("TRAN_SPEED %02X: expected %d, was actually %d", c.tranSpeed, c.freq, freq)
+			}
+		}
+	})
+	t.Run("StepDown", func(t *testing.T) {
+		card := &fakeCard{corrupt: map[uint32]int{4: 4}}
+		d := newTestDevice(card)
+		d.freq = 25000000
+		check(t, d.SetCRC(true, 5))
+		buf := make([]byte, 512)
+		_, err := d.ReadAt(buf, 4*512)
+		check(t, err)
+		// halved after 3 errors, the count restarts at the lower clock
+		if d.Frequency() != 12500000 || card.freq != 12500000 {
+			t.Fatal(d.Frequency(), card.freq)
+		}
+		// a successful transfer resets the count
+		card.corrupt[4] = 2
+		_, err = d.ReadAt(buf, 4*512)
+		check(t, err)
+		card.corrupt[4] = 2
+		_, err = d.ReadAt(buf, 4*512)
+		check(t, err)
+		if d.Frequency() != 12500000 {
+			t.Fatal(d.Frequency())
+		}
+	})
+}
+
+func TestDetect(t *testing.T) {
+	cd, wp := machine.GPIO14, machine.GPIO15
+	defer cd.Low()
+	defer wp.Low()
+	card := &fakeCard{csd: testCSDv2}
+	d := New(card, machine.NoPin)
+	cd.Low()
+	check(t, d.SetDetectPins(cd, wp))
+	check(t, d.Configure())
+	if !d.Present() || !d.Ready() {
+		t.Fatal("expected card to be ready")
+	}
+
+	// removal
+	cd.High()
+	d.detect.update()
+	if ev := <-d.Events(); ev != EventRemoved {
+		t.Fatalf("expected removal event, was actually %d", ev)
+	}
+	if _, err := d.ReadAt(make([]byte, 512), 0); !errors.Is(err, ErrNoCard) {
+		t.Fatalf("expected no card error, was actually %v", err)
+	}
+	if err := d.Configure(); !errors.Is(err, ErrNoCard) {
+		t.Fatalf("expected no card error, was actually %v", err)
+	}
+
+	// insertion, bounce is not reported twice
+	cd.Low()
+	d.detect.update()
+	d.detect.update()
+	if ev := <-d.Events(); ev != EventInserted {
+		t.Fatalf("expected insertion event, was actually %d", ev)
+	}
+	if len(d.Events()) != 0 {
+		t.Fatal("expected no more events")
+	}
+	if d.Ready() {
+		t.Fatal("expected card to need initialization")
+	}
+	check(t, d.Configure())
+	if !d.Ready() {
+		t.Fatal("expected card to be ready")
+	}
+
+	// write protect switch
+	wp.High()
+	if _, err := d.WriteAt(make([]byte, 512), 0); !errors.Is(err, ErrWriteProtect) {
+		t.Fatalf("expected write protect error, was actually %v", err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	t.Run("Password", func(t *testing.T) {
+		card := &fakeCard{}
+		d := newTestDevice(card)
+		check(t, d.SetPassword(nil, []byte("kiosk")))
+		check(t, d.Lock([]byte("kiosk")))
+		locked, err := d.Locked()
+		check(t, err)
+		if !locked {
+			t.Fatal("expected card to be locked")
+		}
+		if _, err := d.ReadAt(make([]byte, 512), 0); !errors.Is(err, ErrIllegalCommand) {
+			t.Fatalf("expected illegal command, was actually %v", err)
+		}
+		if err := d.Unlock([]byte("wrong")); err != ErrPassword {
+			t.Fatalf("expected %v, was actually %v", ErrPassword, err)
+		}
+		check(t, d.Unlock([]byte("kiosk")))
+		check(t, d.SetPassword([]byte("kiosk"), []byte("new")))
+		check(t, d.ClearPassword([]byte("new")))
+		expectLog(t, card,
+			"CMD16", "CMD42(1)", "CMD16", "CMD13",
+			"CMD16", "CMD42(4)", "CMD16", "CMD13",
+			"CMD13",
+			"CMD17(0)",
+			"CMD16", "CMD42(0)", "CMD16", "CMD13",
+			"CMD16", "CMD42(0)", "CMD16", "CMD13",
+			"CMD16", "CMD42(1)", "CMD16", "CMD13",
+			"CMD16", "CMD42(2)", "CMD16", "CMD13")
+		if card.password != nil || card.locked {
+			t.Fatal("expected password to be cleared")
+		}
+	})
+	t.Run("LockedInit", func(t *testing.T) {
+		card := &fakeCard{csd: testCSDv2, password: []byte("kiosk"), locked: true}
+		d := New(card, machine.NoPin)
+		if err := d.Configure(); err != ErrCardLocked {
+			t.Fatalf("expected %v, was actually %v", ErrCardLocked, err)
+		}
+		if d.Ready() {
+			t.Fatal("expected locked card not to be ready")
+		}
+		card.log = nil
+		check(t, d.Unlock([]byte("kiosk")))
+		if !d.Ready() {
+			t.Fatal("expected card to be ready after unlock")
+		}
+		expectLog(t, card, "CMD16", "CMD42(0)", "CMD16", "CMD13",
+			"CMD0", "CMD8", "ACMD41(1073741824)", "CMD58", "CMD16", "CMD10", "CMD9", "CMD13", "ACMD51(0)", "ACMD13(0)")
+	})
+	t.Run("TempWriteProtect", func(t *testing.T) {
+		card := &fakeCard{csd: append([]byte{}, testCSDv2...)}
+		d := newTestDevice(card)
+		d.CSD = NewCSD(card.csd)
+		check(t, d.SetTempWriteProtect(true))
+		protected, err := d.TempWriteProtected()
+		check(t, err)
+		if !protected || card.csd[14]&0x10 == 0 {
+			t.Fatal("expected TMP_WRITE_PROTECT to be set")
+		}
+		check(t, d.SetTempWriteProtect(false))
+		if d.CSD.TMP_WRITE_PROTECT != 0 {
+			t.Fatal("expected TMP_WRITE_PROTECT to be cleared")
+		}
+		expectLog(t, card, "CMD27", "CMD9", "CMD9", "CMD27", "CMD9")
+	})
+	t.Run("WriteProtectGroups", func(t *testing.T) {
+		card := &fakeCard{byteAddr: true}
+		d := newTestDevice(card)
+		check(t, d.SetWriteProtectGroup(128, true))
+		check(t, d.SetWriteProtectGroup(192, true))
+		check(t, d.SetWriteProtectGroup(128, false))
+		groups, err := d.WriteProtectGroups(64)
+		check(t, err)
+		if groups != 0x04 {
+			t.Fatalf("expected groups 04, was actually %02X", groups)
+		}
+		expectLog(t, card, "CMD28(128)", "CMD28(192)", "CMD29(128)", "CMD30(64)")
+	})
+	t.Run("Clock", func(t *testing.T) {
+		card := &fakeCard{csd: append([]byte{}, testCSDv2...)}
+		d := newTestDevice(card)
+		d.freq = 12000000
+		d.CSD = NewCSD(card.csd)
+		for _, fn := range []func() error{
+			func() error { return d.SetPassword(nil, []byte("kiosk")) },
+			func() error { _, err := d.Locked(); return err },
+			func() error { return d.ClearPassword([]byte("kiosk")) },
+			func() error { return d.SetTempWriteProtect(true) },
+			func() error { _, err := d.TempWriteProtected(); return err },
+			func() error { return d.SetWriteProtectGroup(128, true) },
+			func() error { _, err := d.WriteProtectGroups(128); return err },
+		} {
+			// the codec on the shared bus set its clock
+			card.freq = 4000000
+			check(t, fn())
+			if card.freq != d.freq {
+				t.Fatalf("expected %d, was actually %d", d.freq, card.freq)
+			}
+		}
+	})
+}
+
+func TestTimeout(t *testing.T) {
+	t.Run("NoResponse", func(t *testing.T) {
+		card := &fakeCard{}
+		d := newTestDevice(card)
+		card.mute = true
+		_, err := d.ReadAt(make([]byte, 512), 0)
+		var cmdErr CommandError
+		if !errors.As(err, &cmdErr) || cmdErr.Cmd != CMD17_READ_SINGLE_BLOCK || !errors.Is(err, ErrTimeout) {
+			t.Fatalf("expected CMD17 timeout, was actually %v", err)
+		}
+	})
+	t.Run("BusyAfterWrite", func(t *testing.T) {
+		card := &fakeCard{stuck: true}
+		d := newTestDevice(card)
+		if _, err := d.WriteAt(make([]byte, 512), 0); !errors.Is(err, ErrTimeout) {
+			t.Fatalf("expected timeout, was actually %v", err)
+		}
+	})
+	t.Run("BusyInMultiWrite", func(t *testing.T) {
+		card := &fakeCard{stuck: true}
+		d := newTestDevice(card)
+		if _, err := d.WriteAt(make([]byte, 4*512), 0); !errors.Is(err, ErrTimeout) {
+			t.Fatalf("expected timeout, was actually %v", err)
+		}
+		expectLog(t, card, "ACMD23(4)", "CMD25(0)", "DATA(0)", "STOP")
+	})
+	t.Run("BusyErase", func(t *testing.T) {
+		card := &fakeCard{stuck: true}
+		d := newTestDevice(card)
+		if err := d.EraseBlocks(0, 2); !errors.Is(err, ErrTimeout) {
+			t.Fatalf("expected timeout, was actually %v", err)
+		}
+	})
+}
+
+func expectString(t *testing.T, expected string, actual string) {
+	t.Helper()
+	if expected != actual {
+		t.Fatalf("expected \"%s\", was actually \"%s\"", expected, actual)
+	}
+}
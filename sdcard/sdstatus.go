@@ -0,0 +1,105 @@
+package sdcard
+
+import (
+	"fmt"
+)
+
+type SDStatus struct {
+	DAT_BUS_WIDTH          byte   //  2 [511:510] : currently defined data bus width
+	SECURED_MODE           byte   //  1 [509:509] : card is in secured mode of operation
+	SD_CARD_TYPE           uint16 // 16 [495:480] : 0x0000 regular, 0x0001 ROM, 0x0002 OTP
+	SIZE_OF_PROTECTED_AREA uint32 // 32 [479:448] : size of protected area
+	SPEED_CLASS            byte   //  8 [447:440] : speed class of the card
+	PERFORMANCE_MOVE       byte   //  8 [439:432] : performance of move indicated by 1 [MB/s] step
+	AU_SIZE                byte   //  4 [431:428] : size of AU
+	ERASE_SIZE             uint16 // 16 [423:408] : number of AUs to be erased at a time
+	ERASE_TIMEOUT          byte   //  6 [407:402] : timeout value for erasing areas specified by ERASE_SIZE
+	ERASE_OFFSET           byte   //  2 [401:400] : fixed offset value added to erase time
+	UHS_SPEED_GRADE        byte   //  4 [399:396] : speed grade for UHS mode
+	UHS_AU_SIZE            byte   //  4 [395:392] : size of AU for UHS card
+	VIDEO_SPEED_CLASS      byte   //  8 [391:384] : video speed class value of the card
+	VSC_AU_SIZE            uint16 // 10 [377:368] : size of AU for video speed class
+	APP_PERF_CLASS         byte   //  4 [339:336] : application performance class value of the card
+	PERFORMANCE_ENHANCE    byte   //  8 [335:328] : support for performance enhancement functionalities
+	DISCARD_SUPPORT        byte   //  1 [313:313] : discard support
+	FULE_SUPPORT           byte   //  1 [312:312] : full user area logical erase support
+}
+
+func NewSDStatus(buf []byte) *SDStatus {
+	return &SDStatus{
+		DAT_BUS_WIDTH:          (buf[0] & 0xC0) >> 6,
+		SECURED_MODE:           (buf[0] & 0x20) >> 5,
+		SD_CARD_TYPE:           uint16(buf[2])<<8 | uint16(buf[3]),
+		SIZE_OF_PROTECTED_AREA: uint32(buf[4])<<24 | uint32(buf[5])<<16 | uint32(buf[6])<<8 | uint32(buf[7]),
+		SPEED_CLASS:            buf[8],
+		PERFORMANCE_MOVE:       buf[9],
+		AU_SIZE:                (buf[10] & 0xF0) >> 4,
+		ERASE_SIZE:             uint16(buf[11])<<8 | uint16(buf[12]),
+		ERASE_TIMEOUT:          (buf[13] & 0xFC) >> 2,
+		ERASE_OFFSET:           buf[13] & 0x03,
+		UHS_SPEED_GRADE:        (buf[14] & 0xF0) >> 4,
+		UHS_AU_SIZE:            buf[14] & 0x0F,
+		VIDEO_SPEED_CLASS:      buf[15],
+		VSC_AU_SIZE:            uint16(buf[16]&0x03)<<8 | uint16(buf[17]),
+		APP_PERF_CLASS:         buf[21] & 0x0F,
+		PERFORMANCE_ENHANCE:    buf[22],
+		DISCARD_SUPPORT:        (buf[24] & 0x02) >> 1,
+		FULE_SUPPORT:           buf[24] & 0x01,
+	}
+}
+
+func (s *SDStatus) Dump() {
+	fmt.Printf("DAT_BUS_WIDTH:          %X\r\n", s.DAT_BUS_WIDTH)
+	fmt.Printf("SECURED_MODE:           %X\r\n", s.SECURED_MODE)
+	fmt.Printf("SD_CARD_TYPE:           %X\r\n", s.SD_CARD_TYPE)
+	fmt.Printf("SIZE_OF_PROTECTED_AREA: %X\r\n", s.SIZE_OF_PROTECTED_AREA)
+	fmt.Printf("SPEED_CLASS:            %X\r\n", s.SPEED_CLASS)
+	fmt.Printf("PERFORMANCE_MOVE:       %X\r\n", s.PERFORMANCE_MOVE)
+	fmt.Printf("AU_SIZE:                %X\r\n", s.AU_SIZE)
+	fmt.Printf("ERASE_SIZE:             %X\r\n", s.ERASE_SIZE)
+	fmt.Printf("ERASE_TIMEOUT:          %X\r\n", s.ERASE_TIMEOUT)
+	fmt.Printf("ERASE_OFFSET:           %X\r\n", s.ERASE_OFFSET)
+	fmt.Printf("UHS_SPEED_GRADE:        %X\r\n", s.UHS_SPEED_GRADE)
+	fmt.Printf("UHS_AU_SIZE:            %X\r\n", s.UHS_AU_SIZE)
+	fmt.Printf("VIDEO_SPEED_CLASS:      %X\r\n", s.VIDEO_SPEED_CLASS)
+	fmt.Printf("VSC_AU_SIZE:            %X\r\n", s.VSC_AU_SIZE)
+	fmt.Printf("APP_PERF_CLASS:         %X\r\n", s.APP_PERF_CLASS)
+	fmt.Printf("PERFORMANCE_ENHANCE:    %X\r\n", s.PERFORMANCE_ENHANCE)
+	fmt.Printf("DISCARD_SUPPORT:        %X\r\n", s.DISCARD_SUPPORT)
+	fmt.Printf("FULE_SUPPORT:           %X\r\n", s.FULE_SUPPORT)
+}
+
+// SpeedClass returns the SD speed class of the card (minimum sequential
+// write performance in MB/s), 0 if the card is not classified.
+func (s *SDStatus) SpeedClass() int {
+	switch s.SPEED_CLASS {
+	case 1:
+		return 2
+	case 2:
+		return 4
+	case 3:
+		return 6
+	case 4:
+		return 10
+	}
+	return 0
+}
+
+// AUSize returns the allocation unit size in bytes, 0 if it is not defined.
+func (s *SDStatus) AUSize() int64 {
+	return auSize(s.AU_SIZE)
+}
+
+// auSize returns the allocation unit size in bytes for the AU_SIZE field of
+// SD Status, or 0 if it is not defined.
+func auSize(code byte) int64 {
+	switch {
+	case code == 0 || code > 0x0F:
+		return 0
+	case code <= 0x0A:
+		// 16KB .. 8MB
+		return 8192 << code
+	}
+	// 12MB, 16MB, 24MB, 32MB, 64MB
+	return []int64{12, 16, 24, 32, 64}[code-0x0B] << 20
+}
@@ -4,7 +4,8 @@ import (
 	"time"
 )
 
-var timeoutTimer [2]timer
+// timer 0: initialization and start block, 1: busy, 2: command response
+var timeoutTimer [3]timer
 
 type timer struct {
 	start   int64
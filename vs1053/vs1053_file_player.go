@@ -32,13 +32,15 @@ package vs1053
 import (
     "fmt"
     "io"
+    "sync"
     "time"
 )
 
+// File is the track to play, such as *fatfs.File, io.SectionReader or
+// bytes.Reader.
 type File interface {
-    Tell() (ret int64, err error)
-    Seek(offset int64) error
-    Read(buf []byte) (n int, err error)
+    io.Reader
+    io.Seeker
 }
 
 type Player struct {
@@ -48,6 +50,8 @@ type Player struct {
     currentTrack File
     mp3Buf       []byte
     mp3BufReq    chan struct{}
+    mu           sync.Mutex // guards mp3BufReq and the state changed by finish
+    err          error
 }
 
 const (
@@ -82,28 +86,55 @@ func (p *Player) PlayFullFile(file File) error {
 }
 
 func (p *Player) StopPlaying() error {
-    // stop DreqInterrupt and cancel all playback
-    p.codec.setDreqInterrupt(false, nil)
+    // cancel all playback
     p.codec.sciWrite(REG_MODE, MODE_SM_LINE1 | MODE_SM_SDINEW | MODE_SM_CANCEL)
-
-    // wrap it up!
-    close(p.mp3BufReq)
+    p.finish()
     return nil
 }
 
+// finish stops DreqInterrupt and closes the request channel, which ends the
+// feeding goroutine. It may be called more than once, also at the same time
+// by the feeding goroutine at the end of the track and by StopPlaying.
+func (p *Player) finish() {
+    p.codec.setDreqInterrupt(false, nil)
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.mp3BufReq != nil {
+        close(p.mp3BufReq)
+        p.mp3BufReq = nil
+    } else {
+        // goroutine not started yet
+        p.isPlaying = false
+        p.isPaused = false
+    }
+}
+
+// Err returns the read error which stopped the playback, nil if the track
+// was played to the end or stopped by StopPlaying.
+func (p *Player) Err() error {
+    return p.err
+}
+
 func (p *Player) PausePlaying(pause bool) error {
+    p.mu.Lock()
     p.isPaused = pause
-    if p.isPlaying && !p.isPaused {
+    resume := p.isPlaying && !p.isPaused
+    p.mu.Unlock()
+    if resume {
         p.feedBuffer()
     }
     return nil
 }
 
 func (p *Player) Paused() bool {
+    p.mu.Lock()
+    defer p.mu.Unlock()
     return p.isPlaying && p.isPaused
 }
 
 func (p *Player) Stopped() bool {
+    p.mu.Lock()
+    defer p.mu.Unlock()
     return !p.isPlaying
 }
 
@@ -120,6 +151,7 @@ func (p *Player) StartPlayingFile(file File) error {
     p.codec.sciWrite(REG_WRAM, 0)
 
     p.currentTrack = file
+    p.err = nil
 
     // We know we have a valid file. Check if .mp3
     // If so, check for ID3 tag and jump it if present.
@@ -127,14 +159,16 @@ func (p *Player) StartPlayingFile(file File) error {
     if err != nil {
         return fmt.Errorf("mp3_ID3Jumper failed: %s", err.Error())
     }
-    p.currentTrack.Seek(pos)
+    p.currentTrack.Seek(pos, io.SeekStart)
 
     // As explained in datasheet, set twice 0 in REG_DECODETIME to set time back to 0
     p.codec.sciWrite(REG_DECODETIME, 0x00)
     p.codec.sciWrite(REG_DECODETIME, 0x00)
 
+    p.mu.Lock()
     p.isPlaying = true
     p.isPaused = false
+    p.mu.Unlock()
 
     // wait till its ready for data
     for !p.codec.readyForData() {}
@@ -143,11 +177,21 @@ func (p *Player) StartPlayingFile(file File) error {
     for p.isPlaying && !p.isPaused && p.codec.readyForData() {
         p.feedBuffer()
     }
+    if !p.isPlaying {
+        // track ended while filling up
+        return p.err
+    }
 
     // open channel & set interrupt
-    p.mp3BufReq = make(chan struct{}, REQ_CH_SZ)
+    req := make(chan struct{}, REQ_CH_SZ)
+    p.mu.Lock()
+    p.mp3BufReq = req
+    p.mu.Unlock()
     p.codec.setDreqInterrupt(true, func() {
-        p.mp3BufReq <- struct{}{} // send event (no type)
+        select {
+        case req <- struct{}{}: // send event (no type)
+        default: // request already pending
+        }
     })
 
     // ok going forward, we can use goroutine
@@ -155,14 +199,16 @@ func (p *Player) StartPlayingFile(file File) error {
         for {
             _, more := <-req
             if !more {
+                p.codec.setDreqInterrupt(false, nil)
+                p.mu.Lock()
                 p.isPlaying = false
                 p.isPaused = false
-                p.codec.setDreqInterrupt(false, nil)
+                p.mu.Unlock()
                 return
             }
             p.feedBuffer()
         }
-    } (p.mp3BufReq)
+    } (req)
 
     return nil
 }
@@ -172,19 +218,19 @@ func (p *Player) mp3_ID3Jumper(mp3 File) (start int64, err error) {
     if mp3 == nil {
         return 0, fmt.Errorf("nil file")
     }
-    current, _ := mp3.Tell()
-    err = mp3.Seek(0)
+    current, _ := mp3.Seek(0, io.SeekCurrent)
+    _, err = mp3.Seek(0, io.SeekStart)
     if err != nil {
         return 0, fmt.Errorf("Seek failed")
     }
-    defer mp3.Seek(current)
+    defer mp3.Seek(current, io.SeekStart)
     buf := make([]byte, 3)
     br, err := mp3.Read(buf)
     if err != nil || br != 3 {
         return 0, fmt.Errorf("Read failed")
     }
     if string(buf) == "ID3" {
-        mp3.Seek(6)
+        mp3.Seek(6, io.SeekStart)
         for i := 0; i < 4; i++ {
             start <<= 7
             mp3.Read(buf[:1])
@@ -206,9 +252,12 @@ func (p *Player) feedBuffer() {
         // Read some audio data from the SD card file
         br, err := p.currentTrack.Read(p.mp3Buf)
 
-        if err == io.EOF {
-            // must be at the end of the file, wrap it up!
-            close(p.mp3BufReq)
+        if err != nil {
+            // must be at the end of the file or the card is gone, wrap it up!
+            if err != io.EOF {
+                p.err = err
+            }
+            p.finish()
             break
         }
 